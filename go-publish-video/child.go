@@ -1,8 +1,11 @@
+//go:build child
+
 package main
 
 import (
 	"bufio"
 	"encoding/binary"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -12,6 +15,7 @@ import (
 	"time"
 
 	"go-publish-video/ipc/ipcgen"
+	"go-publish-video/media"
 
 	agoraservice "github.com/AgoraIO-Extensions/Agora-Golang-Server-SDK/v2/go_sdk/rtc"
 	flatbuffers "github.com/google/flatbuffers/go"
@@ -32,11 +36,18 @@ var (
 	initAudioChannels int32
 	initBitrate       int
 	initMinBitrate    int
+	// Frames arrive already encoded and are published without re-encoding
+	encodedVideo bool
+	// Audio arrives as Opus or AAC frames instead of PCM
+	encodedAudio bool
 
 	globalAppID   string
 	globalChannel string
 	globalUserID  string
 	globalCodecName string
+
+	// Paces samples from the parent to their presentation time
+	playout *media.PlayoutBuffer
 )
 
 func onConnected(conn *agoraservice.RtcConnection, conInfo *agoraservice.RtcConnectionInfo, reason int) {
@@ -93,6 +104,11 @@ func onUserJoined(conn *agoraservice.RtcConnection, uid string) {
 	logMsg := fmt.Sprintf("Agora SDK: User %s joined", uid)
 	childLogger.Println(logMsg)
 	sendAsyncLogResponse(ipcgen.LogLevelINFO, logMsg)
+	sendAsyncActivityResponse(ipcgen.ActivityKindUSER_JOINED, uid)
+}
+
+func onStreamMessage(localUser *agoraservice.LocalUser, uid string, streamId int, data []byte) {
+	sendAsyncActivityResponse(ipcgen.ActivityKindSTREAM_MESSAGE, uid)
 }
 
 func onUserLeft(conn *agoraservice.RtcConnection, uid string, reason int) {
@@ -170,6 +186,14 @@ func main() {
 	bitrateFlag := flag.Int("bitrate", 1000, "Video target bitrate in Kbps")
 	minBitrateFlag := flag.Int("minBitrate", 100, "Video minimum bitrate in Kbps")
 	enableStringUIDFlag := flag.Bool("enableStringUID", false, "Enable string UID support")
+	sdkLogPathFlag := flag.String("sdkLogPath", "./agora_child_sdk.log", "Agora SDK log file path")
+	playoutCfg := media.DefaultPlayoutConfig()
+	flag.DurationVar(&playoutCfg.Delay, "playoutDelay", playoutCfg.Delay, "Latency added by the playout buffer to absorb jitter")
+	flag.DurationVar(&playoutCfg.MaxBuffered, "playoutMaxBuffer", playoutCfg.MaxBuffered, "How far ahead of its presentation time a sample may be buffered")
+	flag.DurationVar(&playoutCfg.MaxLate, "playoutMaxLate", playoutCfg.MaxLate, "How late a sample may arrive and still be played")
+	playoutReportFlag := flag.Duration("playoutReportInterval", 5*time.Second, "How often to report playout buffer stats to the parent (0 disables)")
+	encodedVideoFlag := flag.Bool("encodedVideo", false, "Publish pre-encoded video frames through the SDK's encoded-image path instead of raw frames")
+	encodedAudioFlag := flag.Bool("encodedAudio", false, "Publish pre-encoded Opus or AAC audio through the SDK's encoded audio path instead of PCM")
 
 	flag.Parse()
 
@@ -185,6 +209,8 @@ func main() {
 	initAudioChannels = int32(*audioChannelsFlag)
 	initBitrate = *bitrateFlag
 	initMinBitrate = *minBitrateFlag
+	encodedVideo = *encodedVideoFlag
+	encodedAudio = *encodedAudioFlag
 	enableStringUID := *enableStringUIDFlag
 
 	childLogger.Printf("Initial parameters from command line: AppID=%s, Channel=%s, UserID=%s, Codec=%s, Res=%dx%d@%d, Bitrate=%dKbps, MinBitrate=%dKbps, AudioSR=%d, AudioCh=%d, StringUID=%t",
@@ -198,7 +224,7 @@ func main() {
 	serviceCfg.EnableVideo = true
 	serviceCfg.AppId = globalAppID
 	serviceCfg.UseStringUid = enableStringUID
-	serviceCfg.LogPath = "./agora_child_sdk.log"
+	serviceCfg.LogPath = *sdkLogPathFlag
 	serviceCfg.LogSize = 5 * 1024 * 1024
 	serviceCfg.LogLevel = 5  // Error only
 
@@ -261,6 +287,21 @@ func main() {
 	publishConfig.AudioProfile = agoraservice.AudioProfileDefault
 	publishConfig.AudioPublishType = agoraservice.AudioPublishTypePcm
 	publishConfig.VideoPublishType = agoraservice.VideoPublishTypeYuv
+	if encodedVideo {
+		// The SDK sends the frames as they are, so it only needs to know the codec
+		publishConfig.VideoPublishType = agoraservice.VideoPublishTypeEncodedImage
+		publishConfig.VideoEncodedImageSenderOptions = &agoraservice.VideoEncodedImageSenderOptions{
+			CcMode:        agoraservice.VideoSendCcEnabled,
+			CodecType:     initVideoCodec,
+			TargetBitrate: initBitrate,
+		}
+		childLogger.Printf("Publishing pre-encoded %s video", globalCodecName)
+	}
+	if encodedAudio {
+		// The codec is given with every frame
+		publishConfig.AudioPublishType = agoraservice.AudioPublishTypeEncodedPcm
+		childLogger.Println("Publishing pre-encoded audio")
+	}
 
 	rtcConnection = agoraservice.NewRtcConnection(connCfg, publishConfig)
 	if rtcConnection == nil {
@@ -290,6 +331,10 @@ func main() {
 	}
 	
 	rtcConnection.RegisterObserver(observer)
+	// Stream messages only count as activity for the parent's idle timeout
+	rtcConnection.RegisterLocalUserObserver(&agoraservice.LocalUserObserver{
+		OnStreamMessage: onStreamMessage,
+	})
 	childLogger.Println("Agora RtcConnection created and observer registered.")
 
 	// Add delay before connect to let SDK finish initialization
@@ -311,8 +356,19 @@ func main() {
 	time.Sleep(100 * time.Millisecond)
 	sendStatusResponse(ipcgen.ConnectionStatusINITIALIZED_SUCCESS, fmt.Sprintf("Connect call issued with %s codec, awaiting callback.", globalCodecName), "")
 
+	playout = media.NewPlayoutBuffer(playoutCfg, pushSample)
+	childLogger.Printf("Playout buffer started: delay=%v, maxBuffer=%v, maxLate=%v",
+		playoutCfg.Delay, playoutCfg.MaxBuffered, playoutCfg.MaxLate)
+	if *playoutReportFlag > 0 {
+		go reportPlayoutStats(*playoutReportFlag)
+	}
+
 	reader := bufio.NewReader(os.Stdin)
 
+	// Encoded frames only decode after the key frame they depend on, so once
+	// one is lost everything up to the next key frame is dropped
+	waitForKeyFrame := true
+
 	for {
 		// Read 4-byte length prefix
 		lenBytes := make([]byte, 4)
@@ -322,6 +378,8 @@ func main() {
 			} else {
 				childLogger.Printf("Error reading message length from stdin: %v. Exiting.", err)
 			}
+			// Leave the channel properly even without a CLOSE command
+			cleanupAgoraResources()
 			return
 		}
 		msgLen := binary.BigEndian.Uint32(lenBytes)
@@ -335,6 +393,7 @@ func main() {
 		msgBuf := make([]byte, msgLen)
 		if _, err := io.ReadFull(reader, msgBuf); err != nil {
 			childLogger.Printf("Error reading message payload (len %d) from stdin: %v. Exiting.", msgLen, err)
+			cleanupAgoraResources()
 			return
 		}
 
@@ -350,7 +409,7 @@ func main() {
 				childLogger.Println("Received Close command. Cleaning up and exiting.")
 				cleanupAgoraResources()
 				sendAsyncLogResponse(ipcgen.LogLevelINFO, "Child process shutting down.")
-				sendAsyncStatusResponse(ipcgen.ConnectionStatusDISCONNECTED, "", "Closed by parent command")
+				sendAsyncStatusResponse(ipcgen.ConnectionStatusDISCONNECTED, "", closeAckInfo)
 				childLogger.Println("Child process terminated by close command.")
 				return
 			}
@@ -382,15 +441,80 @@ func main() {
 				frameData[i] = byte(samplePayload.Data(i))
 			}
 
-			extFrame := &agoraservice.ExternalVideoFrame{
-				Type:      agoraservice.VideoBufferRawData,
-				Format:    agoraservice.VideoPixelI420,
-				Buffer:    frameData,
-				Stride:    int(initWidth),
-				Height:    int(initHeight),
-				Timestamp: int64(0),
+			pixelFormat, ok := mediaPixelFormat(samplePayload.PixelFormat())
+			if !ok {
+				childLogger.Printf("Dropping video frame with unknown pixel format %d", samplePayload.PixelFormat())
+				continue
+			}
+			// The SDK reads the frame from the configured width and height
+			if err := pixelFormat.CheckSize(int(initWidth), int(initHeight)); err != nil {
+				childLogger.Printf("Dropping video frame: %v", err)
+				continue
+			}
+			if expected := pixelFormat.FrameSize(int(initWidth), int(initHeight)); len(frameData) != expected {
+				childLogger.Printf("Dropping %s video frame of %d bytes, expected %d for %dx%d", pixelFormat, len(frameData), expected, initWidth, initHeight)
+				continue
+			}
+
+			playout.Push(media.Sample{
+				Kind:  media.KindVideo,
+				PTS:   time.Duration(samplePayload.TimestampUnixNano()),
+				Data:  frameData,
+				Pixel: pixelFormat,
+			})
+
+		case ipcgen.MessageTypeWRITE_ENCODED_VIDEO_COMMAND:
+			if rtcConnection == nil {
+				continue
+			}
+			if !encodedVideo {
+				childLogger.Println("Dropping encoded video frame, the child was not started with -encodedVideo")
+				continue
+			}
+
+			// Parse EncodedVideoSamplePayload from payload bytes
+			samplePayload := ipcgen.GetRootAsEncodedVideoSamplePayload(payloadBytes, 0)
+			dataLen := samplePayload.DataLength()
+			if dataLen == 0 {
+				continue
+			}
+
+			// Extract frame data
+			frameData := make([]byte, dataLen)
+			for i := 0; i < int(dataLen); i++ {
+				frameData[i] = byte(samplePayload.Data(i))
+			}
+
+			codec, ok := mediaVideoCodec(samplePayload.Codec())
+			if !ok || sdkVideoCodec(codec) != initVideoCodec {
+				childLogger.Printf("Dropping encoded video frame with codec %d, the track is %s", samplePayload.Codec(), globalCodecName)
+				continue
+			}
+			key := samplePayload.KeyFrame()
+			if waitForKeyFrame && !key {
+				continue
+			}
+			waitForKeyFrame = false
+
+			resyncs := playout.Resyncs()
+			pushed := playout.Push(media.Sample{
+				Kind: media.KindVideo,
+				PTS:  time.Duration(samplePayload.TimestampNano()),
+				Data: frameData,
+				EncodedVideo: &media.EncodedFrameInfo{
+					Codec:     codec,
+					Key:       key,
+					Width:     int(samplePayload.Width()),
+					Height:    int(samplePayload.Height()),
+					FrameRate: int(samplePayload.FrameRate()),
+				},
+			})
+			// A dropped frame, or queued frames discarded by a resync, break
+			// the chain of frames the decoder depends on
+			if !pushed || (playout.Resyncs() != resyncs && !key) {
+				childLogger.Println("Encoded video frame lost, waiting for the next key frame")
+				waitForKeyFrame = true
 			}
-			rtcConnection.PushVideoFrame(extFrame)
 
 		case ipcgen.MessageTypeWRITE_AUDIO_SAMPLE_COMMAND:
 			if rtcConnection == nil {
@@ -410,14 +534,94 @@ func main() {
 				frameData[i] = byte(samplePayload.Data(i))
 			}
 
-			// Push audio PCM data directly
-			rtcConnection.PushAudioPcmData(frameData, int(initSampleRate), int(initAudioChannels), 0)
+			playout.Push(media.Sample{
+				Kind: media.KindAudio,
+				PTS:  time.Duration(samplePayload.TimestampUnixNano()),
+				Data: frameData,
+			})
+
+		case ipcgen.MessageTypeWRITE_ENCODED_AUDIO_COMMAND:
+			if rtcConnection == nil {
+				continue
+			}
+			if !encodedAudio {
+				childLogger.Println("Dropping encoded audio frame, the child was not started with -encodedAudio")
+				continue
+			}
+
+			// Parse EncodedAudioSamplePayload from payload bytes
+			samplePayload := ipcgen.GetRootAsEncodedAudioSamplePayload(payloadBytes, 0)
+			dataLen := samplePayload.DataLength()
+			if dataLen == 0 {
+				continue
+			}
+
+			// Extract frame data
+			frameData := make([]byte, dataLen)
+			for i := 0; i < int(dataLen); i++ {
+				frameData[i] = byte(samplePayload.Data(i))
+			}
+
+			codec, ok := mediaAudioCodec(samplePayload.Codec())
+			if !ok {
+				childLogger.Printf("Dropping encoded audio frame with unknown codec %d", samplePayload.Codec())
+				continue
+			}
+			format := &media.EncodedAudioFormat{
+				Codec:           codec,
+				SampleRate:      int(samplePayload.SampleRate()),
+				Channels:        int(samplePayload.Channels()),
+				SamplesPerFrame: int(samplePayload.SamplesPerChannel()),
+			}
+			if format.SampleRate <= 0 || format.Channels <= 0 || format.SamplesPerFrame <= 0 {
+				childLogger.Printf("Dropping encoded audio frame with invalid format %d Hz, %d channels, %d samples", format.SampleRate, format.Channels, format.SamplesPerFrame)
+				continue
+			}
+
+			playout.Push(media.Sample{
+				Kind:         media.KindAudio,
+				PTS:          time.Duration(samplePayload.TimestampNano()),
+				Data:         frameData,
+				EncodedAudio: format,
+			})
+
+		case ipcgen.MessageTypeINTERRUPT_COMMAND:
+			if rtcConnection == nil {
+				continue
+			}
+
+			// Parse InterruptPayload from payload bytes
+			interruptPayload := ipcgen.GetRootAsInterruptPayload(payloadBytes, 0)
+			fade := time.Duration(interruptPayload.FadeOutMs()) * time.Millisecond
+			if encodedAudio {
+				// Compressed frames cannot be faded, they are dropped too
+				fade = 0
+			}
+			dropped := playout.Flush(fade, func(samples []media.Sample) {
+				media.FadeOutPCM16(samples, int(initAudioChannels))
+			})
+			// Audio already pushed would otherwise still be sent
+			if ret := rtcConnection.InterruptAudio(); ret != 0 {
+				childLogger.Printf("Failed to clear the SDK's pending audio, error code: %d", ret)
+			}
+			// Dropped frames break the chain of frames the decoder depends on
+			if encodedVideo && dropped[media.KindVideo] > 0 {
+				waitForKeyFrame = true
+			}
+			childLogger.Printf("Interrupted: dropped %d audio and %d video samples, fading out %v",
+				dropped[media.KindAudio], dropped[media.KindVideo], fade)
 
 		case ipcgen.MessageTypeCLOSE_COMMAND:
-			childLogger.Println("Received Close command. Cleaning up and exiting.")
+			// Without a reason the payload is empty
+			reason := closeCommandReason(ipcMsg)
+			shutdownMessage := "Child process shutting down."
+			if reason != "" {
+				shutdownMessage = "Child process shutting down: " + reason
+			}
+			childLogger.Printf("Received Close command (reason: %q). Cleaning up and exiting.", reason)
 			cleanupAgoraResources()
-			sendAsyncLogResponse(ipcgen.LogLevelINFO, "Child process shutting down.")
-			sendAsyncStatusResponse(ipcgen.ConnectionStatusDISCONNECTED, "", "Closed by parent command")
+			sendAsyncLogResponse(ipcgen.LogLevelINFO, shutdownMessage)
+			sendAsyncStatusResponse(ipcgen.ConnectionStatusDISCONNECTED, reason, closeAckInfo)
 			childLogger.Println("Child process terminated by close command.")
 			return
 
@@ -429,6 +633,145 @@ func main() {
 	}
 }
 
+// pushSample hands a sample released by the playout buffer to the SDK. The
+// session-relative presentation time is passed on in milliseconds.
+func pushSample(s media.Sample) {
+	if rtcConnection == nil {
+		return
+	}
+	timestampMs := int64(s.PTS / time.Millisecond)
+
+	switch s.Kind {
+	case media.KindVideo:
+		if s.EncodedVideo != nil {
+			frameType := agoraservice.VideoFrameTypeDeltaFrame
+			if s.EncodedVideo.Key {
+				frameType = agoraservice.VideoFrameTypeKeyFrame
+			}
+			rtcConnection.PushVideoEncodedData(s.Data, &agoraservice.EncodedVideoFrameInfo{
+				CodecType:       sdkVideoCodec(s.EncodedVideo.Codec),
+				Width:           s.EncodedVideo.Width,
+				Height:          s.EncodedVideo.Height,
+				FramesPerSecond: s.EncodedVideo.FrameRate,
+				FrameType:       frameType,
+				Rotation:        agoraservice.VideoOrientation0,
+				CaptureTimeMs:   timestampMs,
+				DecodeTimeMs:    timestampMs,
+				PresentTimeMs:   timestampMs,
+			})
+			return
+		}
+		extFrame := &agoraservice.ExternalVideoFrame{
+			Type:      agoraservice.VideoBufferRawData,
+			Format:    sdkPixelFormat(s.Pixel),
+			Buffer:    s.Data,
+			Stride:    int(initWidth), // in pixels, for every format
+			Height:    int(initHeight),
+			Timestamp: timestampMs,
+		}
+		rtcConnection.PushVideoFrame(extFrame)
+	case media.KindAudio:
+		if s.EncodedAudio != nil {
+			rtcConnection.PushAudioEncodedData(s.Data, &agoraservice.EncodedAudioFrameInfo{
+				Speech:            true,
+				Codec:             sdkAudioCodec(s.EncodedAudio.Codec),
+				SampleRateHz:      s.EncodedAudio.SampleRate,
+				SamplesPerChannel: s.EncodedAudio.SamplesPerFrame,
+				SendEvenIfEmpty:   true,
+				NumberOfChannels:  s.EncodedAudio.Channels,
+				CaptureTimeMs:     timestampMs,
+			})
+			return
+		}
+		rtcConnection.PushAudioPcmData(s.Data, int(initSampleRate), int(initAudioChannels), timestampMs)
+	}
+}
+
+func mediaPixelFormat(format ipcgen.PixelFormat) (media.PixelFormat, bool) {
+	switch format {
+	case ipcgen.PixelFormatI420:
+		return media.PixelI420, true
+	case ipcgen.PixelFormatNV12:
+		return media.PixelNV12, true
+	case ipcgen.PixelFormatRGBA:
+		return media.PixelRGBA, true
+	case ipcgen.PixelFormatBGRA:
+		return media.PixelBGRA, true
+	}
+	return 0, false
+}
+
+func mediaVideoCodec(codec ipcgen.VideoCodec) (media.VideoCodec, bool) {
+	switch codec {
+	case ipcgen.VideoCodecH264:
+		return media.CodecH264, true
+	case ipcgen.VideoCodecVP8:
+		return media.CodecVP8, true
+	case ipcgen.VideoCodecAV1:
+		return media.CodecAV1, true
+	}
+	return 0, false
+}
+
+func sdkVideoCodec(codec media.VideoCodec) agoraservice.VideoCodecType {
+	switch codec {
+	case media.CodecVP8:
+		return agoraservice.VideoCodecTypeVp8
+	case media.CodecAV1:
+		return agoraservice.VideoCodecTypeAv1
+	}
+	return agoraservice.VideoCodecTypeH264
+}
+
+func mediaAudioCodec(codec ipcgen.AudioCodec) (media.AudioCodec, bool) {
+	switch codec {
+	case ipcgen.AudioCodecOPUS:
+		return media.CodecOpus, true
+	case ipcgen.AudioCodecAAC_LC:
+		return media.CodecAAC, true
+	}
+	return 0, false
+}
+
+func sdkAudioCodec(codec media.AudioCodec) agoraservice.AudioCodecType {
+	if codec == media.CodecAAC {
+		return agoraservice.AudioCodecAacLc
+	}
+	return agoraservice.AudioCodecOpus
+}
+
+// sdkPixelFormat maps a validated pixel format to the SDK's. All of them
+// are accepted by PushVideoFrame, so no conversion is needed.
+func sdkPixelFormat(format media.PixelFormat) agoraservice.VideoPixelFormat {
+	switch format {
+	case media.PixelNV12:
+		return agoraservice.VideoPixelNV12
+	case media.PixelRGBA:
+		return agoraservice.VideoPixelRGBA
+	case media.PixelBGRA:
+		return agoraservice.VideoPixelBGRA
+	}
+	return agoraservice.VideoPixelI420
+}
+
+// reportPlayoutStats periodically sends the playout buffer's fill level,
+// underruns and drops to the parent.
+func reportPlayoutStats(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-playout.Done():
+			return
+		case <-ticker.C:
+			logMsg := "Playout buffer: " + playout.Stats().String()
+			childLogger.Println(logMsg)
+			sendAsyncLogResponse(ipcgen.LogLevelINFO, logMsg)
+		}
+	}
+}
+
 func setupMediaInfrastructureAndPublish(conn *agoraservice.RtcConnection) error {
 	if conn == nil {
 		return fmt.Errorf("RtcConnection is nil in setupMediaInfrastructureAndPublish")
@@ -468,20 +811,25 @@ func setupMediaInfrastructureAndPublish(conn *agoraservice.RtcConnection) error
 		globalCodecName, videoEncoderConfig.CodecType, videoEncoderConfig.Width, videoEncoderConfig.Height, 
 		videoEncoderConfig.Framerate, videoEncoderConfig.MinBitrate, videoEncoderConfig.Bitrate)
 	
-	ret := conn.SetVideoEncoderConfiguration(videoEncoderConfig)
-	if ret != 0 {
-		errMsg := fmt.Sprintf("failed to set video encoder configuration for %s codec (enum=%d), error code: %d", 
-			globalCodecName, initVideoCodec, ret)
-		childLogger.Printf("ERROR: %s", errMsg)
-		return fmt.Errorf(errMsg)
+	if encodedVideo {
+		// Nothing is encoded in the child, the frames arrive compressed
+		childLogger.Println("Skipping video encoder configuration for pre-encoded video.")
+	} else {
+		ret := conn.SetVideoEncoderConfiguration(videoEncoderConfig)
+		if ret != 0 {
+			errMsg := fmt.Sprintf("failed to set video encoder configuration for %s codec (enum=%d), error code: %d", 
+				globalCodecName, initVideoCodec, ret)
+			childLogger.Printf("ERROR: %s", errMsg)
+			return errors.New(errMsg)
+		}
+		childLogger.Printf("Video encoder configuration set successfully for %s codec (enum=%d).", globalCodecName, initVideoCodec)
 	}
-	childLogger.Printf("Video encoder configuration set successfully for %s codec (enum=%d).", globalCodecName, initVideoCodec)
 
 	// Publish Audio and Video
 	childLogger.Println("Publishing audio...")
 	if ret := conn.PublishAudio(); ret != 0 {
 		errMsg := fmt.Sprintf("failed to publish audio, error code: %d", ret)
-		return fmt.Errorf(errMsg)
+		return errors.New(errMsg)
 	}
 	childLogger.Println("Audio published.")
 
@@ -489,7 +837,7 @@ func setupMediaInfrastructureAndPublish(conn *agoraservice.RtcConnection) error
 	if ret := conn.PublishVideo(); ret != 0 {
 		errMsg := fmt.Sprintf("failed to publish video, error code: %d", ret)
 		conn.UnpublishAudio()
-		return fmt.Errorf(errMsg)
+		return errors.New(errMsg)
 	}
 	childLogger.Printf("Video published with %s codec (enum=%d).", globalCodecName, initVideoCodec)
 
@@ -500,6 +848,11 @@ func setupMediaInfrastructureAndPublish(conn *agoraservice.RtcConnection) error
 
 func cleanupAgoraResources() {
 	childLogger.Println("Cleaning up ALL Agora resources due to CLOSE command or fatal error...")
+	// Stop releasing samples before the connection goes away
+	if playout != nil {
+		playout.Close()
+		childLogger.Printf("Playout buffer stopped: %s", playout.Stats())
+	}
 	cleanupLocalRtcResources(true)
 	childLogger.Println("Full Agora resources cleanup attempt finished.")
 }
@@ -594,6 +947,50 @@ func sendAsyncLogResponse(level ipcgen.LogLevel, messageStr string) {
 	}
 }
 
+// sendAsyncActivityResponse tells the parent that something happened in the
+// channel that keeps the session active.
+func sendAsyncActivityResponse(kind ipcgen.ActivityKind, uid string) {
+	stdoutLock.Lock()
+	defer stdoutLock.Unlock()
+
+	// First create the ActivityResponsePayload
+	innerBuilder := flatbuffers.NewBuilder(128)
+	uidStr := innerBuilder.CreateString(uid)
+
+	ipcgen.ActivityResponsePayloadStart(innerBuilder)
+	ipcgen.ActivityResponsePayloadAddKind(innerBuilder, kind)
+	ipcgen.ActivityResponsePayloadAddUserId(innerBuilder, uidStr)
+	activityPayloadOffset := ipcgen.ActivityResponsePayloadEnd(innerBuilder)
+	innerBuilder.Finish(activityPayloadOffset)
+
+	// Get the serialized ActivityResponsePayload bytes
+	activityPayloadBytes := innerBuilder.FinishedBytes()
+
+	// Now create the outer IPCMessage with the ActivityResponsePayload bytes as payload
+	outerBuilder := flatbuffers.NewBuilder(len(activityPayloadBytes) + 64)
+
+	// Create payload vector for IPCMessage
+	ipcgen.IPCMessageStartPayloadVector(outerBuilder, len(activityPayloadBytes))
+	for i := len(activityPayloadBytes) - 1; i >= 0; i-- {
+		outerBuilder.PrependByte(activityPayloadBytes[i])
+	}
+	payloadOffset := outerBuilder.EndVector(len(activityPayloadBytes))
+
+	// Create IPCMessage
+	ipcgen.IPCMessageStart(outerBuilder)
+	ipcgen.IPCMessageAddMessageType(outerBuilder, ipcgen.MessageTypeACTIVITY_RESPONSE)
+	ipcgen.IPCMessageAddPayloadType(outerBuilder, ipcgen.MessagePayloadActivity)
+	ipcgen.IPCMessageAddPayload(outerBuilder, payloadOffset)
+	msg := ipcgen.IPCMessageEnd(outerBuilder)
+	outerBuilder.Finish(msg)
+
+	buf := outerBuilder.FinishedBytes()
+	sendFramedMessage(stdoutWriter, buf)
+	if err := stdoutWriter.Flush(); err != nil {
+		childLogger.Printf("ERROR flushing stdout after activity response: %v", err)
+	}
+}
+
 func sendStatusResponse(status ipcgen.ConnectionStatus, errMsgStr string, addInfoStr string) {
 	sendAsyncStatusResponse(status, errMsgStr, addInfoStr)
 }
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"go-publish-video/ipc/ipcgen"
+
+	flatbuffers "github.com/google/flatbuffers/go"
+)
+
+// closeAckInfo is the additional info the child attaches to the DISCONNECTED
+// status it sends after handling CLOSE_COMMAND; the parent waits for it
+// before closing stdin.
+const closeAckInfo = "Closed by parent command"
+
+// newCloseCommand builds the CLOSE_COMMAND message. A non-empty reason is sent
+// along in a ClosePayload for the child to log, without one the payload is
+// empty.
+func newCloseCommand(reason string) []byte {
+	var closeBytes []byte
+	payloadType := ipcgen.MessagePayloadNONE
+	if reason != "" {
+		// First create the ClosePayload
+		innerBuilder := flatbuffers.NewBuilder(len(reason) + 64)
+		reasonOffset := innerBuilder.CreateString(reason)
+		ipcgen.ClosePayloadStart(innerBuilder)
+		ipcgen.ClosePayloadAddReason(innerBuilder, reasonOffset)
+		closeOffset := ipcgen.ClosePayloadEnd(innerBuilder)
+		innerBuilder.Finish(closeOffset)
+		closeBytes = innerBuilder.FinishedBytes()
+		payloadType = ipcgen.MessagePayloadClose
+	}
+
+	builder := flatbuffers.NewBuilder(len(closeBytes) + 64)
+
+	// Create payload vector, empty without a reason
+	ipcgen.IPCMessageStartPayloadVector(builder, len(closeBytes))
+	for i := len(closeBytes) - 1; i >= 0; i-- {
+		builder.PrependByte(closeBytes[i])
+	}
+	payloadOffset := builder.EndVector(len(closeBytes))
+
+	ipcgen.IPCMessageStart(builder)
+	ipcgen.IPCMessageAddMessageType(builder, ipcgen.MessageTypeCLOSE_COMMAND)
+	ipcgen.IPCMessageAddPayloadType(builder, payloadType)
+	ipcgen.IPCMessageAddPayload(builder, payloadOffset)
+	msg := ipcgen.IPCMessageEnd(builder)
+	builder.Finish(msg)
+
+	return builder.FinishedBytes()
+}
+
+// closeCommandReason returns the reason of a CLOSE_COMMAND message, or "" if
+// it was sent without one.
+func closeCommandReason(msg *ipcgen.IPCMessage) string {
+	if msg.PayloadType() != ipcgen.MessagePayloadClose || msg.PayloadLength() == 0 {
+		return ""
+	}
+	payloadBytes := make([]byte, msg.PayloadLength())
+	for i := range payloadBytes {
+		payloadBytes[i] = byte(msg.Payload(i))
+	}
+	return string(ipcgen.GetRootAsClosePayload(payloadBytes, 0).Reason())
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+
+	"go-publish-video/ipc/ipcgen"
+)
+
+func TestCloseCommandRoundTrip(t *testing.T) {
+	for _, reason := range []string{"", "idle timeout", "session stopped by the API"} {
+		msg := ipcgen.GetRootAsIPCMessage(newCloseCommand(reason), 0)
+		if msg.MessageType() != ipcgen.MessageTypeCLOSE_COMMAND {
+			t.Errorf("reason %q: message type %s, want CLOSE_COMMAND", reason, ipcgen.EnumNamesMessageType[msg.MessageType()])
+		}
+		if got := closeCommandReason(msg); got != reason {
+			t.Errorf("reason %q: got %q", reason, got)
+		}
+	}
+}
+
+// A CLOSE_COMMAND with a payload of another type carries no reason.
+func TestCloseCommandReasonIgnoresOtherPayloads(t *testing.T) {
+	msg := ipcgen.GetRootAsIPCMessage(newCloseCommand("reason"), 0)
+	msg.MutatePayloadType(ipcgen.MessagePayloadNONE)
+	if got := closeCommandReason(msg); got != "" {
+		t.Errorf("got %q, want no reason", got)
+	}
+}
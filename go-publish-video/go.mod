@@ -1,11 +1,13 @@
 module go-publish-video
 
-go 1.20
+go 1.24.0
 
 require (
 	github.com/AgoraIO-Extensions/Agora-Golang-Server-SDK/v2 v2.3.3
 	github.com/AgoraIO/Tools/DynamicKey/AgoraDynamicKey/go/src v0.0.0-20240807100336-95d820182fef
 	github.com/google/flatbuffers v25.2.10+incompatible
+	github.com/gorilla/websocket v1.5.3
+	github.com/pion/opus v0.1.0
 )
 
 replace github.com/AgoraIO-Extensions/Agora-Golang-Server-SDK/v2 => /home/ubuntu/Agora-Golang-Server-SDK
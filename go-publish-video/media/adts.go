@@ -0,0 +1,118 @@
+package media
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	adtsHeaderSize   = 7
+	adtsObjectTypeLC = 2
+	id3HeaderSize    = 10
+)
+
+var adtsSampleRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// isADTSSync reports whether head starts with an ADTS syncword and layer 0.
+func isADTSSync(head []byte) bool {
+	return head[0] == 0xff && head[1]&0xf6 == 0xf0
+}
+
+// adtsHeader is what the reader needs from an ADTS frame header.
+type adtsHeader struct {
+	objectType int
+	sampleRate int
+	channels   int
+	size       int // including the header
+	samples    int
+}
+
+func parseADTSHeader(b []byte) (adtsHeader, error) {
+	if !isADTSSync(b) {
+		return adtsHeader{}, fmt.Errorf("missing ADTS syncword")
+	}
+	rateIndex := int(b[2] >> 2 & 0xf)
+	if rateIndex >= len(adtsSampleRates) {
+		return adtsHeader{}, fmt.Errorf("invalid ADTS sample rate index %d", rateIndex)
+	}
+	h := adtsHeader{
+		objectType: int(b[2]>>6) + 1,
+		sampleRate: adtsSampleRates[rateIndex],
+		channels:   int(b[2]&1)<<2 | int(b[3]>>6),
+		size:       int(b[3]&3)<<11 | int(b[4])<<3 | int(b[5]>>5),
+		// Each raw data block is 1024 samples
+		samples: 1024 * (int(b[6]&3) + 1),
+	}
+	if h.size < adtsHeaderSize {
+		return adtsHeader{}, fmt.Errorf("invalid ADTS frame length %d", h.size)
+	}
+	return h, nil
+}
+
+// openADTS indexes the frames of an ADTS stream, skipping a leading ID3 tag.
+// The frames keep their ADTS headers, which the SDK expects for AAC.
+func openADTS(file *os.File, mode PlayMode) (*encodedAudioFile, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	var offset int64
+	id3 := make([]byte, id3HeaderSize)
+	if _, err := file.ReadAt(id3, 0); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read ADTS stream: %v", err)
+	}
+	if string(id3[:3]) == "ID3" {
+		// The tag size is syncsafe, 7 bits per byte, and excludes the header
+		// and the optional footer
+		size := int64(id3[6])<<21 | int64(id3[7])<<14 | int64(id3[8])<<7 | int64(id3[9])
+		offset = id3HeaderSize + size
+		if id3[5]&0x10 != 0 {
+			offset += id3HeaderSize
+		}
+	}
+
+	var (
+		units  []encodedUnit
+		first  adtsHeader
+		header = make([]byte, adtsHeaderSize)
+	)
+	for offset+adtsHeaderSize <= info.Size() {
+		if _, err := file.ReadAt(header, offset); err != nil {
+			return nil, fmt.Errorf("failed to read ADTS frame header: %v", err)
+		}
+		h, err := parseADTSHeader(header)
+		if err != nil {
+			if len(units) > 0 {
+				// Trailing tags or garbage
+				break
+			}
+			return nil, err
+		}
+		if offset+int64(h.size) > info.Size() {
+			// Truncated last frame
+			break
+		}
+
+		if len(units) == 0 {
+			first = h
+			if h.objectType != adtsObjectTypeLC {
+				return nil, fmt.Errorf("unsupported AAC object type %d, only AAC-LC is supported", h.objectType)
+			}
+			if h.channels < 1 || h.channels > 2 {
+				return nil, fmt.Errorf("unsupported AAC channel configuration %d, only mono and stereo are supported", h.channels)
+			}
+		} else if h.objectType != first.objectType || h.sampleRate != first.sampleRate || h.channels != first.channels || h.samples != first.samples {
+			return nil, fmt.Errorf("ADTS frame %d changes the stream format", len(units))
+		}
+		units = append(units, encodedUnit{offset: offset, size: h.size, key: true})
+		offset += int64(h.size)
+	}
+	if len(units) == 0 {
+		return nil, fmt.Errorf("no ADTS frames found")
+	}
+
+	format := EncodedAudioFormat{Codec: CodecAAC, SampleRate: first.sampleRate, Channels: first.channels, SamplesPerFrame: first.samples}
+	return &encodedAudioFile{file: file, format: format, mode: mode, units: units}, nil
+}
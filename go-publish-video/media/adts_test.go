@@ -0,0 +1,158 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// adtsFrame builds an AAC-LC frame around payload. With crc set the header
+// is followed by a CRC word (protection_absent is 0).
+func adtsFrame(rateIndex, channels int, payload []byte, crc bool) []byte {
+	headerSize := adtsHeaderSize
+	protectionAbsent := byte(1)
+	if crc {
+		headerSize += 2
+		protectionAbsent = 0
+	}
+	size := headerSize + len(payload)
+	frame := []byte{
+		0xff,
+		0xf0 | protectionAbsent,
+		byte(adtsObjectTypeLC-1)<<6 | byte(rateIndex)<<2 | byte(channels>>2),
+		byte(channels&3)<<6 | byte(size>>11),
+		byte(size >> 3),
+		byte(size&7)<<5 | 0x1f,
+		0xfc, // one raw data block
+	}
+	if crc {
+		frame = append(frame, 0x12, 0x34)
+	}
+	return append(frame, payload...)
+}
+
+// withADTSLength overwrites the frame length in the header of frame.
+func withADTSLength(frame []byte, size int) []byte {
+	frame[3] = frame[3]&^3 | byte(size>>11)
+	frame[4] = byte(size >> 3)
+	frame[5] = byte(size&7)<<5 | frame[5]&0x1f
+	return frame
+}
+
+func TestParseADTSHeader(t *testing.T) {
+	twoBlocks := adtsFrame(3, 2, filled(10, 1), false)
+	twoBlocks[6] |= 1
+
+	tests := []struct {
+		name  string
+		frame []byte
+		want  adtsHeader
+		ok    bool
+	}{
+		{"44.1kHz stereo", adtsFrame(4, 2, filled(100, 1), false), adtsHeader{2, 44100, 2, 107, 1024}, true},
+		// The frame length includes the CRC
+		{"CRC", adtsFrame(3, 1, filled(100, 1), true), adtsHeader{2, 48000, 1, 109, 1024}, true},
+		{"two raw data blocks", twoBlocks, adtsHeader{2, 48000, 2, 17, 2048}, true},
+		{"large frame", adtsFrame(3, 2, filled(3000, 1), false), adtsHeader{2, 48000, 2, 3007, 1024}, true},
+		{"no syncword", append([]byte{0xff, 0xe0}, adtsFrame(3, 2, nil, false)[2:]...), adtsHeader{}, false},
+		{"layer not 0", append([]byte{0xff, 0xf3}, adtsFrame(3, 2, nil, false)[2:]...), adtsHeader{}, false},
+		{"invalid sample rate", adtsFrame(13, 2, nil, false), adtsHeader{}, false},
+		{"frame shorter than its header", withADTSLength(adtsFrame(3, 2, nil, false), 5), adtsHeader{}, false},
+	}
+	for _, tt := range tests {
+		h, err := parseADTSHeader(tt.frame)
+		switch {
+		case !tt.ok && err == nil:
+			t.Errorf("%s: parseADTSHeader() = %+v, want an error", tt.name, h)
+		case tt.ok && (err != nil || h != tt.want):
+			t.Errorf("%s: parseADTSHeader() = %+v, %v, want %+v", tt.name, h, err, tt.want)
+		}
+	}
+}
+
+// id3Tag builds an ID3v2 tag with size bytes of frames, and a footer if
+// footer is set.
+func id3Tag(size int, footer bool) []byte {
+	tag := []byte{'I', 'D', '3', 4, 0, 0, byte(size >> 21 & 0x7f), byte(size >> 14 & 0x7f), byte(size >> 7 & 0x7f), byte(size & 0x7f)}
+	tag = append(tag, filled(size, 0xff)...)
+	if footer {
+		tag[5] |= 0x10
+		tag = append(tag, '3', 'D', 'I', 4, 0, 0x10, tag[6], tag[7], tag[8], tag[9])
+	}
+	return tag
+}
+
+func TestOpenADTS(t *testing.T) {
+	frames := [][]byte{
+		adtsFrame(3, 2, filled(20, 1), false),
+		adtsFrame(3, 2, filled(30, 2), false),
+		adtsFrame(3, 2, filled(25, 3), false),
+	}
+	crcFrames := [][]byte{
+		adtsFrame(3, 2, filled(20, 1), true),
+		adtsFrame(3, 2, filled(30, 2), true),
+	}
+	tests := []struct {
+		name   string
+		prefix []byte
+		frames [][]byte
+		cut    int // bytes cut off the end
+		want   int // frames read
+	}{
+		{"plain", nil, frames, 0, 3},
+		{"CRC", nil, crcFrames, 0, 2},
+		// The tag frames start with 0xff like a syncword
+		{"ID3 tag", id3Tag(300, false), frames, 0, 3},
+		{"ID3 tag with footer", id3Tag(300, true), frames, 0, 3},
+		{"truncated final frame", nil, frames, 1, 2},
+		{"truncated final header", nil, frames, len(frames[2]) - 3, 2},
+		{"trailing garbage", nil, append(append([][]byte{}, frames...), []byte("TAG garbage")), 0, 3},
+	}
+	for _, tt := range tests {
+		data := append(append([]byte{}, tt.prefix...), bytes.Join(tt.frames, nil)...)
+		path := filepath.Join(t.TempDir(), "test.aac")
+		if err := os.WriteFile(path, data[:len(data)-tt.cut], 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		src, err := OpenEncodedAudioFile(path, PlayOnce)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		want := EncodedAudioFormat{Codec: CodecAAC, SampleRate: 48000, Channels: 2, SamplesPerFrame: 1024}
+		if got := src.EncodedAudioFormat(); got != want {
+			t.Errorf("%s: format = %v, want %v", tt.name, got, want)
+		}
+		for i := 0; i < tt.want; i++ {
+			frame, err := src.ReadEncodedAudio(context.Background())
+			if err != nil {
+				t.Errorf("%s: frame %d: %v", tt.name, i, err)
+				break
+			}
+			// Frames keep their headers and CRC
+			if !bytes.Equal(frame.Data, tt.frames[i]) {
+				t.Errorf("%s: frame %d = % x, want % x", tt.name, i, frame.Data, tt.frames[i])
+			}
+		}
+		if _, err := src.ReadEncodedAudio(context.Background()); err != io.EOF {
+			t.Errorf("%s: read after %d frames: %v, want EOF", tt.name, tt.want, err)
+		}
+		src.Close()
+	}
+}
+
+func TestOpenADTSRejectsFormatChange(t *testing.T) {
+	data := append(adtsFrame(3, 2, filled(20, 1), false), adtsFrame(4, 2, filled(20, 1), false)...)
+	path := filepath.Join(t.TempDir(), "test.aac")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if src, err := OpenEncodedAudioFile(path, PlayOnce); err == nil {
+		src.Close()
+		t.Error("stream changing from 48kHz to 44.1kHz opened")
+	}
+}
@@ -0,0 +1,238 @@
+// Package media contains the pieces of the publishing pipeline that do not
+// depend on the IPC protocol or the Agora SDK.
+package media
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxScheduleLag is how far a stream may fall behind the clock before it
+// skips frames instead of sending a burst to catch up.
+const maxScheduleLag = 500 * time.Millisecond
+
+// Clock is the master timeline shared by all streams of a session. Every
+// stream schedules frame n at Zero + n*frameDuration, so streams that start at
+// different moments or run at different rates still line up.
+type Clock struct {
+	mu      sync.Mutex
+	zero    time.Time
+	started chan struct{}
+	streams map[string]*streamTiming
+
+	// Time source, replaced in tests
+	now   func() time.Time
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+type streamTiming struct {
+	frames   int64
+	skipped  int64
+	position time.Duration // presentation time of the last frame
+	lastLag  time.Duration
+	maxLag   time.Duration
+	totalLag time.Duration
+}
+
+type StreamStats struct {
+	Frames   int64
+	Skipped  int64
+	Position time.Duration
+	LastLag  time.Duration
+	MaxLag   time.Duration
+	AvgLag   time.Duration
+}
+
+type ClockStats struct {
+	Elapsed time.Duration
+	Streams map[string]StreamStats
+}
+
+func NewClock() *Clock {
+	return &Clock{
+		started: make(chan struct{}),
+		streams: make(map[string]*streamTiming),
+		now:     time.Now,
+		sleep:   sleepContext,
+	}
+}
+
+// sleepContext waits for d or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Start sets the zero point of the timeline. Only the first call has an
+// effect, so the timeline survives reconnects and child restarts.
+func (c *Clock) Start(zero time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.started:
+		return false
+	default:
+	}
+	c.zero = zero
+	close(c.started)
+	return true
+}
+
+// Zero blocks until the clock has been started and returns its zero point.
+func (c *Clock) Zero(ctx context.Context) (time.Time, error) {
+	select {
+	case <-c.started:
+	case <-ctx.Done():
+		return time.Time{}, ctx.Err()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.zero, nil
+}
+
+// Now returns the time elapsed since the zero point, or 0 before Start.
+func (c *Clock) Now() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.zero.IsZero() {
+		return 0
+	}
+	return c.now().Sub(c.zero)
+}
+
+func (c *Clock) Stats() ClockStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := ClockStats{Streams: make(map[string]StreamStats, len(c.streams))}
+	if !c.zero.IsZero() {
+		stats.Elapsed = c.now().Sub(c.zero)
+	}
+	for name, t := range c.streams {
+		s := StreamStats{
+			Frames:   t.frames,
+			Skipped:  t.skipped,
+			Position: t.position,
+			LastLag:  t.lastLag,
+			MaxLag:   t.maxLag,
+		}
+		if t.frames > 0 {
+			s.AvgLag = t.totalLag / time.Duration(t.frames)
+		}
+		stats.Streams[name] = s
+	}
+	return stats
+}
+
+// Drift returns how far stream a is ahead of stream b on average, e.g. the
+// audio/video offset a receiver would observe.
+func (s ClockStats) Drift(a, b string) time.Duration {
+	return s.Streams[b].AvgLag - s.Streams[a].AvgLag
+}
+
+func (s ClockStats) String() string {
+	names := make([]string, 0, len(s.Streams))
+	for name := range s.Streams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := []string{fmt.Sprintf("elapsed=%v", s.Elapsed.Round(time.Millisecond))}
+	for _, name := range names {
+		st := s.Streams[name]
+		parts = append(parts, fmt.Sprintf("%s[frames=%d skipped=%d pos=%v lag avg=%v max=%v]",
+			name, st.Frames, st.Skipped, st.Position.Round(time.Millisecond),
+			st.AvgLag.Round(time.Microsecond), st.MaxLag.Round(time.Microsecond)))
+	}
+	return strings.Join(parts, " ")
+}
+
+func (c *Clock) record(name string, pts, lag time.Duration, skipped int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := c.streams[name]
+	if t == nil {
+		t = &streamTiming{}
+		c.streams[name] = t
+	}
+	t.frames++
+	t.skipped += skipped
+	t.position = pts
+	t.lastLag = lag
+	t.totalLag += lag
+	if lag > t.maxLag {
+		t.maxLag = lag
+	}
+}
+
+// Schedule paces one stream against the clock at a rational frame rate of
+// rateNum/rateDen frames per second.
+type Schedule struct {
+	clock   *Clock
+	name    string
+	rateNum int64
+	rateDen int64
+	next    int64
+}
+
+func (c *Clock) NewSchedule(name string, rateNum, rateDen int) *Schedule {
+	return &Schedule{clock: c, name: name, rateNum: int64(rateNum), rateDen: int64(rateDen)}
+}
+
+// PTS returns the presentation time of frame n relative to the clock zero.
+func (s *Schedule) PTS(n int64) time.Duration {
+	return time.Duration(n * int64(time.Second) * s.rateDen / s.rateNum)
+}
+
+// FrameDuration returns the nominal duration of one frame.
+func (s *Schedule) FrameDuration() time.Duration {
+	return s.PTS(1)
+}
+
+type Tick struct {
+	Frame   int64
+	PTS     time.Duration
+	Lag     time.Duration // how late the tick fired
+	Skipped int64         // frames dropped to catch up before this one
+}
+
+// Next waits until the next frame is due and returns its presentation time.
+// If the stream has fallen more than maxScheduleLag behind, e.g. after a pause
+// during a reconnect, it skips ahead to the current frame and reports how many
+// frames were skipped so the caller can discard them from its source.
+func (s *Schedule) Next(ctx context.Context) (Tick, error) {
+	zero, err := s.clock.Zero(ctx)
+	if err != nil {
+		return Tick{}, err
+	}
+
+	var skipped int64
+	elapsed := s.clock.now().Sub(zero)
+	if behind := elapsed - s.PTS(s.next); behind > maxScheduleLag {
+		current := int64(elapsed) * s.rateNum / (int64(time.Second) * s.rateDen)
+		skipped = current - s.next
+		s.next = current
+	}
+
+	deadline := zero.Add(s.PTS(s.next))
+	if wait := deadline.Sub(s.clock.now()); wait > 0 {
+		if err := s.clock.sleep(ctx, wait); err != nil {
+			return Tick{}, err
+		}
+	}
+
+	tick := Tick{Frame: s.next, PTS: s.PTS(s.next), Lag: s.clock.now().Sub(deadline), Skipped: skipped}
+	s.clock.record(s.name, tick.PTS, tick.Lag, skipped)
+	s.next++
+	return tick, nil
+}
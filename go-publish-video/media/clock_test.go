@@ -0,0 +1,176 @@
+package media
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTime is a controllable time source: sleeping advances it instantly,
+// and Advance simulates a stream that is held up.
+type fakeTime struct {
+	mu  sync.Mutex
+	now time.Time
+	// slept are the waits the schedule asked for
+	slept []time.Duration
+}
+
+func newFakeClock() (*Clock, *fakeTime) {
+	ft := &fakeTime{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	c := NewClock()
+	c.now = ft.Now
+	c.sleep = ft.Sleep
+	return c, ft
+}
+
+func (f *fakeTime) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *fakeTime) Sleep(ctx context.Context, d time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.slept = append(f.slept, d)
+	f.now = f.now.Add(d)
+	return nil
+}
+
+func (f *fakeTime) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+}
+
+// Frames are due at zero + n*frameDuration, however long sending took.
+func TestScheduleAbsoluteDeadlines(t *testing.T) {
+	c, ft := newFakeClock()
+	c.Start(ft.Now())
+	s := c.NewSchedule("video", 30000, 1001) // 29.97fps
+
+	ctx := context.Background()
+	for n := int64(0); n < 5; n++ {
+		tick, err := s.Next(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tick.Frame != n || tick.PTS != s.PTS(n) || tick.Skipped != 0 || tick.Lag != 0 {
+			t.Errorf("tick %d: %+v, want frame %d at %v", n, tick, n, s.PTS(n))
+		}
+		// A slow send delays only this frame
+		ft.Advance(10 * time.Millisecond)
+	}
+	// The first frame was due at once, the others a frame minus the send
+	for i, d := range ft.slept {
+		n := int64(i + 1)
+		if want := s.PTS(n) - s.PTS(n-1) - 10*time.Millisecond; d != want {
+			t.Errorf("wait %d: %v, want %v", i, d, want)
+		}
+	}
+	if len(ft.slept) != 4 {
+		t.Errorf("%d waits, want 4", len(ft.slept))
+	}
+	if got := s.PTS(30000); got != 1001*time.Second {
+		t.Errorf("PTS(30000) = %v, want 1001s", got)
+	}
+}
+
+// A late frame is sent at once and reports its lag, without skipping while
+// the stream is less than maxScheduleLag behind.
+func TestScheduleLateWithoutSkipping(t *testing.T) {
+	c, ft := newFakeClock()
+	c.Start(ft.Now())
+	s := c.NewSchedule("audio", 100, 1)
+	ctx := context.Background()
+
+	s.Next(ctx)
+	ft.Advance(maxScheduleLag)
+	tick, err := s.Next(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tick.Frame != 1 || tick.Skipped != 0 || tick.Lag != maxScheduleLag-10*time.Millisecond {
+		t.Errorf("tick %+v, want frame 1, no skip, lag %v", tick, maxScheduleLag-10*time.Millisecond)
+	}
+}
+
+// After more than maxScheduleLag behind, e.g. a pause, the schedule jumps to
+// the current frame and reports the frames it skipped.
+func TestScheduleSkipsAfterLag(t *testing.T) {
+	c, ft := newFakeClock()
+	c.Start(ft.Now())
+	s := c.NewSchedule("audio", 100, 1)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		s.Next(ctx)
+	}
+	// Frame 3 was due at 30ms, the stream comes back at 1.2s
+	ft.Advance(1200*time.Millisecond - 20*time.Millisecond)
+	tick, err := s.Next(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tick.Frame != 120 || tick.Skipped != 117 || tick.PTS != 1200*time.Millisecond || tick.Lag != 0 {
+		t.Errorf("tick %+v, want frame 120 after skipping 117", tick)
+	}
+	stats := c.Stats().Streams["audio"]
+	if stats.Frames != 4 || stats.Skipped != 117 || stats.Position != 1200*time.Millisecond {
+		t.Errorf("stats %+v", stats)
+	}
+
+	// Back in step, the next frame waits again
+	tick, _ = s.Next(ctx)
+	if tick.Frame != 121 || tick.Skipped != 0 {
+		t.Errorf("tick %+v, want frame 121", tick)
+	}
+}
+
+// Schedules wait for the clock to start, which the parent does at the first
+// CONNECTED; later starts keep the zero point.
+func TestClockStartsOnce(t *testing.T) {
+	c, ft := newFakeClock()
+	s := c.NewSchedule("video", 25, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := s.Next(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Next before Start: %v, want %v", err, context.DeadlineExceeded)
+	}
+	if got := c.Now(); got != 0 {
+		t.Errorf("Now before Start = %v, want 0", got)
+	}
+
+	zero := ft.Now()
+	if !c.Start(zero) {
+		t.Fatal("first Start returned false")
+	}
+	ft.Advance(time.Second)
+	if c.Start(ft.Now()) {
+		t.Error("second Start returned true")
+	}
+	if got, _ := c.Zero(context.Background()); !got.Equal(zero) {
+		t.Errorf("zero moved to %v, want %v", got, zero)
+	}
+	if got := c.Now(); got != time.Second {
+		t.Errorf("Now = %v, want 1s", got)
+	}
+}
+
+func TestScheduleNextCancelled(t *testing.T) {
+	c, ft := newFakeClock()
+	c.Start(ft.Now())
+	s := c.NewSchedule("video", 25, 1)
+	s.Next(context.Background())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := s.Next(ctx); err != context.Canceled {
+		t.Errorf("Next = %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,613 @@
+package media
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"math"
+	"strings"
+)
+
+// ColorMatrix selects the coefficients for RGB<->YUV conversion. YUV is
+// limited range (luma 16-235), RGB is full range.
+type ColorMatrix int
+
+const (
+	// BT601 is used by SD video and most webcams
+	BT601 ColorMatrix = iota
+	// BT709 is used by HD video
+	BT709
+)
+
+func (m ColorMatrix) String() string {
+	switch m {
+	case BT601:
+		return "bt601"
+	case BT709:
+		return "bt709"
+	}
+	return fmt.Sprintf("ColorMatrix(%d)", int(m))
+}
+
+// ParseColorMatrix parses "bt601" or "bt709".
+func ParseColorMatrix(s string) (ColorMatrix, error) {
+	for _, m := range []ColorMatrix{BT601, BT709} {
+		if strings.EqualFold(s, m.String()) {
+			return m, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown color matrix %q, expected bt601 or bt709", s)
+}
+
+// weights returns the luma weights of red and blue.
+func (m ColorMatrix) weights() (kr, kb float64) {
+	if m == BT709 {
+		return 0.2126, 0.0722
+	}
+	return 0.299, 0.114
+}
+
+// yuv converts a color with components in [0, 1].
+func (m ColorMatrix) yuv(r, g, b float64) yuv {
+	kr, kb := m.weights()
+	y := kr*r + (1-kr-kb)*g + kb*b
+	u := (b - y) / (2 * (1 - kb))
+	v := (r - y) / (2 * (1 - kr))
+	return yuv{clampByte(int32(math.Round(16 + 219*y))), clampByte(int32(math.Round(128 + 224*u))), clampByte(int32(math.Round(128 + 224*v)))}
+}
+
+// rgbToYUV holds 16.16 fixed-point factors for 8-bit RGB to YUV.
+type rgbToYUV struct{ yr, yg, yb, ur, ug, ub, vr, vg, vb int32 }
+
+func (m ColorMatrix) rgbToYUV() rgbToYUV {
+	kr, kb := m.weights()
+	kg := 1 - kr - kb
+	ys, cs := 219.0/255, 224.0/255
+	return rgbToYUV{
+		fixed16(ys * kr), fixed16(ys * kg), fixed16(ys * kb),
+		fixed16(-cs * kr / (2 * (1 - kb))), fixed16(-cs * kg / (2 * (1 - kb))), fixed16(cs / 2),
+		fixed16(cs / 2), fixed16(-cs * kg / (2 * (1 - kr))), fixed16(-cs * kb / (2 * (1 - kr))),
+	}
+}
+
+func (c *rgbToYUV) y(r, g, b int32) byte {
+	return clampByte(16 + (c.yr*r+c.yg*g+c.yb*b+1<<15)>>16)
+}
+
+func (c *rgbToYUV) uv(r, g, b int32) (byte, byte) {
+	u := 128 + (c.ur*r+c.ug*g+c.ub*b+1<<15)>>16
+	v := 128 + (c.vr*r+c.vg*g+c.vb*b+1<<15)>>16
+	return clampByte(u), clampByte(v)
+}
+
+// yuvToRGB holds 16.16 fixed-point factors for YUV to 8-bit RGB.
+type yuvToRGB struct{ y, rv, gu, gv, bu int32 }
+
+func (m ColorMatrix) yuvToRGB() yuvToRGB {
+	kr, kb := m.weights()
+	kg := 1 - kr - kb
+	cs := 255.0 / 224
+	return yuvToRGB{
+		y:  fixed16(255.0 / 219),
+		rv: fixed16(2 * (1 - kr) * cs),
+		gu: fixed16(2 * kb * (1 - kb) / kg * cs),
+		gv: fixed16(2 * kr * (1 - kr) / kg * cs),
+		bu: fixed16(2 * (1 - kb) * cs),
+	}
+}
+
+func (c *yuvToRGB) rgb(y, u, v byte) (byte, byte, byte) {
+	yy := c.y * (int32(y) - 16)
+	uu, vv := int32(u)-128, int32(v)-128
+	r := (yy + c.rv*vv + 1<<15) >> 16
+	g := (yy - c.gu*uu - c.gv*vv + 1<<15) >> 16
+	b := (yy + c.bu*uu + 1<<15) >> 16
+	return clampByte(r), clampByte(g), clampByte(b)
+}
+
+func fixed16(v float64) int32 { return int32(math.Round(v * (1 << 16))) }
+
+func clampByte(v int32) byte {
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return byte(v)
+}
+
+// ScaleFilter selects how frames are resized.
+type ScaleFilter int
+
+const (
+	// ScaleArea averages the source pixels an output pixel covers when
+	// shrinking, which avoids aliasing, and interpolates when enlarging
+	ScaleArea ScaleFilter = iota
+	// ScaleBilinear always interpolates between the nearest source pixels,
+	// which is sharper but aliases when shrinking by more than 2x
+	ScaleBilinear
+)
+
+func (f ScaleFilter) String() string {
+	switch f {
+	case ScaleArea:
+		return "area"
+	case ScaleBilinear:
+		return "bilinear"
+	}
+	return fmt.Sprintf("ScaleFilter(%d)", int(f))
+}
+
+// ParseScaleFilter parses "area" or "bilinear".
+func ParseScaleFilter(s string) (ScaleFilter, error) {
+	for _, f := range []ScaleFilter{ScaleArea, ScaleBilinear} {
+		if strings.EqualFold(s, f.String()) {
+			return f, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown scale filter %q, expected area or bilinear", s)
+}
+
+// FitMode selects how frames of another aspect ratio are fitted.
+type FitMode int
+
+const (
+	// FitLetterbox shows the whole frame with black bars
+	FitLetterbox FitMode = iota
+	// FitCrop fills the output and cuts off the edges that do not fit
+	FitCrop
+	// FitStretch fills the output, distorting the aspect ratio
+	FitStretch
+)
+
+func (f FitMode) String() string {
+	switch f {
+	case FitLetterbox:
+		return "letterbox"
+	case FitCrop:
+		return "crop"
+	case FitStretch:
+		return "stretch"
+	}
+	return fmt.Sprintf("FitMode(%d)", int(f))
+}
+
+// ParseFitMode parses "letterbox", "crop" or "stretch".
+func ParseFitMode(s string) (FitMode, error) {
+	for _, f := range []FitMode{FitLetterbox, FitCrop, FitStretch} {
+		if strings.EqualFold(s, f.String()) {
+			return f, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown fit mode %q, expected letterbox, crop or stretch", s)
+}
+
+// ConvertConfig tunes a FrameConverter. The zero value converts with BT.601,
+// area scaling and letterboxing.
+type ConvertConfig struct {
+	Matrix ColorMatrix
+	Filter ScaleFilter
+	Fit    FitMode
+}
+
+func (c ConvertConfig) String() string {
+	return fmt.Sprintf("%s, %s, %s", c.Fit, c.Filter, c.Matrix)
+}
+
+// kernelBits is the fixed-point precision of kernel weights.
+const kernelBits = 14
+
+// kernel maps every output pixel along one axis to weighted source pixels.
+type kernel struct {
+	taps     int
+	index    []int   // taps source indexes per output pixel
+	weights  []int32 // taps weights per output pixel, summing to 1<<kernelBits
+	min, max int     // range of source indexes used
+	identity bool    // output pixel i is source pixel min+i
+}
+
+// newKernel resamples the source span [start, start+length) of an axis with
+// size source pixels into n output pixels.
+func newKernel(filter ScaleFilter, start, length float64, size, n int) *kernel {
+	scale := length / float64(n)
+	type tap struct {
+		index  int
+		weight float64
+	}
+	all := make([][]tap, n)
+	for i := range all {
+		var taps []tap
+		if filter == ScaleArea && scale > 1 {
+			// Box filter with fractional coverage of the edge pixels
+			a := start + float64(i)*scale
+			b := a + scale
+			for j := int(math.Floor(a)); float64(j) < b; j++ {
+				overlap := math.Min(b, float64(j+1)) - math.Max(a, float64(j))
+				if overlap > 0 {
+					taps = append(taps, tap{j, overlap / scale})
+				}
+			}
+		} else {
+			// Interpolate at the center of the output pixel
+			center := start + (float64(i)+0.5)*scale - 0.5
+			j := math.Floor(center)
+			t := center - j
+			taps = []tap{{int(j), 1 - t}, {int(j) + 1, t}}
+		}
+		all[i] = taps
+	}
+
+	k := &kernel{min: size, max: 0}
+	for _, taps := range all {
+		if len(taps) > k.taps {
+			k.taps = len(taps)
+		}
+	}
+	k.index = make([]int, n*k.taps)
+	k.weights = make([]int32, n*k.taps)
+	for i, taps := range all {
+		var sum int32
+		largest := 0
+		for t, tp := range taps {
+			index := tp.index
+			if index < 0 {
+				index = 0
+			}
+			if index >= size {
+				index = size - 1
+			}
+			w := int32(math.Round(tp.weight * (1 << kernelBits)))
+			k.index[i*k.taps+t] = index
+			k.weights[i*k.taps+t] = w
+			sum += w
+			if w > k.weights[i*k.taps+largest] {
+				largest = t
+			}
+			if index < k.min {
+				k.min = index
+			}
+			if index > k.max {
+				k.max = index
+			}
+		}
+		// Rounding must not change the brightness
+		k.weights[i*k.taps+largest] += 1<<kernelBits - sum
+		// Unused taps keep weight 0 on a valid index
+		for t := len(taps); t < k.taps; t++ {
+			k.index[i*k.taps+t] = k.index[i*k.taps]
+		}
+	}
+
+	k.identity = true
+	for i := 0; i < n && k.identity; i++ {
+		k.identity = k.index[i*k.taps] == k.min+i && k.weights[i*k.taps] == 1<<kernelBits
+	}
+	return k
+}
+
+// scaler resizes one plane into a rectangle of another.
+type scaler struct {
+	h, v *kernel
+	tmp  []int32 // horizontally scaled source rows
+	acc  []int32 // one output row
+}
+
+func newScaler(filter ScaleFilter, src rect, srcWidth, srcHeight int, dst image.Rectangle) *scaler {
+	s := &scaler{
+		h: newKernel(filter, src.x, src.w, srcWidth, dst.Dx()),
+		v: newKernel(filter, src.y, src.h, srcHeight, dst.Dy()),
+	}
+	s.tmp = make([]int32, (s.v.max-s.v.min+1)*dst.Dx())
+	s.acc = make([]int32, dst.Dx())
+	return s
+}
+
+// scale writes the resized plane at (x, y) of dst.
+func (s *scaler) scale(dst []byte, dstStride, x, y int, src []byte, srcStride int) {
+	dw := len(s.acc)
+	dh := len(s.v.index) / s.v.taps
+	if s.h.identity && s.v.identity {
+		// Only a crop or a format conversion
+		for j := 0; j < dh; j++ {
+			row := (s.v.min+j)*srcStride + s.h.min
+			copy(dst[(y+j)*dstStride+x:(y+j)*dstStride+x+dw], src[row:row+dw])
+		}
+		return
+	}
+
+	taps, index, weights := s.h.taps, s.h.index, s.h.weights
+
+	// Horizontal pass, keeping 7 fractional bits
+	for row := s.v.min; row <= s.v.max; row++ {
+		line := src[row*srcStride : row*srcStride+srcStride]
+		out := s.tmp[(row-s.v.min)*dw : (row-s.v.min+1)*dw]
+		if taps == 2 {
+			// Bilinear, and area scaling by less than 2x
+			index, weights := index[:2*len(out)], weights[:2*len(out)]
+			for i := range out {
+				i0, i1 := index[2*i], index[2*i+1]
+				out[i] = (int32(line[i0])*weights[2*i] + int32(line[i1])*weights[2*i+1]) >> (kernelBits - 7)
+			}
+			continue
+		}
+		for i := range out {
+			var sum int32
+			for t := i * taps; t < i*taps+taps; t++ {
+				sum += int32(line[index[t]]) * weights[t]
+			}
+			out[i] = sum >> (kernelBits - 7)
+		}
+	}
+
+	// Vertical pass, a weighted sum of whole rows
+	const shift = kernelBits + 7
+	for j := 0; j < dh; j++ {
+		acc := s.acc
+		for i := range acc {
+			acc[i] = 1 << (shift - 1)
+		}
+		for t := 0; t < s.v.taps; t++ {
+			w := s.v.weights[j*s.v.taps+t]
+			if w == 0 {
+				continue
+			}
+			row := s.v.index[j*s.v.taps+t] - s.v.min
+			in := s.tmp[row*dw : row*dw+dw]
+			for i, v := range in {
+				acc[i] += v * w
+			}
+		}
+		out := dst[(y+j)*dstStride+x : (y+j)*dstStride+x+dw]
+		for i, v := range acc {
+			out[i] = clampByte(v >> shift)
+		}
+	}
+}
+
+// rect is a source area in fractional pixels.
+type rect struct{ x, y, w, h float64 }
+
+// fit returns the part of a sw x sh frame that is shown and where it lands
+// in a dw x dh frame. Output rectangles are even for 4:2:0 chroma.
+func fit(mode FitMode, sw, sh, dw, dh int) (rect, image.Rectangle) {
+	full := rect{0, 0, float64(sw), float64(sh)}
+	switch mode {
+	case FitLetterbox:
+		scale := math.Min(float64(dw)/float64(sw), float64(dh)/float64(sh))
+		w := evenSize(float64(sw)*scale, dw)
+		h := evenSize(float64(sh)*scale, dh)
+		x := (dw - w) / 2 &^ 1
+		y := (dh - h) / 2 &^ 1
+		return full, image.Rect(x, y, x+w, y+h)
+	case FitCrop:
+		scale := math.Max(float64(dw)/float64(sw), float64(dh)/float64(sh))
+		w, h := float64(dw)/scale, float64(dh)/scale
+		return rect{(float64(sw) - w) / 2, (float64(sh) - h) / 2, w, h}, image.Rect(0, 0, dw, dh)
+	}
+	return full, image.Rect(0, 0, dw, dh)
+}
+
+func evenSize(v float64, limit int) int {
+	n := int(math.Round(v)) &^ 1
+	if n < 2 {
+		n = 2
+	}
+	if n > limit {
+		n = limit
+	}
+	return n
+}
+
+// FrameConverter converts frames of one VideoFormat to I420 frames of
+// another size, ignoring the frame rates.
+type FrameConverter struct {
+	in, out VideoFormat
+	cfg     ConvertConfig
+	dst     image.Rectangle
+
+	luma, chroma *scaler
+	rgb          rgbToYUV
+
+	// source planes for formats other than I420
+	y, u, v []byte
+	frame   []byte
+}
+
+// NewFrameConverter creates a converter from any PixelFormat to I420. The
+// output size must be even.
+func NewFrameConverter(in, out VideoFormat, cfg ConvertConfig) (*FrameConverter, error) {
+	if out.Pixel != PixelI420 {
+		return nil, fmt.Errorf("unsupported output pixel format %s, only I420 is supported", out.Pixel)
+	}
+	if err := out.Pixel.CheckSize(out.Width, out.Height); err != nil {
+		return nil, fmt.Errorf("output: %v", err)
+	}
+	switch in.Pixel {
+	case PixelI420, PixelNV12, PixelRGBA, PixelBGRA:
+	default:
+		return nil, fmt.Errorf("unsupported source pixel format %s", in.Pixel)
+	}
+	if err := in.Pixel.CheckSize(in.Width, in.Height); err != nil {
+		return nil, fmt.Errorf("source: %v", err)
+	}
+
+	src, dst := fit(cfg.Fit, in.Width, in.Height, out.Width, out.Height)
+	cw, ch := (in.Width+1)/2, (in.Height+1)/2
+	c := &FrameConverter{
+		in:     in,
+		out:    out,
+		cfg:    cfg,
+		dst:    dst,
+		luma:   newScaler(cfg.Filter, src, in.Width, in.Height, dst),
+		chroma: newScaler(cfg.Filter, rect{src.x / 2, src.y / 2, src.w / 2, src.h / 2}, cw, ch, image.Rect(dst.Min.X/2, dst.Min.Y/2, dst.Max.X/2, dst.Max.Y/2)),
+		rgb:    cfg.Matrix.rgbToYUV(),
+		frame:  make([]byte, out.FrameSize()),
+	}
+	switch in.Pixel {
+	case PixelNV12:
+		c.u, c.v = make([]byte, cw*ch), make([]byte, cw*ch)
+	case PixelRGBA, PixelBGRA:
+		c.y, c.u, c.v = make([]byte, in.Width*in.Height), make([]byte, cw*ch), make([]byte, cw*ch)
+	}
+	// The bars outside the picture never change
+	fillRect(c.frame, out.Width, out.Height, 0, 0, out.Width, out.Height, barBlack)
+	return c, nil
+}
+
+// Convert returns the converted frame, valid until the next call.
+func (c *FrameConverter) Convert(data []byte) ([]byte, error) {
+	if len(data) != c.in.FrameSize() {
+		return nil, fmt.Errorf("%s frame has %d bytes, expected %d", c.in, len(data), c.in.FrameSize())
+	}
+
+	w, h := c.in.Width, c.in.Height
+	cw := (w + 1) / 2
+	var y, u, v []byte
+	switch c.in.Pixel {
+	case PixelI420:
+		y, u, v = data[:w*h], data[w*h:w*h+w*h/4], data[w*h+w*h/4:]
+	case PixelNV12:
+		y, u, v = data[:w*h], c.u, c.v
+		uv := data[w*h:]
+		for i := range c.u {
+			c.u[i], c.v[i] = uv[2*i], uv[2*i+1]
+		}
+	case PixelRGBA:
+		c.splitRGB(data, 0, 2)
+		y, u, v = c.y, c.u, c.v
+	case PixelBGRA:
+		c.splitRGB(data, 2, 0)
+		y, u, v = c.y, c.u, c.v
+	}
+
+	ow, oh := c.out.Width, c.out.Height
+	c.luma.scale(c.frame[:ow*oh], ow, c.dst.Min.X, c.dst.Min.Y, y, w)
+	c.chroma.scale(c.frame[ow*oh:ow*oh+ow*oh/4], ow/2, c.dst.Min.X/2, c.dst.Min.Y/2, u, cw)
+	c.chroma.scale(c.frame[ow*oh+ow*oh/4:], ow/2, c.dst.Min.X/2, c.dst.Min.Y/2, v, cw)
+	return c.frame, nil
+}
+
+// splitRGB converts packed 4-byte pixels to Y, U and V planes, with chroma
+// averaged over 2x2 blocks. r and b are the byte offsets of red and blue.
+func (c *FrameConverter) splitRGB(data []byte, r, b int) {
+	w, h := c.in.Width, c.in.Height
+	cw := (w + 1) / 2
+	if w%2 == 0 && h%2 == 0 {
+		c.splitRGBEven(data, r, b)
+		return
+	}
+	for y := 0; y < h; y += 2 {
+		for x := 0; x < w; x += 2 {
+			var sr, sg, sb, n int32
+			for dy := 0; dy < 2 && y+dy < h; dy++ {
+				for dx := 0; dx < 2 && x+dx < w; dx++ {
+					i := 4 * ((y+dy)*w + x + dx)
+					pr, pg, pb := int32(data[i+r]), int32(data[i+1]), int32(data[i+b])
+					c.y[(y+dy)*w+x+dx] = c.rgb.y(pr, pg, pb)
+					sr, sg, sb, n = sr+pr, sg+pg, sb+pb, n+1
+				}
+			}
+			c.u[y/2*cw+x/2], c.v[y/2*cw+x/2] = c.rgb.uv((sr+n/2)/n, (sg+n/2)/n, (sb+n/2)/n)
+		}
+	}
+}
+
+// splitRGBEven is splitRGB for the common even frame sizes, two rows at a
+// time.
+func (c *FrameConverter) splitRGBEven(data []byte, r, b int) {
+	w, h := c.in.Width, c.in.Height
+	cw := w / 2
+	m := &c.rgb
+	for y := 0; y < h; y += 2 {
+		top := data[4*y*w : 4*(y+1)*w]
+		bottom := data[4*(y+1)*w : 4*(y+2)*w]
+		yTop := c.y[y*w : (y+1)*w]
+		yBottom := c.y[(y+1)*w : (y+2)*w]
+		u := c.u[y/2*cw : y/2*cw+cw]
+		v := c.v[y/2*cw : y/2*cw+cw]
+		for x := 0; x < cw; x++ {
+			p := top[8*x : 8*x+8]
+			q := bottom[8*x : 8*x+8]
+			r0, g0, b0 := int32(p[r]), int32(p[1]), int32(p[b])
+			r1, g1, b1 := int32(p[4+r]), int32(p[5]), int32(p[4+b])
+			r2, g2, b2 := int32(q[r]), int32(q[1]), int32(q[b])
+			r3, g3, b3 := int32(q[4+r]), int32(q[5]), int32(q[4+b])
+			yTop[2*x] = m.y(r0, g0, b0)
+			yTop[2*x+1] = m.y(r1, g1, b1)
+			yBottom[2*x] = m.y(r2, g2, b2)
+			yBottom[2*x+1] = m.y(r3, g3, b3)
+			u[x], v[x] = m.uv((r0+r1+r2+r3+2)>>2, (g0+g1+g2+g3+2)>>2, (b0+b1+b2+b3+2)>>2)
+		}
+	}
+}
+
+// I420ToRGBA converts an I420 frame to packed RGBA with opaque alpha,
+// reusing dst if it is large enough.
+func I420ToRGBA(dst, src []byte, width, height int, m ColorMatrix) []byte {
+	size := 4 * width * height
+	if cap(dst) < size {
+		dst = make([]byte, size)
+	}
+	dst = dst[:size]
+
+	c := m.yuvToRGB()
+	cw := width / 2
+	u := src[width*height:]
+	v := src[width*height+cw*(height/2):]
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			ci := y/2*cw + x/2
+			i := 4 * (y*width + x)
+			dst[i], dst[i+1], dst[i+2] = c.rgb(src[y*width+x], u[ci], v[ci])
+			dst[i+3] = 255
+		}
+	}
+	return dst
+}
+
+// VideoConverter is a VideoSource that converts the frames of another
+// source to I420 of a fixed size, keeping their timing.
+type VideoConverter struct {
+	src    VideoSource
+	format VideoFormat
+	conv   *FrameConverter
+}
+
+// ConvertVideo returns src itself if it already produces frames of format's
+// size and pixel format, otherwise a converter to them. The frame rate of
+// src is kept.
+func ConvertVideo(src VideoSource, format VideoFormat, cfg ConvertConfig) (VideoSource, error) {
+	in := src.VideoFormat()
+	format.FrameRateNum, format.FrameRateDen = in.FrameRateNum, in.FrameRateDen
+	if in == format {
+		return src, nil
+	}
+	conv, err := NewFrameConverter(in, format, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &VideoConverter{src: src, format: format, conv: conv}, nil
+}
+
+func (v *VideoConverter) VideoFormat() VideoFormat { return v.format }
+
+func (v *VideoConverter) ReadVideo(ctx context.Context) (Frame, error) {
+	frame, err := v.src.ReadVideo(ctx)
+	if err != nil {
+		return Frame{}, err
+	}
+	data, err := v.conv.Convert(frame.Data)
+	if err != nil {
+		return Frame{}, err
+	}
+	return Frame{Data: data, PTS: frame.PTS}, nil
+}
+
+func (v *VideoConverter) Skip(frames int64) error {
+	return SkipVideo(context.Background(), v.src, frames)
+}
+
+func (v *VideoConverter) Rewind() error { return rewind(v.src) }
+
+func (v *VideoConverter) Close() error { return v.src.Close() }
@@ -0,0 +1,302 @@
+package media
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// psnr compares two byte slices of the same length, in dB.
+func psnr(a, b []byte) float64 {
+	var sum float64
+	for i := range a {
+		d := float64(a[i]) - float64(b[i])
+		sum += d * d
+	}
+	if sum == 0 {
+		return math.Inf(1)
+	}
+	return 10 * math.Log10(255*255/(sum/float64(len(a))))
+}
+
+// randomRGBA returns a packed 4-byte frame of smooth random colors, so that
+// neighbouring pixels are similar as in real pictures.
+func randomRGBA(rng *rand.Rand, width, height int) []byte {
+	data := make([]byte, 4*width*height)
+	var r, g, b float64 = 128, 128, 128
+	for i := 0; i < len(data); i += 4 {
+		r = math.Max(0, math.Min(255, r+rng.Float64()*16-8))
+		g = math.Max(0, math.Min(255, g+rng.Float64()*16-8))
+		b = math.Max(0, math.Min(255, b+rng.Float64()*16-8))
+		data[i], data[i+1], data[i+2], data[i+3] = byte(r), byte(g), byte(b), 255
+	}
+	return data
+}
+
+func newTestConverter(t testing.TB, in, out VideoFormat, cfg ConvertConfig) *FrameConverter {
+	t.Helper()
+	c, err := NewFrameConverter(in, out, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestSplitRGBGolden(t *testing.T) {
+	// Limited range Y'CbCr of the primaries, as in the BT.601 and BT.709
+	// color bar tables
+	tests := []struct {
+		matrix  ColorMatrix
+		r, g, b byte
+		y, u, v byte
+	}{
+		{BT601, 0, 0, 0, 16, 128, 128},
+		{BT601, 255, 255, 255, 235, 128, 128},
+		{BT601, 255, 0, 0, 81, 90, 240},
+		{BT601, 0, 255, 0, 145, 54, 34},
+		{BT601, 0, 0, 255, 41, 240, 110},
+		{BT709, 0, 0, 0, 16, 128, 128},
+		{BT709, 255, 255, 255, 235, 128, 128},
+		{BT709, 255, 0, 0, 63, 102, 240},
+		{BT709, 0, 255, 0, 173, 42, 26},
+		{BT709, 0, 0, 255, 32, 240, 118},
+	}
+	for _, tt := range tests {
+		// 2x2 takes the even path, 3x3 the generic one
+		for _, size := range []int{2, 3} {
+			for _, pixel := range []PixelFormat{PixelRGBA, PixelBGRA} {
+				name := fmt.Sprintf("%s/%d,%d,%d/%dx%d/%s", tt.matrix, tt.r, tt.g, tt.b, size, size, pixel)
+				t.Run(name, func(t *testing.T) {
+					in := VideoFormat{Width: size, Height: size, Pixel: pixel}
+					c := newTestConverter(t, in, VideoFormat{Width: 2, Height: 2, Pixel: PixelI420}, ConvertConfig{Matrix: tt.matrix})
+					data := make([]byte, in.FrameSize())
+					for i := 0; i < len(data); i += 4 {
+						data[i+1], data[i+3] = tt.g, 255
+						if pixel == PixelRGBA {
+							data[i], data[i+2] = tt.r, tt.b
+						} else {
+							data[i], data[i+2] = tt.b, tt.r
+						}
+					}
+					if pixel == PixelRGBA {
+						c.splitRGB(data, 0, 2)
+					} else {
+						c.splitRGB(data, 2, 0)
+					}
+					for i, y := range c.y {
+						if y != tt.y {
+							t.Fatalf("Y[%d] = %d, want %d", i, y, tt.y)
+						}
+					}
+					for i := range c.u {
+						if c.u[i] != tt.u || c.v[i] != tt.v {
+							t.Fatalf("UV[%d] = %d,%d, want %d,%d", i, c.u[i], c.v[i], tt.u, tt.v)
+						}
+					}
+				})
+			}
+		}
+	}
+}
+
+// The fixed-point conversion matches the exact one, with chroma averaged
+// over the 2x2 blocks, for even and odd sizes.
+func TestSplitRGBAccuracy(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, matrix := range []ColorMatrix{BT601, BT709} {
+		for _, size := range [][2]int{{64, 48}, {63, 47}, {1, 1}, {2, 5}} {
+			t.Run(fmt.Sprintf("%s/%dx%d", matrix, size[0], size[1]), func(t *testing.T) {
+				w, h := size[0], size[1]
+				in := VideoFormat{Width: w, Height: h, Pixel: PixelRGBA}
+				c := newTestConverter(t, in, VideoFormat{Width: 2, Height: 2, Pixel: PixelI420}, ConvertConfig{Matrix: matrix})
+				data := randomRGBA(rng, w, h)
+				c.splitRGB(data, 0, 2)
+
+				cw, ch := (w+1)/2, (h+1)/2
+				wantY := make([]byte, w*h)
+				wantU, wantV := make([]byte, cw*ch), make([]byte, cw*ch)
+				for y := 0; y < h; y += 2 {
+					for x := 0; x < w; x += 2 {
+						var sr, sg, sb, n float64
+						for dy := 0; dy < 2 && y+dy < h; dy++ {
+							for dx := 0; dx < 2 && x+dx < w; dx++ {
+								i := 4 * ((y+dy)*w + x + dx)
+								r, g, b := float64(data[i])/255, float64(data[i+1])/255, float64(data[i+2])/255
+								wantY[(y+dy)*w+x+dx] = matrix.yuv(r, g, b).y
+								sr, sg, sb, n = sr+r, sg+g, sb+b, n+1
+							}
+						}
+						c := matrix.yuv(sr/n, sg/n, sb/n)
+						wantU[y/2*cw+x/2], wantV[y/2*cw+x/2] = c.u, c.v
+					}
+				}
+				for name, planes := range map[string][2][]byte{"Y": {c.y, wantY}, "U": {c.u, wantU}, "V": {c.v, wantV}} {
+					if p := psnr(planes[0], planes[1]); p < 50 {
+						t.Errorf("%s plane PSNR %.1fdB, want at least 50dB", name, p)
+					}
+				}
+			})
+		}
+	}
+}
+
+// RGB converted to I420 and back is unchanged up to rounding when the
+// chroma is the same within every 2x2 block.
+func TestI420ToRGBARoundTrip(t *testing.T) {
+	const w, h = 64, 48
+	rng := rand.New(rand.NewSource(2))
+	for _, matrix := range []ColorMatrix{BT601, BT709} {
+		t.Run(matrix.String(), func(t *testing.T) {
+			// One color per 2x2 block, so chroma subsampling loses nothing
+			data := make([]byte, 4*w*h)
+			for y := 0; y < h; y += 2 {
+				for x := 0; x < w; x += 2 {
+					r, g, b := byte(rng.Intn(256)), byte(rng.Intn(256)), byte(rng.Intn(256))
+					for i := range 4 {
+						p := 4 * ((y+i/2)*w + x + i%2)
+						data[p], data[p+1], data[p+2], data[p+3] = r, g, b, 255
+					}
+				}
+			}
+			in := VideoFormat{Width: w, Height: h, Pixel: PixelRGBA}
+			out := VideoFormat{Width: w, Height: h, Pixel: PixelI420}
+			frame, err := newTestConverter(t, in, out, ConvertConfig{Matrix: matrix}).Convert(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			back := I420ToRGBA(nil, frame, w, h, matrix)
+			if p := psnr(back, data); p < 40 {
+				t.Errorf("round trip PSNR %.1fdB, want at least 40dB", p)
+			}
+			for i := 3; i < len(back); i += 4 {
+				if back[i] != 255 {
+					t.Fatalf("alpha %d at pixel %d", back[i], i/4)
+				}
+			}
+		})
+	}
+}
+
+func TestFit(t *testing.T) {
+	tests := []struct {
+		name           string
+		mode           FitMode
+		sw, sh, dw, dh int
+		src            rect
+		dst            image.Rectangle
+	}{
+		{"letterbox same aspect", FitLetterbox, 1920, 1080, 1280, 720, rect{0, 0, 1920, 1080}, image.Rect(0, 0, 1280, 720)},
+		{"letterbox pillarbox", FitLetterbox, 640, 480, 1280, 720, rect{0, 0, 640, 480}, image.Rect(160, 0, 1120, 720)},
+		{"letterbox bars", FitLetterbox, 1920, 1080, 720, 720, rect{0, 0, 1920, 1080}, image.Rect(0, 158, 720, 562)},
+		{"letterbox odd source", FitLetterbox, 333, 333, 640, 360, rect{0, 0, 333, 333}, image.Rect(140, 0, 500, 360)},
+		{"crop sides", FitCrop, 1920, 1080, 720, 720, rect{420, 0, 1080, 1080}, image.Rect(0, 0, 720, 720)},
+		{"crop top and bottom", FitCrop, 640, 480, 1280, 720, rect{0, 60, 640, 360}, image.Rect(0, 0, 1280, 720)},
+		{"crop same aspect", FitCrop, 1920, 1080, 1280, 720, rect{0, 0, 1920, 1080}, image.Rect(0, 0, 1280, 720)},
+		{"stretch", FitStretch, 640, 480, 1280, 720, rect{0, 0, 640, 480}, image.Rect(0, 0, 1280, 720)},
+	}
+	const eps = 1e-9
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, dst := fit(tt.mode, tt.sw, tt.sh, tt.dw, tt.dh)
+			if math.Abs(src.x-tt.src.x) > eps || math.Abs(src.y-tt.src.y) > eps ||
+				math.Abs(src.w-tt.src.w) > eps || math.Abs(src.h-tt.src.h) > eps {
+				t.Errorf("source %+v, want %+v", src, tt.src)
+			}
+			if dst != tt.dst {
+				t.Errorf("output %v, want %v", dst, tt.dst)
+			}
+			// 4:2:0 chroma needs even output rectangles
+			if dst.Min.X%2 != 0 || dst.Min.Y%2 != 0 || dst.Dx()%2 != 0 || dst.Dy()%2 != 0 {
+				t.Errorf("output %v is not even", dst)
+			}
+			if !dst.In(image.Rect(0, 0, tt.dw, tt.dh)) {
+				t.Errorf("output %v outside the %dx%d frame", dst, tt.dw, tt.dh)
+			}
+		})
+	}
+}
+
+func TestNewKernel(t *testing.T) {
+	tests := []struct {
+		name          string
+		filter        ScaleFilter
+		start, length float64
+		size, n       int
+		identity      bool
+	}{
+		{"same size", ScaleArea, 0, 720, 720, 720, true},
+		{"same size bilinear", ScaleBilinear, 0, 720, 720, 720, true},
+		{"whole pixel crop", ScaleArea, 60, 360, 480, 360, true},
+		{"fractional crop", ScaleArea, 60.5, 360, 480, 360, false},
+		{"area 1.5x down", ScaleArea, 0, 1920, 1920, 1280, false},
+		{"area 3x down", ScaleArea, 0, 1080, 1080, 360, false},
+		{"area 2.7x down", ScaleArea, 0, 1920, 1920, 711, false},
+		{"area up", ScaleArea, 0, 480, 480, 720, false},
+		{"bilinear down", ScaleBilinear, 0, 1080, 1080, 720, false},
+		{"bilinear up", ScaleBilinear, 0, 352, 352, 1280, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := newKernel(tt.filter, tt.start, tt.length, tt.size, tt.n)
+			if k.identity != tt.identity {
+				t.Errorf("identity = %v, want %v", k.identity, tt.identity)
+			}
+			if len(k.index) != tt.n*k.taps || len(k.weights) != tt.n*k.taps {
+				t.Fatalf("%d indexes and %d weights for %d pixels of %d taps", len(k.index), len(k.weights), tt.n, k.taps)
+			}
+			lo, hi := tt.size, -1
+			for i := 0; i < tt.n; i++ {
+				var sum int32
+				for t2 := i * k.taps; t2 < (i+1)*k.taps; t2++ {
+					if k.weights[t2] < 0 {
+						t.Fatalf("pixel %d has negative weight %d", i, k.weights[t2])
+					}
+					index := k.index[t2]
+					if index < 0 || index >= tt.size {
+						t.Fatalf("pixel %d reads source pixel %d of %d", i, index, tt.size)
+					}
+					lo, hi = min(lo, index), max(hi, index)
+					sum += k.weights[t2]
+				}
+				if sum != 1<<kernelBits {
+					t.Fatalf("weights of pixel %d sum to %d, want %d", i, sum, 1<<kernelBits)
+				}
+			}
+			if k.min != lo || k.max != hi {
+				t.Errorf("source range %d-%d, want %d-%d", k.min, k.max, lo, hi)
+			}
+			if k.identity {
+				for i := 0; i < tt.n; i++ {
+					if k.index[i*k.taps] != int(tt.start)+i {
+						t.Fatalf("pixel %d reads source pixel %d, want %d", i, k.index[i*k.taps], int(tt.start)+i)
+					}
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkFrameConverter(b *testing.B) {
+	out := VideoFormat{Width: 1280, Height: 720, Pixel: PixelI420}
+	for _, pixel := range []PixelFormat{PixelRGBA, PixelNV12, PixelI420} {
+		for _, filter := range []ScaleFilter{ScaleArea, ScaleBilinear} {
+			b.Run(fmt.Sprintf("%s-1080p-720p-%s", pixel, filter), func(b *testing.B) {
+				in := VideoFormat{Width: 1920, Height: 1080, Pixel: pixel}
+				c := newTestConverter(b, in, out, ConvertConfig{Filter: filter})
+				data := make([]byte, in.FrameSize())
+				if pixel == PixelRGBA {
+					data = randomRGBA(rand.New(rand.NewSource(3)), in.Width, in.Height)
+				}
+				b.SetBytes(int64(len(data)))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, err := c.Convert(data); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package media
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// VideoCodec is the compression of an encoded video stream.
+type VideoCodec int
+
+const (
+	CodecH264 VideoCodec = iota
+	CodecVP8
+	CodecAV1
+)
+
+func (c VideoCodec) String() string {
+	switch c {
+	case CodecH264:
+		return "H264"
+	case CodecVP8:
+		return "VP8"
+	case CodecAV1:
+		return "AV1"
+	}
+	return fmt.Sprintf("VideoCodec(%d)", int(c))
+}
+
+// ParseVideoCodec parses "H264", "VP8" or "AV1", the names -videoCodec uses.
+func ParseVideoCodec(s string) (VideoCodec, error) {
+	for _, c := range []VideoCodec{CodecH264, CodecVP8, CodecAV1} {
+		if strings.EqualFold(s, c.String()) {
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown video codec %q, expected H264, VP8 or AV1", s)
+}
+
+// EncodedVideoFormat describes compressed video at a rational frame rate.
+type EncodedVideoFormat struct {
+	Codec        VideoCodec
+	Width        int
+	Height       int
+	FrameRateNum int
+	FrameRateDen int
+}
+
+// PTS is the presentation time of frame n.
+func (f EncodedVideoFormat) PTS(n int64) time.Duration {
+	return time.Duration(n * int64(time.Second) * int64(f.FrameRateDen) / int64(f.FrameRateNum))
+}
+
+func (f EncodedVideoFormat) String() string {
+	if f.FrameRateDen == 1 {
+		return fmt.Sprintf("%s %dx%d@%dfps", f.Codec, f.Width, f.Height, f.FrameRateNum)
+	}
+	return fmt.Sprintf("%s %dx%d@%d/%dfps", f.Codec, f.Width, f.Height, f.FrameRateNum, f.FrameRateDen)
+}
+
+// EncodedFrame is one compressed frame: an H.264 access unit in Annex-B
+// format with start codes, a VP8 frame or an AV1 temporal unit.
+type EncodedFrame struct {
+	Data []byte
+	PTS  time.Duration
+	// Key frames decode on their own; every other frame depends on the
+	// frames since the last key frame
+	Key bool
+}
+
+// EncodedFrameInfo describes the encoded video frame carried by a Sample.
+type EncodedFrameInfo struct {
+	Codec     VideoCodec
+	Key       bool
+	Width     int
+	Height    int
+	FrameRate int
+}
+
+// EncodedVideoSource produces compressed video that is published without
+// being decoded or re-encoded.
+type EncodedVideoSource interface {
+	EncodedVideoFormat() EncodedVideoFormat
+	// ReadEncodedVideo returns the next frame. The data is only valid until
+	// the next call. io.EOF means the source is exhausted.
+	ReadEncodedVideo(ctx context.Context) (EncodedFrame, error)
+	Close() error
+}
+
+// SkipEncodedVideo drops n frames from src, seeking when the source supports
+// it. The frames after a skip cannot be decoded until the next key frame.
+func SkipEncodedVideo(ctx context.Context, src EncodedVideoSource, n int64) error {
+	if s, ok := src.(Skipper); ok {
+		return s.Skip(n)
+	}
+	for i := int64(0); i < n; i++ {
+		if _, err := src.ReadEncodedVideo(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodedUnit locates one frame in an encoded video file.
+type encodedUnit struct {
+	offset int64
+	size   int
+	key    bool
+	// prefix is prepended to the frame, e.g. H.264 parameter sets for key
+	// frames that do not repeat them
+	prefix []byte
+}
+
+// encodedFile reads indexed frames from a file. Frames depend on each
+// other, so it can only play forwards.
+type encodedFile struct {
+	file   *os.File
+	format EncodedVideoFormat
+	mode   PlayMode
+	units  []encodedUnit
+	buf    []byte
+	pos    int64
+}
+
+func newEncodedFile(file *os.File, format EncodedVideoFormat, units []encodedUnit, mode PlayMode) (*encodedFile, error) {
+	if mode == PlayPingPong {
+		return nil, fmt.Errorf("play mode %s is not supported for encoded video, frames cannot be decoded backwards", mode)
+	}
+	if len(units) == 0 {
+		return nil, fmt.Errorf("no video frames found")
+	}
+	return &encodedFile{file: file, format: format, mode: mode, units: units}, nil
+}
+
+func (f *encodedFile) EncodedVideoFormat() EncodedVideoFormat { return f.format }
+
+func (f *encodedFile) ReadEncodedVideo(ctx context.Context) (EncodedFrame, error) {
+	n := f.pos
+	frames := int64(len(f.units))
+	if f.mode == PlayOnce && n >= frames {
+		return EncodedFrame{}, io.EOF
+	}
+	u := f.units[n%frames]
+
+	size := len(u.prefix) + u.size
+	if cap(f.buf) < size {
+		f.buf = make([]byte, size)
+	}
+	f.buf = f.buf[:size]
+	copy(f.buf, u.prefix)
+	if _, err := f.file.ReadAt(f.buf[len(u.prefix):], u.offset); err != nil {
+		return EncodedFrame{}, err
+	}
+
+	f.pos++
+	return EncodedFrame{Data: f.buf, PTS: f.format.PTS(n), Key: u.key}, nil
+}
+
+func (f *encodedFile) Skip(frames int64) error {
+	f.pos += frames
+	return nil
+}
+
+func (f *encodedFile) Rewind() error {
+	f.pos = 0
+	return nil
+}
+
+func (f *encodedFile) Close() error { return f.file.Close() }
+
+// IsEncodedVideoFile reports whether the file is an IVF file, or an Annex-B
+// H.264 stream judged by its .h264, .264 or .avc extension and a leading
+// start code.
+func IsEncodedVideoFile(path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	head := make([]byte, 4)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return false, err
+	}
+	head = head[:n]
+	if string(head) == ivfSignature {
+		return true, nil
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".h264", ".264", ".avc":
+		return hasStartCode(head), nil
+	}
+	return false, nil
+}
+
+// OpenEncodedVideoFile opens an IVF file with VP8 or AV1 video, or an
+// Annex-B H.264 stream. The size comes from the file. frameRate is used for
+// H.264 streams whose SPS carries no timing information; IVF files always
+// give their own rate.
+func OpenEncodedVideoFile(path string, frameRate int, mode PlayMode) (EncodedVideoSource, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open video file %s: %v", path, err)
+	}
+
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(file, head); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to read video file %s: %v", path, err)
+	}
+
+	var src *encodedFile
+	if string(head) == ivfSignature {
+		src, err = openIVF(file, mode)
+	} else {
+		src, err = openAnnexB(file, frameRate, mode)
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to open video file %s: %v", path, err)
+	}
+	return src, nil
+}
+
+// reduceRatio divides num and den by their greatest common divisor.
+func reduceRatio(num, den int64) (int64, int64) {
+	a, b := num, den
+	for b != 0 {
+		a, b = b, a%b
+	}
+	if a == 0 {
+		return num, den
+	}
+	return num / a, den / a
+}
+
+// plausibleFrameRate rejects rates that come from garbage or placeholder
+// header fields.
+func plausibleFrameRate(num, den int64) bool {
+	return num > 0 && den > 0 && num <= 240*den && num*10 >= den
+}
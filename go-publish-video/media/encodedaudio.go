@@ -0,0 +1,201 @@
+package media
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// AudioCodec is the compression of an encoded audio stream.
+type AudioCodec int
+
+const (
+	CodecOpus AudioCodec = iota
+	// CodecAAC is AAC-LC in ADTS frames
+	CodecAAC
+)
+
+func (c AudioCodec) String() string {
+	switch c {
+	case CodecOpus:
+		return "Opus"
+	case CodecAAC:
+		return "AAC"
+	}
+	return fmt.Sprintf("AudioCodec(%d)", int(c))
+}
+
+// EncodedAudioFormat describes compressed audio in frames of a constant
+// duration.
+type EncodedAudioFormat struct {
+	Codec           AudioCodec
+	SampleRate      int
+	Channels        int
+	SamplesPerFrame int // per channel
+}
+
+// FrameDuration is the presentation time of one frame.
+func (f EncodedAudioFormat) FrameDuration() time.Duration {
+	return f.PTS(1)
+}
+
+// PTS is the presentation time of frame n.
+func (f EncodedAudioFormat) PTS(n int64) time.Duration {
+	return time.Duration(n * int64(f.SamplesPerFrame) * int64(time.Second) / int64(f.SampleRate))
+}
+
+func (f EncodedAudioFormat) String() string {
+	return fmt.Sprintf("%s %dHz %dch %v frames", f.Codec, f.SampleRate, f.Channels, f.FrameDuration())
+}
+
+// EncodedAudioSource produces compressed audio that is published without
+// being decoded or re-encoded. Every frame decodes on its own.
+type EncodedAudioSource interface {
+	EncodedAudioFormat() EncodedAudioFormat
+	// ReadEncodedAudio returns the next frame. The data is only valid until
+	// the next call. io.EOF means the source is exhausted.
+	ReadEncodedAudio(ctx context.Context) (EncodedFrame, error)
+	Close() error
+}
+
+// SkipEncodedAudio drops n frames from src, seeking when the source supports
+// it.
+func SkipEncodedAudio(ctx context.Context, src EncodedAudioSource, n int64) error {
+	if s, ok := src.(Skipper); ok {
+		return s.Skip(n)
+	}
+	for i := int64(0); i < n; i++ {
+		if _, err := src.ReadEncodedAudio(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodedAudioFile plays indexed frames from a file, or packets that were
+// read into memory because the container splits them, like Ogg.
+type encodedAudioFile struct {
+	file    *os.File
+	format  EncodedAudioFormat
+	mode    PlayMode
+	units   []encodedUnit
+	packets [][]byte
+	buf     []byte
+	pos     int64
+}
+
+func (f *encodedAudioFile) frames() int64 {
+	if f.packets != nil {
+		return int64(len(f.packets))
+	}
+	return int64(len(f.units))
+}
+
+func (f *encodedAudioFile) EncodedAudioFormat() EncodedAudioFormat { return f.format }
+
+func (f *encodedAudioFile) ReadEncodedAudio(ctx context.Context) (EncodedFrame, error) {
+	n := f.pos
+	if f.mode == PlayOnce && n >= f.frames() {
+		return EncodedFrame{}, io.EOF
+	}
+	i := n % f.frames()
+
+	var data []byte
+	if f.packets != nil {
+		data = f.packets[i]
+	} else {
+		u := f.units[i]
+		if cap(f.buf) < u.size {
+			f.buf = make([]byte, u.size)
+		}
+		data = f.buf[:u.size]
+		if _, err := f.file.ReadAt(data, u.offset); err != nil {
+			return EncodedFrame{}, err
+		}
+	}
+
+	f.pos++
+	return EncodedFrame{Data: data, PTS: f.format.PTS(n), Key: true}, nil
+}
+
+func (f *encodedAudioFile) Skip(frames int64) error {
+	f.pos += frames
+	return nil
+}
+
+func (f *encodedAudioFile) Rewind() error {
+	f.pos = 0
+	return nil
+}
+
+func (f *encodedAudioFile) Close() error {
+	if f.file == nil {
+		return nil
+	}
+	return f.file.Close()
+}
+
+// IsEncodedAudioFile reports whether the file is an Ogg file, or an ADTS AAC
+// stream judged by its frame sync word or, after an ID3 tag, its .aac
+// extension.
+func IsEncodedAudioFile(path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	head := make([]byte, 4)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return false, err
+	}
+	head = head[:n]
+	switch {
+	case string(head) == oggSignature:
+		return true, nil
+	case len(head) >= 2 && isADTSSync(head):
+		return true, nil
+	case len(head) >= 3 && string(head[:3]) == "ID3":
+		ext := strings.ToLower(filepath.Ext(path))
+		return ext == ".aac" || ext == ".adts", nil
+	}
+	return false, nil
+}
+
+// OpenEncodedAudioFile opens an Ogg file with Opus audio, or an ADTS stream
+// with AAC-LC audio. The format comes from the file; all frames must have
+// the same duration.
+func OpenEncodedAudioFile(path string, mode PlayMode) (EncodedAudioSource, error) {
+	mode = mode.forAudio()
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audio file %s: %v", path, err)
+	}
+
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(file, head); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to read audio file %s: %v", path, err)
+	}
+
+	var src *encodedAudioFile
+	if string(head) == oggSignature {
+		// The packets are read into memory, the file is not needed anymore
+		src, err = openOggOpus(file, mode)
+		file.Close()
+	} else {
+		src, err = openADTS(file, mode)
+		if err != nil {
+			file.Close()
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audio file %s: %v", path, err)
+	}
+	return src, nil
+}
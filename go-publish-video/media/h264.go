@@ -0,0 +1,412 @@
+package media
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+)
+
+// H.264 NAL unit types
+const (
+	nalSlice    = 1
+	nalIDR      = 5
+	nalSEI      = 6
+	nalSPS      = 7
+	nalPPS      = 8
+	nalAUD      = 9
+	nalPrefix   = 14
+	nalReserved = 18 // last of the types that may start an access unit
+)
+
+func hasStartCode(head []byte) bool {
+	switch {
+	case len(head) >= 3 && head[0] == 0 && head[1] == 0 && head[2] == 1:
+		return true
+	case len(head) >= 4 && head[0] == 0 && head[1] == 0 && head[2] == 0 && head[3] == 1:
+		return true
+	}
+	return false
+}
+
+// annexBIndex splits an Annex-B stream into access units while it is
+// scanned, following the rules of H.264 7.4.1.2.3: a unit ends before an
+// AUD, SPS, PPS, SEI or prefix NAL that follows a slice, and before a slice
+// that starts a new picture (first_mb_in_slice is 0).
+type annexBIndex struct {
+	units   []encodedUnit
+	bare    []int // key frames without their own SPS
+	start   int64 // of the current unit, -1 before the first NAL
+	slices  bool  // the current unit contains a slice
+	key     bool
+	params  bool // the current unit contains an SPS
+	sps     nalRange
+	pps     nalRange
+	pending *nalRange // parameter set whose end is not known yet
+}
+
+// nalRange is a NAL unit in the file. start is its start code and header
+// its header byte.
+type nalRange struct {
+	start, header, end int64
+}
+
+func (x *annexBIndex) nal(start, headerAt int64, header byte, firstMB0 bool) {
+	typ := header & 0x1f
+	slice := typ == nalSlice || typ == nalIDR
+
+	boundary := false
+	switch {
+	case typ == nalAUD, typ == nalSPS, typ == nalPPS, typ == nalSEI, typ >= nalPrefix && typ <= nalReserved:
+		boundary = x.slices
+	case slice:
+		boundary = x.slices && firstMB0
+	}
+	if boundary {
+		x.finish(start)
+	}
+	if x.start < 0 {
+		x.start = start
+	}
+
+	switch typ {
+	case nalIDR:
+		x.key = true
+	case nalSPS:
+		x.params = true
+		if x.sps.end == 0 {
+			x.sps = nalRange{start: start, header: headerAt}
+			x.pending = &x.sps
+		}
+	case nalPPS:
+		if x.pps.end == 0 {
+			x.pps = nalRange{start: start, header: headerAt}
+			x.pending = &x.pps
+		}
+	}
+	if slice {
+		x.slices = true
+	}
+}
+
+// end marks where the previous NAL unit ended.
+func (x *annexBIndex) end(offset int64) {
+	if x.pending != nil {
+		x.pending.end = offset
+		x.pending = nil
+	}
+}
+
+// finish closes the current unit at offset. Units without a slice, e.g.
+// trailing parameter sets, are dropped.
+func (x *annexBIndex) finish(offset int64) {
+	if x.slices {
+		if x.key && !x.params {
+			x.bare = append(x.bare, len(x.units))
+		}
+		x.units = append(x.units, encodedUnit{offset: x.start, size: int(offset - x.start), key: x.key})
+	}
+	x.start = offset
+	x.slices, x.key, x.params = false, false, false
+}
+
+// indexAnnexB scans a whole Annex-B stream.
+func indexAnnexB(r io.Reader) (*annexBIndex, error) {
+	br := bufio.NewReaderSize(r, 64*1024)
+	x := &annexBIndex{start: -1}
+
+	var (
+		pos     int64 = -1
+		zeros   int
+		nalAt   int64 // start code of the NAL whose header is being read
+		header  []byte
+		reading bool
+	)
+	for {
+		b, err := br.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		pos++
+
+		if b == 1 && zeros >= 2 {
+			start := pos - 2
+			if zeros >= 3 {
+				start = pos - 3
+			}
+			// A NAL too short to have a header and a payload byte is dropped
+			x.end(start)
+			nalAt = start
+			header = header[:0]
+			zeros = 0
+			reading = true
+			continue
+		}
+
+		if reading {
+			header = append(header, b)
+			if len(header) == 2 {
+				reading = false
+				x.nal(nalAt, pos-1, header[0], header[1]&0x80 != 0)
+			}
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	x.end(pos + 1)
+	x.finish(pos + 1)
+	return x, nil
+}
+
+func openAnnexB(file *os.File, frameRate int, mode PlayMode) (*encodedFile, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	x, err := indexAnnexB(file)
+	if err != nil {
+		return nil, err
+	}
+	if x.sps.end == 0 || x.pps.end == 0 {
+		return nil, fmt.Errorf("no H.264 SPS and PPS found, not an Annex-B H.264 stream")
+	}
+
+	readNAL := func(n nalRange) ([]byte, error) {
+		buf := make([]byte, n.end-n.start)
+		_, err := file.ReadAt(buf, n.start)
+		return buf, err
+	}
+	sps, err := readNAL(x.sps)
+	if err != nil {
+		return nil, err
+	}
+	pps, err := readNAL(x.pps)
+	if err != nil {
+		return nil, err
+	}
+	info, err := parseSPS(sps[x.sps.header-x.sps.start:])
+	if err != nil {
+		return nil, fmt.Errorf("invalid H.264 SPS: %v", err)
+	}
+
+	format := EncodedVideoFormat{Codec: CodecH264, Width: info.width, Height: info.height, FrameRateNum: frameRate, FrameRateDen: 1}
+	if plausibleFrameRate(info.rateNum, info.rateDen) {
+		num, den := reduceRatio(info.rateNum, info.rateDen)
+		format.FrameRateNum, format.FrameRateDen = int(num), int(den)
+	} else if frameRate <= 0 {
+		return nil, fmt.Errorf("H.264 stream has no frame rate and none was given")
+	}
+
+	// Encoders often send the parameter sets only once, but receivers that
+	// join later need them with every key frame
+	params := append(sps, pps...)
+	for _, i := range x.bare {
+		x.units[i].prefix = params
+	}
+	return newEncodedFile(file, format, x.units, mode)
+}
+
+// spsInfo is what the parent needs from a sequence parameter set.
+type spsInfo struct {
+	width, height    int
+	rateNum, rateDen int64 // zero without VUI timing information
+}
+
+// parseSPS reads the picture size and frame rate from an SPS NAL unit,
+// starting at its header byte.
+func parseSPS(nal []byte) (spsInfo, error) {
+	r := &bitReader{data: unescapeRBSP(nal[1:])}
+
+	profile := r.bits(8)
+	r.bits(16) // constraint flags and level
+	r.ue()     // seq_parameter_set_id
+
+	chromaFormat := uint32(1)
+	separateColourPlane := false
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormat = r.ue()
+		if chromaFormat == 3 {
+			separateColourPlane = r.flag()
+		}
+		r.ue()        // bit_depth_luma_minus8
+		r.ue()        // bit_depth_chroma_minus8
+		r.bits(1)     // qpprime_y_zero_transform_bypass_flag
+		if r.flag() { // seq_scaling_matrix_present_flag
+			lists := 8
+			if chromaFormat == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if !r.flag() {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := int32(8), int32(8)
+				for j := 0; j < size; j++ {
+					if next != 0 {
+						next = (last + r.se() + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+
+	r.ue()          // log2_max_frame_num_minus4
+	switch r.ue() { // pic_order_cnt_type
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.bits(1) // delta_pic_order_always_zero_flag
+		r.se()    // offset_for_non_ref_pic
+		r.se()    // offset_for_top_to_bottom_field
+		for n := r.ue(); n > 0 && r.err == nil; n-- {
+			r.se()
+		}
+	}
+	r.ue()    // max_num_ref_frames
+	r.bits(1) // gaps_in_frame_num_value_allowed_flag
+	widthMBs := int(r.ue()) + 1
+	heightMapUnits := int(r.ue()) + 1
+	frameMBsOnly := r.flag()
+	if !frameMBsOnly {
+		r.bits(1) // mb_adaptive_frame_field_flag
+	}
+	r.bits(1) // direct_8x8_inference_flag
+
+	fieldFactor := 2
+	if frameMBsOnly {
+		fieldFactor = 1
+	}
+	info := spsInfo{width: widthMBs * 16, height: fieldFactor * heightMapUnits * 16}
+
+	if r.flag() { // frame_cropping_flag
+		left, right, top, bottom := int(r.ue()), int(r.ue()), int(r.ue()), int(r.ue())
+		cropX, cropY := 1, fieldFactor
+		if chromaFormat != 0 && !separateColourPlane {
+			if chromaFormat == 1 || chromaFormat == 2 {
+				cropX = 2
+			}
+			if chromaFormat == 1 {
+				cropY *= 2
+			}
+		}
+		info.width -= (left + right) * cropX
+		info.height -= (top + bottom) * cropY
+	}
+
+	if r.flag() { // vui_parameters_present_flag
+		if r.flag() { // aspect_ratio_info_present_flag
+			if r.bits(8) == 255 { // Extended_SAR
+				r.bits(32)
+			}
+		}
+		if r.flag() { // overscan_info_present_flag
+			r.bits(1)
+		}
+		if r.flag() { // video_signal_type_present_flag
+			r.bits(4)
+			if r.flag() { // colour_description_present_flag
+				r.bits(24)
+			}
+		}
+		if r.flag() { // chroma_loc_info_present_flag
+			r.ue()
+			r.ue()
+		}
+		if r.flag() { // timing_info_present_flag
+			unitsInTick := int64(r.bits(32))
+			timeScale := int64(r.bits(32))
+			// A frame is two ticks
+			info.rateNum, info.rateDen = timeScale, 2*unitsInTick
+		}
+	}
+
+	if r.err != nil {
+		return spsInfo{}, r.err
+	}
+	if info.width <= 0 || info.height <= 0 {
+		return spsInfo{}, fmt.Errorf("invalid picture size %dx%d", info.width, info.height)
+	}
+	return info, nil
+}
+
+// unescapeRBSP removes the emulation prevention bytes from a NAL payload.
+func unescapeRBSP(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	zeros := 0
+	for _, b := range data {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// bitReader reads big-endian bit fields and Exp-Golomb codes. Reading past
+// the end sets err and returns zeros.
+type bitReader struct {
+	data []byte
+	pos  int // in bits
+	err  error
+}
+
+func (r *bitReader) bits(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		if r.pos >= 8*len(r.data) {
+			if r.err == nil {
+				r.err = io.ErrUnexpectedEOF
+			}
+			return 0
+		}
+		bit := r.data[r.pos/8] >> (7 - uint(r.pos%8)) & 1
+		v = v<<1 | uint32(bit)
+		r.pos++
+	}
+	return v
+}
+
+func (r *bitReader) flag() bool { return r.bits(1) == 1 }
+
+// ue reads an unsigned Exp-Golomb code.
+func (r *bitReader) ue() uint32 {
+	zeros := 0
+	for r.bits(1) == 0 {
+		if r.err != nil || zeros >= 31 {
+			if r.err == nil {
+				r.err = fmt.Errorf("invalid Exp-Golomb code")
+			}
+			return 0
+		}
+		zeros++
+	}
+	return 1<<uint(zeros) - 1 + r.bits(zeros)
+}
+
+// se reads a signed Exp-Golomb code.
+func (r *bitReader) se() int32 {
+	v := r.ue()
+	if v%2 == 1 {
+		return int32(v/2 + 1)
+	}
+	return -int32(v / 2)
+}
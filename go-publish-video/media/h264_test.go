@@ -0,0 +1,346 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// bitWriter builds big-endian bit fields and Exp-Golomb codes, the inverse
+// of bitReader.
+type bitWriter struct {
+	data []byte
+	n    int // in bits
+}
+
+func (w *bitWriter) bits(v uint32, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.n%8 == 0 {
+			w.data = append(w.data, 0)
+		}
+		if v>>uint(i)&1 == 1 {
+			w.data[len(w.data)-1] |= 1 << (7 - uint(w.n%8))
+		}
+		w.n++
+	}
+}
+
+func (w *bitWriter) flag(b bool) {
+	if b {
+		w.bits(1, 1)
+	} else {
+		w.bits(0, 1)
+	}
+}
+
+func (w *bitWriter) ue(v uint32) {
+	n := bits.Len32(v + 1)
+	w.bits(0, n-1)
+	w.bits(v+1, n)
+}
+
+// escapeRBSP inserts the emulation prevention bytes unescapeRBSP removes.
+func escapeRBSP(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	zeros := 0
+	for _, b := range data {
+		if zeros >= 2 && b <= 3 {
+			out = append(out, 3)
+			zeros = 0
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+type testSPS struct {
+	profile                  uint32
+	widthMBs, heightMapUnits uint32
+	interlaced               bool
+	crop                     [4]uint32 // left, right, top, bottom
+	unitsInTick, timeScale   uint32
+}
+
+// nal returns the SPS NAL unit from its header byte on, escaped.
+func (s testSPS) nal() []byte {
+	w := &bitWriter{}
+	w.bits(s.profile, 8)
+	w.bits(0, 8)  // constraint flags
+	w.bits(40, 8) // level 4.0
+	w.ue(0)       // seq_parameter_set_id
+	if s.profile == 100 {
+		w.ue(1)       // chroma_format_idc 4:2:0
+		w.ue(0)       // bit_depth_luma_minus8
+		w.ue(0)       // bit_depth_chroma_minus8
+		w.flag(false) // qpprime_y_zero_transform_bypass_flag
+		w.flag(false) // seq_scaling_matrix_present_flag
+	}
+	w.ue(0) // log2_max_frame_num_minus4
+	w.ue(2) // pic_order_cnt_type
+	w.ue(1) // max_num_ref_frames
+	w.flag(false)
+	w.ue(s.widthMBs - 1)
+	w.ue(s.heightMapUnits - 1)
+	w.flag(!s.interlaced)
+	if s.interlaced {
+		w.flag(false)
+	}
+	w.flag(true) // direct_8x8_inference_flag
+	w.flag(s.crop != [4]uint32{})
+	if s.crop != [4]uint32{} {
+		for _, c := range s.crop {
+			w.ue(c)
+		}
+	}
+	w.flag(s.timeScale > 0)
+	if s.timeScale > 0 {
+		w.bits(0, 4) // aspect ratio, overscan, video signal, chroma location
+		w.flag(true)
+		w.bits(s.unitsInTick, 32)
+		w.bits(s.timeScale, 32)
+		w.flag(true) // fixed_frame_rate_flag
+		w.bits(0, 4) // HRD, pic_struct and bitstream restriction
+	}
+	w.bits(1, 1) // rbsp_stop_one_bit
+	return append([]byte{0x67}, escapeRBSP(w.data)...)
+}
+
+func TestParseSPS(t *testing.T) {
+	tests := []struct {
+		name          string
+		sps           testSPS
+		width, height int
+		rateNum       int64
+		rateDen       int64
+	}{
+		{"baseline 720p", testSPS{profile: 66, widthMBs: 80, heightMapUnits: 45}, 1280, 720, 0, 0},
+		{"1080p cropped", testSPS{profile: 66, widthMBs: 120, heightMapUnits: 68, crop: [4]uint32{0, 0, 0, 4}}, 1920, 1080, 0, 0},
+		{"high profile cropped", testSPS{profile: 100, widthMBs: 40, heightMapUnits: 30, crop: [4]uint32{2, 2, 0, 0}}, 632, 480, 0, 0},
+		// Field pictures crop in units of two chroma rows
+		{"interlaced cropped", testSPS{profile: 100, widthMBs: 120, heightMapUnits: 34, interlaced: true, crop: [4]uint32{0, 0, 0, 2}}, 1920, 1080, 0, 0},
+		{"timing", testSPS{profile: 66, widthMBs: 80, heightMapUnits: 45, unitsInTick: 1, timeScale: 50}, 1280, 720, 50, 2},
+	}
+	for _, tt := range tests {
+		info, err := parseSPS(tt.sps.nal())
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		want := spsInfo{width: tt.width, height: tt.height, rateNum: tt.rateNum, rateDen: tt.rateDen}
+		if info != want {
+			t.Errorf("%s: parseSPS() = %+v, want %+v", tt.name, info, want)
+		}
+	}
+}
+
+// The 32-bit num_units_in_tick of 1 is a run of zero bytes that has to be
+// escaped.
+func TestParseSPSEmulationPrevention(t *testing.T) {
+	nal := testSPS{profile: 66, widthMBs: 80, heightMapUnits: 45, unitsInTick: 1, timeScale: 60}.nal()
+	if !bytes.Contains(nal, []byte{0, 0, 3}) {
+		t.Fatalf("SPS % x has no emulation prevention byte", nal)
+	}
+	info, err := parseSPS(nal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.rateNum != 60 || info.rateDen != 2 {
+		t.Errorf("rate = %d/%d, want 60/2", info.rateNum, info.rateDen)
+	}
+}
+
+func TestUnescapeRBSP(t *testing.T) {
+	tests := []struct {
+		in, want []byte
+	}{
+		{[]byte{0, 0, 3, 1}, []byte{0, 0, 1}},
+		{[]byte{0, 0, 3, 0, 0, 3}, []byte{0, 0, 0, 0}},
+		{[]byte{0, 0, 3, 3}, []byte{0, 0, 3}},
+		{[]byte{0, 3, 0, 3}, []byte{0, 3, 0, 3}},
+		{[]byte{1, 0, 0, 3}, []byte{1, 0, 0}},
+	}
+	for _, tt := range tests {
+		if got := unescapeRBSP(tt.in); !bytes.Equal(got, tt.want) {
+			t.Errorf("unescapeRBSP(% x) = % x, want % x", tt.in, got, tt.want)
+		}
+	}
+}
+
+// testNAL is one NAL unit of a test stream. A slice payload starts with
+// first_mb_in_slice, so 0x80 is the first slice of a picture and 0x40 the
+// second.
+type testNAL struct {
+	long bool // 4-byte start code
+	data []byte
+}
+
+var (
+	testAUD      = []byte{0x09, 0xf0}
+	testSEI      = []byte{0x06, 0x05, 0x01, 0xaa, 0x80}
+	testSPSNAL   = []byte{0x67, 0x42, 0x00, 0x28, 0xaa}
+	testPPSNAL   = []byte{0x68, 0xce, 0x3c, 0x80}
+	testIDR      = []byte{0x65, 0x88, 0xaa, 0xbb}
+	testIDRSlice = []byte{0x65, 0x40, 0xaa, 0xbb}
+	testP        = []byte{0x41, 0x9a, 0xaa}
+	testPSlice   = []byte{0x41, 0x40, 0xaa}
+)
+
+// annexB joins nals with their start codes and returns where each one
+// starts, followed by the length of the stream.
+func annexB(nals []testNAL) ([]byte, []int64) {
+	var stream []byte
+	var at []int64
+	for _, n := range nals {
+		at = append(at, int64(len(stream)))
+		if n.long {
+			stream = append(stream, 0)
+		}
+		stream = append(stream, 0, 0, 1)
+		stream = append(stream, n.data...)
+	}
+	return stream, append(at, int64(len(stream)))
+}
+
+func TestIndexAnnexB(t *testing.T) {
+	short := func(data ...[]byte) []testNAL {
+		nals := make([]testNAL, len(data))
+		for i, d := range data {
+			nals[i] = testNAL{data: d}
+		}
+		return nals
+	}
+	long := func(data ...[]byte) []testNAL {
+		nals := short(data...)
+		for i := range nals {
+			nals[i].long = true
+		}
+		return nals
+	}
+
+	// unit spans the NAL units [from, to)
+	type unit struct {
+		from, to int
+		key      bool
+	}
+	tests := []struct {
+		name  string
+		nals  []testNAL
+		units []unit
+		bare  []int
+		sps   int // index of the first SPS
+	}{
+		{
+			name:  "3-byte start codes",
+			nals:  short(testSPSNAL, testPPSNAL, testIDR, testP, testP),
+			units: []unit{{0, 3, true}, {3, 4, false}, {4, 5, false}},
+		},
+		{
+			name:  "4-byte start codes",
+			nals:  long(testSPSNAL, testPPSNAL, testIDR, testP),
+			units: []unit{{0, 3, true}, {3, 4, false}},
+		},
+		{
+			name:  "mixed start codes",
+			nals:  []testNAL{{true, testSPSNAL}, {false, testPPSNAL}, {true, testIDR}, {false, testP}},
+			units: []unit{{0, 3, true}, {3, 4, false}},
+		},
+		{
+			name:  "AUD and SEI open a unit",
+			nals:  long(testAUD, testSPSNAL, testPPSNAL, testSEI, testIDR, testAUD, testP, testSEI, testP),
+			units: []unit{{0, 5, true}, {5, 7, false}, {7, 9, false}},
+			sps:   1,
+		},
+		{
+			name:  "SPS after a slice opens a unit",
+			nals:  short(testSPSNAL, testPPSNAL, testIDR, testP, testSPSNAL, testPPSNAL, testIDR),
+			units: []unit{{0, 3, true}, {3, 4, false}, {4, 7, true}},
+		},
+		{
+			name:  "multi-slice pictures",
+			nals:  short(testSPSNAL, testPPSNAL, testIDR, testIDRSlice, testP, testPSlice, testPSlice),
+			units: []unit{{0, 4, true}, {4, 7, false}},
+		},
+		{
+			name:  "trailing parameter sets are dropped",
+			nals:  short(testSPSNAL, testPPSNAL, testIDR, testP, testSPSNAL, testPPSNAL),
+			units: []unit{{0, 3, true}, {3, 4, false}},
+		},
+		{
+			name:  "key frame without SPS",
+			nals:  short(testSPSNAL, testPPSNAL, testIDR, testP, testIDR),
+			units: []unit{{0, 3, true}, {3, 4, false}, {4, 5, true}},
+			bare:  []int{2},
+		},
+	}
+	for _, tt := range tests {
+		stream, at := annexB(tt.nals)
+		x, err := indexAnnexB(bytes.NewReader(stream))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+
+		want := make([]encodedUnit, len(tt.units))
+		for i, u := range tt.units {
+			want[i] = encodedUnit{offset: at[u.from], size: int(at[u.to] - at[u.from]), key: u.key}
+		}
+		if !reflect.DeepEqual(x.units, want) {
+			t.Errorf("%s: units = %+v, want %+v", tt.name, x.units, want)
+		}
+		if (len(x.bare) > 0 || len(tt.bare) > 0) && !reflect.DeepEqual(x.bare, tt.bare) {
+			t.Errorf("%s: bare key frames = %v, want %v", tt.name, x.bare, tt.bare)
+		}
+
+		// The first SPS and PPS are kept, including their start codes
+		header := int64(3)
+		if tt.nals[tt.sps].long {
+			header = 4
+		}
+		start, end := at[tt.sps], at[tt.sps+1]
+		if x.sps.start != start || x.sps.header != start+header || x.sps.end != end {
+			t.Errorf("%s: sps = %+v, want [%d, %d)", tt.name, x.sps, start, end)
+		}
+	}
+}
+
+func TestOpenAnnexB(t *testing.T) {
+	sps := testSPS{profile: 66, widthMBs: 120, heightMapUnits: 68, crop: [4]uint32{0, 0, 0, 4}, unitsInTick: 1, timeScale: 50}.nal()
+	stream, at := annexB([]testNAL{{true, sps}, {true, testPPSNAL}, {true, testIDR}, {true, testP}, {true, testIDR}})
+	path := filepath.Join(t.TempDir(), "test.h264")
+	if err := os.WriteFile(path, stream, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	src, err := OpenEncodedVideoFile(path, 0, PlayOnce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	want := EncodedVideoFormat{Codec: CodecH264, Width: 1920, Height: 1080, FrameRateNum: 25, FrameRateDen: 1}
+	if got := src.EncodedVideoFormat(); got != want {
+		t.Errorf("format = %v, want %v", got, want)
+	}
+
+	params := stream[at[0]:at[2]]
+	frames := [][]byte{stream[:at[3]], stream[at[3]:at[4]], append(append([]byte{}, params...), stream[at[4]:]...)}
+	for i, data := range frames {
+		frame, err := src.ReadEncodedVideo(context.Background())
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		// The last key frame gets the parameter sets it lacks
+		if !bytes.Equal(frame.Data, data) {
+			t.Errorf("frame %d = % x, want % x", i, frame.Data, data)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package media
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/jpeg" // register decoders for image.Decode
+	_ "image/png"
+	"os"
+)
+
+// StillImage is a VideoSource repeating one picture, e.g. an avatar card
+// for audio-only sessions.
+type StillImage struct {
+	format VideoFormat
+	frame  []byte
+	pos    int64
+}
+
+// OpenImageFile decodes a PNG or JPEG file once and fits it into the
+// format's frame size as configured, by default keeping its aspect ratio
+// with black bars. Frames are always I420.
+func OpenImageFile(path string, format VideoFormat, cfg ConvertConfig) (*StillImage, error) {
+	format.Pixel = PixelI420
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open image file %s: %v", path, err)
+	}
+	defer file.Close()
+
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image file %s: %v", path, err)
+	}
+	if img.Bounds().Empty() {
+		return nil, fmt.Errorf("image file %s is empty", path)
+	}
+
+	// Premultiplied RGBA, so transparent areas turn black
+	bounds := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, bounds.Min, draw.Src)
+
+	in := VideoFormat{Width: bounds.Dx(), Height: bounds.Dy(), Pixel: PixelRGBA}
+	conv, err := NewFrameConverter(in, format, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert image file %s: %v", path, err)
+	}
+	frame, err := conv.Convert(rgba.Pix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert image file %s: %v", path, err)
+	}
+	return &StillImage{format: format, frame: frame}, nil
+}
+
+func (s *StillImage) VideoFormat() VideoFormat { return s.format }
+
+func (s *StillImage) ReadVideo(ctx context.Context) (Frame, error) {
+	n := s.pos
+	s.pos++
+	return Frame{Data: s.frame, PTS: s.format.PTS(n)}, nil
+}
+
+func (s *StillImage) Skip(frames int64) error {
+	s.pos += frames
+	return nil
+}
+
+func (s *StillImage) Rewind() error {
+	s.pos = 0
+	return nil
+}
+
+func (s *StillImage) Close() error { return nil }
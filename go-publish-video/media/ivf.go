@@ -0,0 +1,189 @@
+package media
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+)
+
+const (
+	ivfSignature   = "DKIF"
+	ivfHeaderSize  = 32
+	ivfFrameHeader = 12
+	// Enough of an AV1 temporal unit to reach the first frame header
+	av1ProbeSize = 512
+)
+
+// AV1 OBU types
+const (
+	obuSequenceHeader = 1
+	obuFrameHeader    = 3
+	obuFrame          = 6
+)
+
+// openIVF indexes the frames of an IVF file. The header gives the codec,
+// the size and the time base; the frame rate is taken from the average
+// distance between frame timestamps, since many muxers write a millisecond
+// time base.
+func openIVF(file *os.File, mode PlayMode) (*encodedFile, error) {
+	header := make([]byte, ivfHeaderSize)
+	if _, err := file.ReadAt(header, 0); err != nil {
+		return nil, fmt.Errorf("failed to read IVF header: %v", err)
+	}
+
+	format := EncodedVideoFormat{
+		Width:  int(binary.LittleEndian.Uint16(header[12:])),
+		Height: int(binary.LittleEndian.Uint16(header[14:])),
+	}
+	switch fourcc := string(header[8:12]); fourcc {
+	case "VP80":
+		format.Codec = CodecVP8
+	case "AV01":
+		format.Codec = CodecAV1
+	default:
+		return nil, fmt.Errorf("unsupported IVF codec %q, only VP80 and AV01 are supported", fourcc)
+	}
+	if format.Width <= 0 || format.Height <= 0 {
+		return nil, fmt.Errorf("invalid IVF frame size %dx%d", format.Width, format.Height)
+	}
+	rate := int64(binary.LittleEndian.Uint32(header[16:]))  // time base denominator
+	scale := int64(binary.LittleEndian.Uint32(header[20:])) // time base numerator
+	headerSize := int64(binary.LittleEndian.Uint16(header[6:]))
+	if headerSize < ivfHeaderSize {
+		headerSize = ivfHeaderSize
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		units     []encodedUnit
+		firstPTS  int64
+		lastPTS   int64
+		av1       av1State
+		frameHead = make([]byte, ivfFrameHeader)
+		probe     = make([]byte, av1ProbeSize)
+	)
+	for offset := headerSize; offset+ivfFrameHeader <= info.Size(); {
+		if _, err := file.ReadAt(frameHead, offset); err != nil {
+			return nil, fmt.Errorf("failed to read IVF frame header: %v", err)
+		}
+		size := int64(binary.LittleEndian.Uint32(frameHead))
+		pts := int64(binary.LittleEndian.Uint64(frameHead[4:]))
+		offset += ivfFrameHeader
+		if offset+size > info.Size() {
+			// Truncated last frame
+			break
+		}
+
+		n, err := file.ReadAt(probe[:minInt64(size, av1ProbeSize)], offset)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read IVF frame: %v", err)
+		}
+
+		key := false
+		switch format.Codec {
+		case CodecVP8:
+			// The inverse key frame flag is the first bit of the frame tag
+			key = n > 0 && probe[0]&1 == 0
+		case CodecAV1:
+			key = av1.keyFrame(probe[:n])
+		}
+
+		if len(units) == 0 {
+			firstPTS = pts
+		}
+		lastPTS = pts
+		units = append(units, encodedUnit{offset: offset, size: int(size), key: key})
+		offset += size
+	}
+
+	num, den := rate, scale
+	if frames := int64(len(units)); frames > 1 && lastPTS > firstPTS {
+		num, den = rate*(frames-1), scale*(lastPTS-firstPTS)
+	}
+	if !plausibleFrameRate(num, den) {
+		return nil, fmt.Errorf("IVF file has no usable frame rate (time base %d/%d)", scale, rate)
+	}
+	num, den = reduceRatio(num, den)
+	format.FrameRateNum, format.FrameRateDen = int(num), int(den)
+
+	return newEncodedFile(file, format, units, mode)
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// av1State carries what later temporal units need from the sequence header.
+type av1State struct {
+	reducedStillPicture bool
+}
+
+// keyFrame reports whether a temporal unit starts with a key frame. It
+// walks the OBUs up to the first frame header, which is enough for the
+// streams real-time encoders produce.
+func (s *av1State) keyFrame(data []byte) bool {
+	for len(data) > 0 {
+		header := data[0]
+		typ := header >> 3 & 0xf
+		hasExtension := header&0x04 != 0
+		hasSize := header&0x02 != 0
+		data = data[1:]
+		if hasExtension {
+			if len(data) == 0 {
+				return false
+			}
+			data = data[1:]
+		}
+
+		size := len(data)
+		if hasSize {
+			value, n := readLEB128(data)
+			if n == 0 {
+				return false
+			}
+			data = data[n:]
+			if value < uint64(size) {
+				size = int(value)
+			}
+		}
+		payload := data[:size]
+		data = data[size:]
+
+		switch typ {
+		case obuSequenceHeader:
+			// seq_profile (3), still_picture (1), reduced_still_picture_header (1)
+			if len(payload) > 0 {
+				s.reducedStillPicture = payload[0]&0x08 != 0
+			}
+		case obuFrameHeader, obuFrame:
+			if s.reducedStillPicture {
+				return true
+			}
+			if len(payload) == 0 {
+				return false
+			}
+			// show_existing_frame (1), then frame_type (2) where 0 is KEY_FRAME
+			return payload[0]&0x80 == 0 && payload[0]>>5&0x3 == 0
+		}
+	}
+	return false
+}
+
+// readLEB128 decodes an AV1 leb128 value and returns it and its length, or
+// a length of 0 if data ends first.
+func readLEB128(data []byte) (uint64, int) {
+	var value uint64
+	for i := 0; i < 8 && i < len(data); i++ {
+		value |= uint64(data[i]&0x7f) << (7 * uint(i))
+		if data[i]&0x80 == 0 {
+			return value, i + 1
+		}
+	}
+	return 0, 0
+}
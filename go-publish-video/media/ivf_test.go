@@ -0,0 +1,125 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTestIVF writes frames with their timestamps as an IVF file with the
+// time base scale/rate. truncate cuts that many bytes off the end.
+func writeTestIVF(t *testing.T, fourcc string, rate, scale uint32, pts []uint64, frames [][]byte, truncate int) string {
+	t.Helper()
+	header := make([]byte, ivfHeaderSize)
+	copy(header, ivfSignature)
+	binary.LittleEndian.PutUint16(header[6:], ivfHeaderSize)
+	copy(header[8:], fourcc)
+	binary.LittleEndian.PutUint16(header[12:], 640)
+	binary.LittleEndian.PutUint16(header[14:], 360)
+	binary.LittleEndian.PutUint32(header[16:], rate)
+	binary.LittleEndian.PutUint32(header[20:], scale)
+	binary.LittleEndian.PutUint32(header[24:], uint32(len(frames)))
+
+	data := header
+	for i, frame := range frames {
+		frameHead := make([]byte, ivfFrameHeader)
+		binary.LittleEndian.PutUint32(frameHead, uint32(len(frame)))
+		binary.LittleEndian.PutUint64(frameHead[4:], pts[i])
+		data = append(data, frameHead...)
+		data = append(data, frame...)
+	}
+
+	path := filepath.Join(t.TempDir(), "test.ivf")
+	if err := os.WriteFile(path, data[:len(data)-truncate], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestOpenIVF(t *testing.T) {
+	// The first bit of a VP8 frame tag is set for inter frames
+	frames := [][]byte{{0x10, 0xaa, 0xbb}, {0x11, 0xcc}, {0x11, 0xdd, 0xee}, {0x10, 0xff}}
+	pts := []uint64{0, 40, 80, 120}
+	tests := []struct {
+		name     string
+		truncate int
+		frames   int
+	}{
+		{"complete", 0, 4},
+		// The last frame lacks a byte of its payload
+		{"truncated payload", 1, 3},
+		// The last frame header is cut short
+		{"truncated header", 2 + ivfFrameHeader/2, 3},
+	}
+	for _, tt := range tests {
+		// A millisecond time base, the rate comes from the timestamps
+		path := writeTestIVF(t, "VP80", 1000, 1, pts, frames, tt.truncate)
+		src, err := OpenEncodedVideoFile(path, 0, PlayOnce)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+
+		want := EncodedVideoFormat{Codec: CodecVP8, Width: 640, Height: 360, FrameRateNum: 25, FrameRateDen: 1}
+		if got := src.EncodedVideoFormat(); got != want {
+			t.Errorf("%s: format = %v, want %v", tt.name, got, want)
+		}
+		for i := 0; i < tt.frames; i++ {
+			frame, err := src.ReadEncodedVideo(context.Background())
+			if err != nil {
+				t.Errorf("%s: frame %d: %v", tt.name, i, err)
+				break
+			}
+			if key := i%3 == 0; !bytes.Equal(frame.Data, frames[i]) || frame.Key != key {
+				t.Errorf("%s: frame %d = % x key=%v, want % x key=%v", tt.name, i, frame.Data, frame.Key, frames[i], key)
+			}
+		}
+		if _, err := src.ReadEncodedVideo(context.Background()); err != io.EOF {
+			t.Errorf("%s: read after %d frames: %v, want EOF", tt.name, tt.frames, err)
+		}
+		src.Close()
+	}
+}
+
+func TestOpenIVFRejectsUnknownCodec(t *testing.T) {
+	path := writeTestIVF(t, "VP90", 30, 1, []uint64{0}, [][]byte{{0x10}}, 0)
+	if src, err := OpenEncodedVideoFile(path, 0, PlayOnce); err == nil {
+		src.Close()
+		t.Error("VP9 file opened")
+	}
+}
+
+func TestAV1KeyFrame(t *testing.T) {
+	// OBU headers with obu_has_size_field set
+	const (
+		temporalDelimiter = 2<<3 | 0x02
+		sequenceHeader    = 1<<3 | 0x02
+		frameHeader       = 3<<3 | 0x02
+		frame             = 6<<3 | 0x02
+	)
+	tests := []struct {
+		name string
+		tu   []byte
+		want bool
+	}{
+		{"key frame", []byte{temporalDelimiter, 0, sequenceHeader, 1, 0x00, frame, 2, 0x10, 0xaa}, true},
+		{"inter frame", []byte{temporalDelimiter, 0, frame, 2, 0x30, 0xaa}, false},
+		{"frame header", []byte{temporalDelimiter, 0, frameHeader, 1, 0x10}, true},
+		{"show existing frame", []byte{temporalDelimiter, 0, frameHeader, 1, 0x80}, false},
+		// An extension byte follows the header when obu_extension_flag is set
+		{"extension", []byte{frame | 0x04, 0x00, 2, 0x10, 0xaa}, true},
+		{"reduced still picture", []byte{sequenceHeader, 1, 0x08, frame, 1, 0x60}, true},
+		{"no frame", []byte{temporalDelimiter, 0}, false},
+		{"truncated size", []byte{frame, 0x80}, false},
+	}
+	for _, tt := range tests {
+		var s av1State
+		if got := s.keyFrame(tt.tu); got != tt.want {
+			t.Errorf("%s: keyFrame() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
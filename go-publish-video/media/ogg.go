@@ -0,0 +1,160 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	oggSignature  = "OggS"
+	oggPageHeader = 27
+	opusRate      = 48000
+)
+
+// openOggOpus reads the packets of the first logical stream of an Ogg file,
+// which must carry Opus. Packets span pages, so they are read into memory.
+func openOggOpus(file *os.File, mode PlayMode) (*encodedAudioFile, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	packets, err := readOggPackets(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(packets) == 0 || !bytes.HasPrefix(packets[0], []byte("OpusHead")) {
+		return nil, fmt.Errorf("Ogg stream is not Opus, only Opus is supported")
+	}
+	head := packets[0]
+	if len(head) < 19 {
+		return nil, fmt.Errorf("invalid OpusHead packet")
+	}
+	// version (1), channel count (1), pre-skip (2), input sample rate (4),
+	// output gain (2), channel mapping family (1)
+	channels := int(head[9])
+	if family := head[18]; family != 0 {
+		return nil, fmt.Errorf("unsupported Opus channel mapping family %d, only mono and stereo are supported", family)
+	}
+	if channels < 1 || channels > 2 {
+		return nil, fmt.Errorf("invalid Opus channel count %d", channels)
+	}
+
+	// The comment header follows the identification header
+	packets = packets[1:]
+	if len(packets) > 0 && bytes.HasPrefix(packets[0], []byte("OpusTags")) {
+		packets = packets[1:]
+	}
+
+	format := EncodedAudioFormat{Codec: CodecOpus, SampleRate: opusRate, Channels: channels}
+	audio := packets[:0]
+	for i, p := range packets {
+		if len(p) == 0 {
+			continue
+		}
+		samples, err := opusPacketSamples(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Opus packet %d: %v", i, err)
+		}
+		if format.SamplesPerFrame == 0 {
+			format.SamplesPerFrame = samples
+		} else if samples != format.SamplesPerFrame {
+			return nil, fmt.Errorf("Opus packet %d lasts %d samples instead of %d, packets of varying duration are not supported", i, samples, format.SamplesPerFrame)
+		}
+		audio = append(audio, p)
+	}
+	if len(audio) == 0 {
+		return nil, fmt.Errorf("no audio packets found")
+	}
+	return &encodedAudioFile{format: format, mode: mode, packets: audio}, nil
+}
+
+// readOggPackets assembles the packets of the first logical stream from the
+// lacing values of its pages. Other streams are skipped, as is a truncated
+// last packet.
+func readOggPackets(data []byte) ([][]byte, error) {
+	var (
+		packets [][]byte
+		packet  []byte
+		serial  uint32
+		first   = true
+	)
+	for len(data) > 0 {
+		if len(data) < oggPageHeader || string(data[:4]) != oggSignature {
+			if len(packets) > 0 {
+				// Trailing garbage or a truncated page
+				break
+			}
+			return nil, fmt.Errorf("invalid Ogg page")
+		}
+		segments := int(data[26])
+		if len(data) < oggPageHeader+segments {
+			break
+		}
+		lacing := data[oggPageHeader : oggPageHeader+segments]
+		size := 0
+		for _, l := range lacing {
+			size += int(l)
+		}
+		body := data[oggPageHeader+segments:]
+		if len(body) < size {
+			break
+		}
+		pageSerial := binary.LittleEndian.Uint32(data[14:])
+		data = body[size:]
+
+		if first {
+			serial, first = pageSerial, false
+		}
+		if pageSerial != serial {
+			continue
+		}
+		for _, l := range lacing {
+			packet = append(packet, body[:l]...)
+			body = body[l:]
+			// A lacing value below 255 ends the packet
+			if l < 255 {
+				packets = append(packets, packet)
+				packet = nil
+			}
+		}
+	}
+	return packets, nil
+}
+
+// opusPacketSamples returns the duration of an Opus packet at 48kHz from its
+// TOC byte (RFC 6716 section 3.1).
+func opusPacketSamples(p []byte) (int, error) {
+	config := int(p[0] >> 3)
+	var frame int
+	switch {
+	case config < 12: // SILK: 10, 20, 40, 60ms
+		frame = []int{480, 960, 1920, 2880}[config%4]
+	case config < 16: // hybrid: 10, 20ms
+		frame = []int{480, 960}[config%2]
+	default: // CELT: 2.5, 5, 10, 20ms
+		frame = []int{120, 240, 480, 960}[config%4]
+	}
+
+	frames := 1
+	switch p[0] & 3 {
+	case 1, 2:
+		frames = 2
+	case 3:
+		if len(p) < 2 {
+			return 0, fmt.Errorf("missing frame count")
+		}
+		frames = int(p[1] & 0x3f)
+	}
+	samples := frames * frame
+	// A packet is at most 120ms
+	if samples == 0 || samples > 5760 {
+		return 0, fmt.Errorf("invalid duration of %d samples", samples)
+	}
+	return samples, nil
+}
@@ -0,0 +1,203 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// oggPage builds a page of the logical stream serial. The checksum is not
+// filled in, the reader does not verify it.
+func oggPage(serial uint32, lacing []byte, body []byte) []byte {
+	page := make([]byte, oggPageHeader, oggPageHeader+len(lacing)+len(body))
+	copy(page, oggSignature)
+	binary.LittleEndian.PutUint32(page[14:], serial)
+	page[26] = byte(len(lacing))
+	page = append(page, lacing...)
+	return append(page, body...)
+}
+
+// oggPacketsPage builds a page holding whole packets.
+func oggPacketsPage(serial uint32, packets ...[]byte) []byte {
+	var lacing, body []byte
+	for _, p := range packets {
+		n := len(p)
+		for ; n >= 255; n -= 255 {
+			lacing = append(lacing, 255)
+		}
+		lacing = append(lacing, byte(n))
+		body = append(body, p...)
+	}
+	return oggPage(serial, lacing, body)
+}
+
+func filled(n int, b byte) []byte {
+	return bytes.Repeat([]byte{b}, n)
+}
+
+func TestReadOggPackets(t *testing.T) {
+	long := filled(300, 0xaa)
+	tests := []struct {
+		name  string
+		pages [][]byte
+		want  [][]byte
+	}{
+		{
+			name:  "packets in one page",
+			pages: [][]byte{oggPacketsPage(1, []byte{1}, []byte{2, 2})},
+			want:  [][]byte{{1}, {2, 2}},
+		},
+		{
+			// A 255 lacing value continues the packet on the next page
+			name: "lacing across pages",
+			pages: [][]byte{
+				oggPage(1, []byte{255}, long[:255]),
+				oggPage(1, []byte{45, 1}, append(append([]byte{}, long[255:]...), 3)),
+			},
+			want: [][]byte{long, {3}},
+		},
+		{
+			// A packet of a multiple of 255 bytes ends with a 0 lacing value
+			name:  "packet of 255 bytes",
+			pages: [][]byte{oggPacketsPage(1, long[:255], []byte{4})},
+			want:  [][]byte{long[:255], {4}},
+		},
+		{
+			name: "second logical stream",
+			pages: [][]byte{
+				oggPacketsPage(1, []byte{1}),
+				oggPacketsPage(2, []byte{9, 9}),
+				oggPacketsPage(1, []byte{2}),
+				oggPage(2, []byte{255}, filled(255, 9)),
+				oggPacketsPage(1, []byte{3}),
+			},
+			want: [][]byte{{1}, {2}, {3}},
+		},
+		{
+			name: "truncated last page",
+			pages: [][]byte{
+				oggPacketsPage(1, []byte{1}),
+				oggPacketsPage(1, []byte{2, 2, 2})[:oggPageHeader+1+2],
+			},
+			want: [][]byte{{1}},
+		},
+		{
+			// The packet never ends, so it is dropped
+			name: "truncated continued packet",
+			pages: [][]byte{
+				oggPacketsPage(1, []byte{1}),
+				oggPage(1, []byte{255}, long[:255]),
+			},
+			want: [][]byte{{1}},
+		},
+		{
+			name:  "trailing garbage",
+			pages: [][]byte{oggPacketsPage(1, []byte{1}), []byte("garbage")},
+			want:  [][]byte{{1}},
+		},
+	}
+	for _, tt := range tests {
+		packets, err := readOggPackets(bytes.Join(tt.pages, nil))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if len(packets) != len(tt.want) {
+			t.Errorf("%s: got %d packets, want %d", tt.name, len(packets), len(tt.want))
+			continue
+		}
+		for i := range packets {
+			if !bytes.Equal(packets[i], tt.want[i]) {
+				t.Errorf("%s: packet %d = % x, want % x", tt.name, i, packets[i], tt.want[i])
+			}
+		}
+	}
+
+	if _, err := readOggPackets([]byte("RIFF....WAVE")); err == nil {
+		t.Error("non-Ogg data was accepted")
+	}
+}
+
+func TestOpusPacketSamples(t *testing.T) {
+	toc := func(config, code byte) byte { return config<<3 | code }
+	tests := []struct {
+		name    string
+		packet  []byte
+		samples int // 0 for an error
+	}{
+		{"SILK 20ms", []byte{toc(1, 0), 0xaa}, 960},
+		{"SILK 60ms, two frames", []byte{toc(3, 1), 0xaa}, 5760},
+		{"hybrid 20ms, two frames", []byte{toc(13, 2), 0xaa}, 1920},
+		{"CELT 2.5ms", []byte{toc(16, 0)}, 120},
+		{"CELT 20ms, code 3 with 3 frames", []byte{toc(31, 3), 3}, 2880},
+		// The VBR and padding flags share the byte with the frame count
+		{"code 3 with flags", []byte{toc(16, 3), 0xc0 | 5, 0x01}, 600},
+		{"code 3 at 120ms", []byte{toc(31, 3), 6}, 5760},
+		{"code 3 over 120ms", []byte{toc(31, 3), 7}, 0},
+		{"code 3 without frames", []byte{toc(31, 3), 0}, 0},
+		{"code 3 without a count", []byte{toc(31, 3)}, 0},
+	}
+	for _, tt := range tests {
+		samples, err := opusPacketSamples(tt.packet)
+		switch {
+		case tt.samples == 0 && err == nil:
+			t.Errorf("%s: got %d samples, want an error", tt.name, samples)
+		case tt.samples != 0 && (err != nil || samples != tt.samples):
+			t.Errorf("%s: opusPacketSamples() = %d, %v, want %d", tt.name, samples, err, tt.samples)
+		}
+	}
+}
+
+// opusHead is an identification header for a stream with mapping family 0.
+func opusHead(channels byte) []byte {
+	head := append([]byte("OpusHead"), 1, channels)
+	head = append(head, 0x38, 0x01)             // pre-skip
+	head = append(head, 0x80, 0xbb, 0x00, 0x00) // input sample rate
+	return append(head, 0, 0, 0)                // output gain, mapping family
+}
+
+// toc20ms is the TOC byte of a single 20ms CELT frame.
+const toc20ms = 31 << 3
+
+func TestOpenOggOpus(t *testing.T) {
+	// 20ms CELT packets, one of them continued on the next page
+	audio := [][]byte{{toc20ms, 1}, append([]byte{toc20ms}, filled(299, 2)...), {toc20ms, 3}}
+	data := bytes.Join([][]byte{
+		oggPacketsPage(7, opusHead(2)),
+		oggPacketsPage(7, []byte("OpusTags\x00\x00\x00\x00\x00\x00\x00\x00")),
+		oggPacketsPage(7, audio[0]),
+		oggPage(7, []byte{255}, audio[1][:255]),
+		oggPage(7, []byte{45, 2}, append(append([]byte{}, audio[1][255:]...), audio[2]...)),
+	}, nil)
+	path := filepath.Join(t.TempDir(), "test.opus")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	src, err := OpenEncodedAudioFile(path, PlayOnce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	want := EncodedAudioFormat{Codec: CodecOpus, SampleRate: opusRate, Channels: 2, SamplesPerFrame: 960}
+	if got := src.EncodedAudioFormat(); got != want {
+		t.Errorf("format = %v, want %v", got, want)
+	}
+	for i, p := range audio {
+		frame, err := src.ReadEncodedAudio(context.Background())
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		if !bytes.Equal(frame.Data, p) {
+			t.Errorf("packet %d = % x, want % x", i, frame.Data, p)
+		}
+	}
+	if _, err := src.ReadEncodedAudio(context.Background()); err != io.EOF {
+		t.Errorf("read after the last packet: %v, want EOF", err)
+	}
+}
@@ -0,0 +1,226 @@
+package media
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// PlayMode controls what a file source does at the end of its media.
+type PlayMode int
+
+const (
+	// PlayLoop starts over from the first frame
+	PlayLoop PlayMode = iota
+	// PlayOnce returns io.EOF after the last frame
+	PlayOnce
+	// PlayPingPong plays the frames backwards, then forwards again, which
+	// hides the seam of idle video loops. Audio sources loop instead, since
+	// reversed 10ms chunks are not reversed audio.
+	PlayPingPong
+)
+
+func (m PlayMode) String() string {
+	switch m {
+	case PlayLoop:
+		return "loop"
+	case PlayOnce:
+		return "once"
+	case PlayPingPong:
+		return "pingpong"
+	}
+	return fmt.Sprintf("PlayMode(%d)", int(m))
+}
+
+// ParsePlayMode parses "loop", "once" or "pingpong".
+func ParsePlayMode(s string) (PlayMode, error) {
+	for _, m := range []PlayMode{PlayLoop, PlayOnce, PlayPingPong} {
+		if strings.EqualFold(s, m.String()) {
+			return m, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown play mode %q, expected loop, once or pingpong", s)
+}
+
+func (m PlayMode) forAudio() PlayMode {
+	if m == PlayPingPong {
+		return PlayLoop
+	}
+	return m
+}
+
+// Rewinder is implemented by sources that can start over from their first
+// frame.
+type Rewinder interface {
+	Rewind() error
+}
+
+// playlist steps through items that each end with io.EOF.
+type playlist struct {
+	items   int
+	mode    PlayMode
+	current int
+}
+
+// next moves to the item after the current one and reports whether there
+// is one.
+func (p *playlist) next(rewind func(i int) error) (bool, error) {
+	p.current++
+	if p.current < p.items {
+		return true, nil
+	}
+	if p.mode == PlayOnce {
+		p.current = p.items - 1
+		return false, nil
+	}
+	// Start the whole list over
+	for i := 0; i < p.items; i++ {
+		if err := rewind(i); err != nil {
+			return false, err
+		}
+	}
+	p.current = 0
+	return true, nil
+}
+
+func newPlaylist(items int, mode PlayMode) (*playlist, error) {
+	if items == 0 {
+		return nil, fmt.Errorf("empty playlist")
+	}
+	if mode == PlayPingPong {
+		return nil, fmt.Errorf("play mode %s is not supported for playlists", mode)
+	}
+	return &playlist{items: items, mode: mode}, nil
+}
+
+func rewind(src interface{}) error {
+	r, ok := src.(Rewinder)
+	if !ok {
+		return fmt.Errorf("%T cannot be rewound for looping", src)
+	}
+	return r.Rewind()
+}
+
+// AudioPlaylist plays audio sources one after another. Items must end with
+// io.EOF (open files with PlayOnce) and share one format.
+type AudioPlaylist struct {
+	items []AudioSource
+	list  *playlist
+	pos   int64
+}
+
+// NewAudioPlaylist creates a playlist that plays items once or, with
+// PlayLoop, over and over. The playlist owns the items and closes them.
+func NewAudioPlaylist(items []AudioSource, mode PlayMode) (*AudioPlaylist, error) {
+	list, err := newPlaylist(len(items), mode)
+	if err != nil {
+		return nil, err
+	}
+	for i, item := range items[1:] {
+		if item.AudioFormat() != items[0].AudioFormat() {
+			return nil, fmt.Errorf("playlist item %d is %s, expected %s", i+2, item.AudioFormat(), items[0].AudioFormat())
+		}
+	}
+	return &AudioPlaylist{items: items, list: list}, nil
+}
+
+func (p *AudioPlaylist) AudioFormat() AudioFormat { return p.items[0].AudioFormat() }
+
+// Current is the index of the item being played.
+func (p *AudioPlaylist) Current() int { return p.list.current }
+
+func (p *AudioPlaylist) ReadAudio(ctx context.Context) (Frame, error) {
+	for {
+		frame, err := p.items[p.list.current].ReadAudio(ctx)
+		if err == io.EOF {
+			more, err := p.list.next(func(i int) error { return rewind(p.items[i]) })
+			if err != nil {
+				return Frame{}, err
+			}
+			if !more {
+				return Frame{}, io.EOF
+			}
+			continue
+		}
+		if err != nil {
+			return Frame{}, err
+		}
+		// Frames are renumbered so time keeps running across items
+		frame.PTS = time.Duration(p.pos) * AudioFrameDuration
+		p.pos++
+		return frame, nil
+	}
+}
+
+func (p *AudioPlaylist) Close() error {
+	var firstErr error
+	for _, item := range p.items {
+		if err := item.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// VideoPlaylist plays video sources one after another. Items must end with
+// io.EOF (open files with PlayOnce) and share one frame size and rate.
+type VideoPlaylist struct {
+	items []VideoSource
+	list  *playlist
+	pos   int64
+}
+
+// NewVideoPlaylist creates a playlist that plays items once or, with
+// PlayLoop, over and over. The playlist owns the items and closes them.
+func NewVideoPlaylist(items []VideoSource, mode PlayMode) (*VideoPlaylist, error) {
+	list, err := newPlaylist(len(items), mode)
+	if err != nil {
+		return nil, err
+	}
+	for i, item := range items[1:] {
+		if item.VideoFormat() != items[0].VideoFormat() {
+			return nil, fmt.Errorf("playlist item %d is %s, expected %s", i+2, item.VideoFormat(), items[0].VideoFormat())
+		}
+	}
+	return &VideoPlaylist{items: items, list: list}, nil
+}
+
+func (p *VideoPlaylist) VideoFormat() VideoFormat { return p.items[0].VideoFormat() }
+
+// Current is the index of the item being played.
+func (p *VideoPlaylist) Current() int { return p.list.current }
+
+func (p *VideoPlaylist) ReadVideo(ctx context.Context) (Frame, error) {
+	for {
+		frame, err := p.items[p.list.current].ReadVideo(ctx)
+		if err == io.EOF {
+			more, err := p.list.next(func(i int) error { return rewind(p.items[i]) })
+			if err != nil {
+				return Frame{}, err
+			}
+			if !more {
+				return Frame{}, io.EOF
+			}
+			continue
+		}
+		if err != nil {
+			return Frame{}, err
+		}
+		// Frames are renumbered so time keeps running across items
+		frame.PTS = p.VideoFormat().PTS(p.pos)
+		p.pos++
+		return frame, nil
+	}
+}
+
+func (p *VideoPlaylist) Close() error {
+	var firstErr error
+	for _, item := range p.items {
+		if err := item.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,395 @@
+package media
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Kind identifies the stream a sample belongs to.
+type Kind int
+
+const (
+	KindAudio Kind = iota
+	KindVideo
+	numKinds
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindAudio:
+		return "audio"
+	case KindVideo:
+		return "video"
+	}
+	return fmt.Sprintf("Kind(%d)", int(k))
+}
+
+// Sample is one timestamped unit of media, e.g. a 10ms PCM chunk or a frame.
+type Sample struct {
+	Kind         Kind
+	PTS          time.Duration
+	Data         []byte
+	Pixel        PixelFormat         // raw video only
+	EncodedVideo *EncodedFrameInfo   // encoded video only, nil for raw frames
+	EncodedAudio *EncodedAudioFormat // encoded audio only, nil for PCM
+}
+
+// PlayoutConfig tunes a PlayoutBuffer.
+type PlayoutConfig struct {
+	// Delay is the latency added to the first sample to absorb jitter
+	Delay time.Duration
+	// MaxBuffered is how far ahead of its presentation time a sample may
+	// arrive; samples further ahead are dropped
+	MaxBuffered time.Duration
+	// MaxLate is how far past its presentation time a sample may arrive and
+	// still be played
+	MaxLate time.Duration
+	// ResyncThreshold re-anchors the timeline when a timestamp is this far
+	// outside the acceptable window, e.g. after the sender restarted its clock
+	ResyncThreshold time.Duration
+}
+
+// DefaultPlayoutConfig returns the settings used by the child process.
+func DefaultPlayoutConfig() PlayoutConfig {
+	return PlayoutConfig{
+		Delay:           100 * time.Millisecond,
+		MaxBuffered:     5 * time.Second,
+		MaxLate:         200 * time.Millisecond,
+		ResyncThreshold: 2 * time.Second,
+	}
+}
+
+// PlayoutBuffer accepts samples ahead of time and releases them at their
+// presentation time. All streams share one anchor so their relative timing
+// is preserved.
+type PlayoutBuffer struct {
+	cfg     PlayoutConfig
+	release func(Sample)
+	now     func() time.Time // time source, replaced in tests
+
+	mu      sync.Mutex
+	anchor  time.Time // wall time of PTS 0, zero until the first sample
+	streams [numKinds]playoutStream
+	resyncs int64
+
+	wake      chan struct{}
+	closed    chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type playoutStream struct {
+	queue    []Sample
+	played   bool
+	lastPTS  time.Duration
+	interval time.Duration
+	starved  bool
+
+	released      int64
+	underruns     int64
+	lateDrops     int64
+	overflowDrops int64
+}
+
+// PlayoutStats is a snapshot of the buffer.
+type PlayoutStats struct {
+	Resyncs int64
+	Streams map[Kind]PlayoutStreamStats
+}
+
+// PlayoutStreamStats describes one stream of the buffer.
+type PlayoutStreamStats struct {
+	Queued        int
+	Buffered      time.Duration // time until the last queued sample is due
+	Released      int64
+	Underruns     int64 // times the stream ran dry when its next sample was due
+	LateDrops     int64
+	OverflowDrops int64
+}
+
+// NewPlayoutBuffer starts a buffer that calls release for each sample at its
+// presentation time. release is called from the buffer's own goroutine.
+func NewPlayoutBuffer(cfg PlayoutConfig, release func(Sample)) *PlayoutBuffer {
+	b := &PlayoutBuffer{
+		cfg:     cfg,
+		release: release,
+		now:     time.Now,
+		wake:    make(chan struct{}, 1),
+		closed:  make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+// Push queues a sample. It returns false if the sample was dropped because it
+// arrived too late, too early, or after Close.
+func (b *PlayoutBuffer) Push(s Sample) bool {
+	if s.Kind < 0 || s.Kind >= numKinds {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	select {
+	case <-b.closed:
+		return false
+	default:
+	}
+
+	now := b.now()
+	if b.anchor.IsZero() {
+		b.anchor = now.Add(b.cfg.Delay - s.PTS)
+	}
+
+	due := b.anchor.Add(s.PTS)
+	if lag := now.Sub(due); lag > b.cfg.ResyncThreshold || -lag > b.cfg.MaxBuffered+b.cfg.ResyncThreshold {
+		b.resync(now, s.PTS)
+		due = b.anchor.Add(s.PTS)
+	}
+
+	st := &b.streams[s.Kind]
+	switch {
+	case now.Sub(due) > b.cfg.MaxLate:
+		st.lateDrops++
+		return false
+	case due.Sub(now) > b.cfg.MaxBuffered:
+		st.overflowDrops++
+		return false
+	}
+
+	// Samples normally arrive in order, so this is an append
+	i := sort.Search(len(st.queue), func(i int) bool { return st.queue[i].PTS > s.PTS })
+	st.queue = append(st.queue, Sample{})
+	copy(st.queue[i+1:], st.queue[i:])
+	st.queue[i] = s
+	st.starved = false
+
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// resync moves the anchor so pts plays after the configured delay and drops
+// everything queued against the old timeline.
+func (b *PlayoutBuffer) resync(now time.Time, pts time.Duration) {
+	b.anchor = now.Add(b.cfg.Delay - pts)
+	for i := range b.streams {
+		st := &b.streams[i]
+		st.queue = nil
+		st.played = false
+		st.starved = false
+	}
+	b.resyncs++
+}
+
+// Flush drops the queued samples of every stream without moving the
+// timeline, e.g. when the speech being played is interrupted. Audio due
+// within fade is kept and passed to fadeOut first, so it can be ramped down
+// instead of stopping with a click. It returns the number of dropped samples
+// of every stream.
+func (b *PlayoutBuffer) Flush(fade time.Duration, fadeOut func([]Sample)) map[Kind]int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	dropped := make(map[Kind]int, numKinds)
+	for k := Kind(0); k < numKinds; k++ {
+		st := &b.streams[k]
+		keep := 0
+		if k == KindAudio && fade > 0 {
+			for keep < len(st.queue) && b.anchor.Add(st.queue[keep].PTS).Sub(now) < fade {
+				keep++
+			}
+			if keep > 0 && fadeOut != nil {
+				fadeOut(st.queue[:keep])
+			}
+		}
+		dropped[k] = len(st.queue) - keep
+		for i := keep; i < len(st.queue); i++ {
+			st.queue[i] = Sample{}
+		}
+		st.queue = st.queue[:keep]
+		// The gap that follows is intended, not an underrun
+		st.starved = true
+	}
+	return dropped
+}
+
+// FadeOutPCM16 ramps the PCM16 audio of samples linearly down to silence,
+// in place. channels is the number of interleaved channels.
+func FadeOutPCM16(samples []Sample, channels int) {
+	if channels <= 0 {
+		return
+	}
+	total := 0
+	for _, s := range samples {
+		total += len(s.Data) / (2 * channels)
+	}
+	if total == 0 {
+		return
+	}
+	n := 0
+	for _, s := range samples {
+		for i := 0; i+2*channels <= len(s.Data); i += 2 * channels {
+			n++
+			gain := float64(total-n) / float64(total)
+			for c := i; c < i+2*channels; c += 2 {
+				v := int16(binary.LittleEndian.Uint16(s.Data[c:]))
+				binary.LittleEndian.PutUint16(s.Data[c:], uint16(int16(float64(v)*gain)))
+			}
+		}
+	}
+}
+
+// Resyncs returns how often the timeline has been re-anchored. Every resync
+// discards the samples queued until then.
+func (b *PlayoutBuffer) Resyncs() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.resyncs
+}
+
+// Stats returns the fill level and counters of every stream.
+func (b *PlayoutBuffer) Stats() PlayoutStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	stats := PlayoutStats{Resyncs: b.resyncs, Streams: make(map[Kind]PlayoutStreamStats, numKinds)}
+	for k := Kind(0); k < numKinds; k++ {
+		st := &b.streams[k]
+		s := PlayoutStreamStats{
+			Queued:        len(st.queue),
+			Released:      st.released,
+			Underruns:     st.underruns,
+			LateDrops:     st.lateDrops,
+			OverflowDrops: st.overflowDrops,
+		}
+		if n := len(st.queue); n > 0 {
+			if buffered := b.anchor.Add(st.queue[n-1].PTS).Sub(now); buffered > 0 {
+				s.Buffered = buffered
+			}
+		}
+		stats.Streams[k] = s
+	}
+	return stats
+}
+
+func (s PlayoutStats) String() string {
+	out := fmt.Sprintf("resyncs=%d", s.Resyncs)
+	for k := Kind(0); k < numKinds; k++ {
+		st := s.Streams[k]
+		out += fmt.Sprintf(" %s[queued=%d buffered=%v released=%d underruns=%d late=%d overflow=%d]",
+			k, st.Queued, st.Buffered.Round(time.Millisecond), st.Released, st.Underruns, st.LateDrops, st.OverflowDrops)
+	}
+	return out
+}
+
+// Close stops the buffer and discards samples that have not been released.
+// It returns once the release callback can no longer be called.
+func (b *PlayoutBuffer) Close() {
+	b.closeOnce.Do(func() {
+		b.mu.Lock()
+		close(b.closed)
+		b.mu.Unlock()
+	})
+	<-b.done
+}
+
+// Done is closed once the buffer has stopped.
+func (b *PlayoutBuffer) Done() <-chan struct{} {
+	return b.done
+}
+
+func (b *PlayoutBuffer) run() {
+	defer close(b.done)
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	var ready []Sample
+	for {
+		next := b.collect(b.now(), &ready)
+
+		for _, s := range ready {
+			select {
+			case <-b.closed:
+				return
+			default:
+			}
+			b.release(s)
+		}
+		ready = ready[:0]
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		if !next.IsZero() {
+			timer.Reset(next.Sub(b.now()))
+		}
+
+		select {
+		case <-b.closed:
+			return
+		case <-b.wake:
+		case <-timer.C:
+		}
+	}
+}
+
+// collect moves every sample that is due into ready, in presentation order,
+// counts underruns, and returns when it next needs to run.
+func (b *PlayoutBuffer) collect(now time.Time, ready *[]Sample) time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var next time.Time
+	wakeAt := func(t time.Time) {
+		if next.IsZero() || t.Before(next) {
+			next = t
+		}
+	}
+
+	for i := range b.streams {
+		st := &b.streams[i]
+		for len(st.queue) > 0 && !b.anchor.Add(st.queue[0].PTS).After(now) {
+			s := st.queue[0]
+			st.queue[0] = Sample{}
+			st.queue = st.queue[1:]
+			if st.played && s.PTS > st.lastPTS {
+				st.interval = s.PTS - st.lastPTS
+			}
+			st.played = true
+			st.lastPTS = s.PTS
+			st.released++
+			*ready = append(*ready, s)
+		}
+
+		switch {
+		case len(st.queue) > 0:
+			wakeAt(b.anchor.Add(st.queue[0].PTS))
+		case st.played && !st.starved && st.interval > 0:
+			// The stream is dry once its next sample is half a frame overdue
+			deadline := b.anchor.Add(st.lastPTS + st.interval + st.interval/2)
+			if now.Before(deadline) {
+				wakeAt(deadline)
+			} else {
+				st.starved = true
+				st.underruns++
+			}
+		}
+	}
+
+	sort.SliceStable(*ready, func(i, j int) bool { return (*ready)[i].PTS < (*ready)[j].PTS })
+	return next
+}
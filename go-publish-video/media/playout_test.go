@@ -0,0 +1,259 @@
+package media
+
+import (
+	"encoding/binary"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestPlayout returns a buffer on a fake clock without its release
+// goroutine; tests call collect themselves.
+func newTestPlayout() (*PlayoutBuffer, *fakeTime) {
+	ft := &fakeTime{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	b := &PlayoutBuffer{
+		cfg:    DefaultPlayoutConfig(),
+		now:    ft.Now,
+		wake:   make(chan struct{}, 1),
+		closed: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	return b, ft
+}
+
+func audioSample(pts time.Duration) Sample {
+	return Sample{Kind: KindAudio, PTS: pts, Data: make([]byte, 320)}
+}
+
+func ptsOf(samples []Sample) []time.Duration {
+	pts := make([]time.Duration, len(samples))
+	for i, s := range samples {
+		pts[i] = s.PTS
+	}
+	return pts
+}
+
+func TestPlayoutReleasesAtTimestamp(t *testing.T) {
+	b, ft := newTestPlayout()
+	start := ft.Now()
+	for _, s := range []Sample{
+		audioSample(0),
+		audioSample(10 * time.Millisecond),
+		{Kind: KindVideo, PTS: 5 * time.Millisecond},
+		audioSample(20 * time.Millisecond),
+	} {
+		if !b.Push(s) {
+			t.Fatalf("sample at %v dropped", s.PTS)
+		}
+	}
+
+	// The first sample plays after the configured delay
+	var ready []Sample
+	next := b.collect(start.Add(50*time.Millisecond), &ready)
+	if len(ready) != 0 {
+		t.Fatalf("released %v before the delay", ptsOf(ready))
+	}
+	if want := start.Add(100 * time.Millisecond); !next.Equal(want) {
+		t.Errorf("next wake-up %v, want %v", next.Sub(start), want.Sub(start))
+	}
+
+	// Streams are released together in presentation order
+	next = b.collect(start.Add(111*time.Millisecond), &ready)
+	want := []time.Duration{0, 5 * time.Millisecond, 10 * time.Millisecond}
+	if got := ptsOf(ready); len(got) != len(want) || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+		t.Errorf("released %v, want %v", got, want)
+	}
+	if want := start.Add(120 * time.Millisecond); !next.Equal(want) {
+		t.Errorf("next wake-up %v, want %v", next.Sub(start), want.Sub(start))
+	}
+	if stats := b.Stats(); stats.Streams[KindAudio].Released != 2 || stats.Streams[KindAudio].Queued != 1 {
+		t.Errorf("stats %s", stats)
+	}
+}
+
+func TestPlayoutDropsLateAndOverflowingSamples(t *testing.T) {
+	b, ft := newTestPlayout()
+	b.Push(audioSample(0)) // due at +100ms
+
+	// 300ms past its presentation time, beyond MaxLate but not far enough
+	// off to resync
+	ft.Advance(500 * time.Millisecond)
+	if b.Push(audioSample(100 * time.Millisecond)) {
+		t.Error("late sample accepted")
+	}
+	// Within MaxLate it still plays
+	if !b.Push(audioSample(350 * time.Millisecond)) {
+		t.Error("slightly late sample dropped")
+	}
+	// 6s ahead, beyond MaxBuffered but not far enough off to resync
+	if b.Push(audioSample(6500 * time.Millisecond)) {
+		t.Error("sample beyond MaxBuffered accepted")
+	}
+
+	stats := b.Stats()
+	if st := stats.Streams[KindAudio]; st.LateDrops != 1 || st.OverflowDrops != 1 || st.Queued != 2 {
+		t.Errorf("stats %s, want 1 late drop, 1 overflow drop, 2 queued", stats)
+	}
+	if stats.Resyncs != 0 {
+		t.Errorf("%d resyncs, want 0", stats.Resyncs)
+	}
+}
+
+// A timestamp far outside the window, e.g. after the sender restarted its
+// clock, re-anchors the timeline and drops what was queued against the old
+// one.
+func TestPlayoutResyncsAfterGap(t *testing.T) {
+	b, ft := newTestPlayout()
+	for i := 0; i < 5; i++ {
+		b.Push(audioSample(time.Duration(i) * 10 * time.Millisecond))
+	}
+
+	// The sender jumps 10s ahead
+	if !b.Push(audioSample(10 * time.Second)) {
+		t.Fatal("sample after the jump dropped")
+	}
+	if got := b.Resyncs(); got != 1 {
+		t.Fatalf("%d resyncs, want 1", got)
+	}
+	if st := b.Stats().Streams[KindAudio]; st.Queued != 1 {
+		t.Errorf("%d queued, want only the sample after the jump", st.Queued)
+	}
+	var ready []Sample
+	if next := b.collect(ft.Now(), &ready); !next.Equal(ft.Now().Add(b.cfg.Delay)) {
+		t.Errorf("sample after the jump due in %v, want %v", next.Sub(ft.Now()), b.cfg.Delay)
+	}
+
+	// Later the sender restarts from 0, 3s after the timeline expected it
+	ft.Advance(3 * time.Second)
+	if !b.Push(audioSample(0)) {
+		t.Fatal("sample after the restart dropped")
+	}
+	if got := b.Resyncs(); got != 2 {
+		t.Errorf("%d resyncs, want 2", got)
+	}
+}
+
+func TestPlayoutCountsUnderruns(t *testing.T) {
+	b, ft := newTestPlayout()
+	start := ft.Now()
+	b.Push(audioSample(0))
+	b.Push(audioSample(10 * time.Millisecond))
+
+	var ready []Sample
+	b.collect(start.Add(110*time.Millisecond), &ready)
+	// The next sample is expected at +120ms, dry once half a frame overdue
+	next := b.collect(start.Add(114*time.Millisecond), &ready)
+	if want := start.Add(125 * time.Millisecond); !next.Equal(want) {
+		t.Errorf("underrun check at %v, want %v", next.Sub(start), want.Sub(start))
+	}
+	b.collect(start.Add(126*time.Millisecond), &ready)
+	b.collect(start.Add(200*time.Millisecond), &ready)
+	if got := b.Stats().Streams[KindAudio].Underruns; got != 1 {
+		t.Errorf("%d underruns, want 1 for one gap", got)
+	}
+}
+
+func TestPlayoutFlushFadesOut(t *testing.T) {
+	b, ft := newTestPlayout()
+	start := ft.Now()
+	for i := 0; i < 10; i++ {
+		s := audioSample(time.Duration(i) * 10 * time.Millisecond)
+		for j := 0; j < len(s.Data); j += 2 {
+			binary.LittleEndian.PutUint16(s.Data[j:], uint16(10000))
+		}
+		b.Push(s)
+	}
+	b.Push(Sample{Kind: KindVideo, PTS: 0})
+	b.Push(Sample{Kind: KindVideo, PTS: 40 * time.Millisecond})
+
+	// Audio due within 30ms of now (+100, +110, +120ms) is kept and faded
+	ft.Advance(95 * time.Millisecond)
+	var faded []Sample
+	dropped := b.Flush(30*time.Millisecond, func(samples []Sample) {
+		faded = samples
+		FadeOutPCM16(samples, 1)
+	})
+	if dropped[KindAudio] != 7 || dropped[KindVideo] != 2 {
+		t.Errorf("dropped %v, want 7 audio and 2 video samples", dropped)
+	}
+	if len(faded) != 3 {
+		t.Fatalf("faded %d samples, want 3", len(faded))
+	}
+
+	// The kept audio ramps down to silence and is still released on time
+	var ready []Sample
+	b.collect(start.Add(125*time.Millisecond), &ready)
+	if got := ptsOf(ready); len(got) != 3 || got[2] != 20*time.Millisecond {
+		t.Fatalf("released %v after the flush, want the 3 faded samples", got)
+	}
+	prev := int16(10000)
+	for _, s := range ready {
+		for j := 0; j < len(s.Data); j += 2 {
+			v := int16(binary.LittleEndian.Uint16(s.Data[j:]))
+			if v > prev {
+				t.Fatalf("fade rises from %d to %d", prev, v)
+			}
+			prev = v
+		}
+	}
+	if prev != 0 {
+		t.Errorf("fade ends at %d, want silence", prev)
+	}
+
+	// The gap after the flush is intended, not an underrun
+	b.collect(start.Add(time.Second), &ready)
+	if got := b.Stats().Streams[KindAudio].Underruns; got != 0 {
+		t.Errorf("%d underruns after the flush, want 0", got)
+	}
+}
+
+func TestPlayoutFlushWithoutFade(t *testing.T) {
+	b, _ := newTestPlayout()
+	for i := 0; i < 3; i++ {
+		b.Push(audioSample(time.Duration(i) * 10 * time.Millisecond))
+	}
+	called := false
+	dropped := b.Flush(0, func([]Sample) { called = true })
+	if dropped[KindAudio] != 3 || called {
+		t.Errorf("dropped %v, fadeOut called %v, want all 3 dropped without a fade", dropped, called)
+	}
+}
+
+// The release goroutine plays samples on the wall clock and stops on Close.
+func TestPlayoutBufferRun(t *testing.T) {
+	var mu sync.Mutex
+	var released []time.Duration
+	got := make(chan struct{}, 10)
+	cfg := DefaultPlayoutConfig()
+	cfg.Delay = 20 * time.Millisecond
+	b := NewPlayoutBuffer(cfg, func(s Sample) {
+		mu.Lock()
+		released = append(released, s.PTS)
+		mu.Unlock()
+		got <- struct{}{}
+	})
+
+	start := time.Now()
+	b.Push(audioSample(0))
+	b.Push(audioSample(10 * time.Millisecond))
+	for i := 0; i < 2; i++ {
+		select {
+		case <-got:
+		case <-time.After(time.Second):
+			t.Fatal("samples not released")
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("released after %v, before the second sample was due", elapsed)
+	}
+
+	b.Close()
+	if b.Push(audioSample(20 * time.Millisecond)) {
+		t.Error("Push after Close accepted")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(released) != 2 || released[0] != 0 || released[1] != 10*time.Millisecond {
+		t.Errorf("released %v", released)
+	}
+}
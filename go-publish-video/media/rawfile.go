@@ -0,0 +1,198 @@
+package media
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// frameFile reads frames from a file by index, so they can be played in any
+// PlayMode.
+type frameFile struct {
+	file      *os.File
+	mode      PlayMode
+	offsets   []int64 // start of every frame, or nil for back-to-back frames
+	start     int64   // start of the first frame when offsets is nil
+	frameSize int64
+	frames    int64
+	lastSize  int64 // bytes of the last frame, less than frameSize if padded
+	ignored   int64 // bytes of a trailing partial frame that is not played
+	padByte   byte  // value a padded frame is completed with
+	buf       []byte
+	pos       int64 // frames returned or skipped so far, across loops
+}
+
+// openFrameFile reads back-to-back frames from length bytes at offset, or up
+// to the end of the file if length is negative. With padLast a trailing
+// partial frame is completed with zeros (silence for signed PCM), otherwise
+// it is ignored.
+func openFrameFile(path string, offset, length int64, frameSize int, padLast bool, mode PlayMode) (*frameFile, error) {
+	if frameSize <= 0 {
+		return nil, fmt.Errorf("invalid frame size %d", frameSize)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if length < 0 || offset+length > info.Size() {
+		length = info.Size() - offset
+	}
+
+	f := &frameFile{
+		file:      file,
+		mode:      mode,
+		start:     offset,
+		frameSize: int64(frameSize),
+		frames:    length / int64(frameSize),
+		lastSize:  int64(frameSize),
+		buf:       make([]byte, frameSize),
+	}
+	if rest := length % int64(frameSize); rest > 0 && padLast {
+		f.frames++
+		f.lastSize = rest
+	} else {
+		f.ignored = rest
+	}
+	if f.frames <= 0 {
+		file.Close()
+		return nil, fmt.Errorf("%s is smaller than one %d-byte frame", path, frameSize)
+	}
+	return f, nil
+}
+
+// index maps the playback position to a frame of the file.
+func (f *frameFile) index(pos int64) (int64, bool) {
+	switch f.mode {
+	case PlayOnce:
+		return pos, pos < f.frames
+	case PlayPingPong:
+		if f.frames == 1 {
+			return 0, true
+		}
+		// Forward through all frames, then back without repeating the ends
+		period := 2*f.frames - 2
+		i := pos % period
+		if i >= f.frames {
+			i = period - i
+		}
+		return i, true
+	}
+	return pos % f.frames, true
+}
+
+func (f *frameFile) read() ([]byte, int64, error) {
+	i, ok := f.index(f.pos)
+	if !ok {
+		return nil, 0, io.EOF
+	}
+
+	offset := f.start + i*f.frameSize
+	if f.offsets != nil {
+		offset = f.offsets[i]
+	}
+	size := f.frameSize
+	if i == f.frames-1 {
+		size = f.lastSize
+	}
+	if _, err := f.file.ReadAt(f.buf[:size], offset); err != nil {
+		return nil, 0, err
+	}
+	for j := size; j < f.frameSize; j++ {
+		f.buf[j] = f.padByte
+	}
+
+	n := f.pos
+	f.pos++
+	return f.buf, n, nil
+}
+
+func (f *frameFile) skip(n int64) error {
+	f.pos += n
+	return nil
+}
+
+func (f *frameFile) rewind() error {
+	f.pos = 0
+	return nil
+}
+
+// RawAudioFile is an AudioSource reading headerless PCM16 from a file.
+type RawAudioFile struct {
+	format AudioFormat
+	frames *frameFile
+}
+
+// OpenRawAudioFile opens headerless interleaved PCM16 audio. The format
+// cannot be detected and must be given. A partial last frame is padded with
+// silence.
+func OpenRawAudioFile(path string, format AudioFormat, mode PlayMode) (*RawAudioFile, error) {
+	frames, err := openFrameFile(path, 0, -1, format.FrameSize(), true, mode.forAudio())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audio file %s: %v", path, err)
+	}
+	return &RawAudioFile{format: format, frames: frames}, nil
+}
+
+func (r *RawAudioFile) AudioFormat() AudioFormat { return r.format }
+
+func (r *RawAudioFile) ReadAudio(ctx context.Context) (Frame, error) {
+	data, n, err := r.frames.read()
+	if err != nil {
+		return Frame{}, err
+	}
+	return Frame{Data: data, PTS: time.Duration(n) * AudioFrameDuration}, nil
+}
+
+func (r *RawAudioFile) Skip(frames int64) error { return r.frames.skip(frames) }
+
+func (r *RawAudioFile) Rewind() error { return r.frames.rewind() }
+
+func (r *RawAudioFile) Close() error { return r.frames.file.Close() }
+
+// RawVideoFile is a VideoSource reading headerless frames from a file.
+type RawVideoFile struct {
+	format VideoFormat
+	frames *frameFile
+}
+
+// OpenRawVideoFile opens headerless video in any PixelFormat, with rows
+// packed without padding. The format cannot be detected and must be given. A
+// partial last frame cannot be shown and is ignored, see IgnoredBytes. I420
+// and NV12 frames must have an even size.
+func OpenRawVideoFile(path string, format VideoFormat, mode PlayMode) (*RawVideoFile, error) {
+	if err := format.Pixel.CheckSize(format.Width, format.Height); err != nil {
+		return nil, fmt.Errorf("failed to open video file %s: %v", path, err)
+	}
+	frames, err := openFrameFile(path, 0, -1, format.FrameSize(), false, mode)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open video file %s: %v", path, err)
+	}
+	return &RawVideoFile{format: format, frames: frames}, nil
+}
+
+func (r *RawVideoFile) VideoFormat() VideoFormat { return r.format }
+
+// IgnoredBytes is the size of the trailing partial frame that is not played,
+// usually a sign of a wrong size or pixel format.
+func (r *RawVideoFile) IgnoredBytes() int64 { return r.frames.ignored }
+
+func (r *RawVideoFile) ReadVideo(ctx context.Context) (Frame, error) {
+	data, n, err := r.frames.read()
+	if err != nil {
+		return Frame{}, err
+	}
+	return Frame{Data: data, PTS: r.format.PTS(n)}, nil
+}
+
+func (r *RawVideoFile) Skip(frames int64) error { return r.frames.skip(frames) }
+
+func (r *RawVideoFile) Rewind() error { return r.frames.rewind() }
+
+func (r *RawVideoFile) Close() error { return r.frames.file.Close() }
@@ -0,0 +1,94 @@
+package media
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPixelFormatFrameSize(t *testing.T) {
+	tests := []struct {
+		pixel         PixelFormat
+		width, height int
+		want          int
+	}{
+		{PixelI420, 4, 2, 8 + 2*2},
+		{PixelNV12, 4, 2, 8 + 2*2},
+		{PixelI420, 1920, 1080, 1920*1080 + 2*960*540},
+		{PixelRGBA, 3, 3, 36},
+		{PixelBGRA, 2, 2, 16},
+	}
+	for _, tt := range tests {
+		if got := tt.pixel.FrameSize(tt.width, tt.height); got != tt.want {
+			t.Errorf("%s %dx%d: FrameSize() = %d, want %d", tt.pixel, tt.width, tt.height, got, tt.want)
+		}
+	}
+}
+
+func TestPixelFormatCheckSize(t *testing.T) {
+	tests := []struct {
+		pixel         PixelFormat
+		width, height int
+		ok            bool
+	}{
+		{PixelI420, 4, 2, true},
+		{PixelNV12, 1920, 1080, true},
+		// 4:2:0 chroma needs whole 2x2 blocks
+		{PixelI420, 3, 3, false},
+		{PixelI420, 4, 3, false},
+		{PixelNV12, 5, 2, false},
+		{PixelRGBA, 3, 3, true},
+		{PixelBGRA, 1, 1, true},
+		{PixelI420, 0, 2, false},
+		{PixelRGBA, 2, -1, false},
+	}
+	for _, tt := range tests {
+		if err := tt.pixel.CheckSize(tt.width, tt.height); (err == nil) != tt.ok {
+			t.Errorf("%s %dx%d: CheckSize() = %v, want ok=%v", tt.pixel, tt.width, tt.height, err, tt.ok)
+		}
+	}
+}
+
+func TestOpenRawVideoFileRejectsOddYUV(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "video.yuv")
+	if err := os.WriteFile(path, make([]byte, 1024), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, pixel := range []PixelFormat{PixelI420, PixelNV12} {
+		format := VideoFormat{Width: 5, Height: 4, FrameRateNum: 25, FrameRateDen: 1, Pixel: pixel}
+		if f, err := OpenRawVideoFile(path, format, PlayOnce); err == nil {
+			f.Close()
+			t.Errorf("%s 5x4 opened", pixel)
+		}
+	}
+	format := VideoFormat{Width: 5, Height: 3, FrameRateNum: 25, FrameRateDen: 1, Pixel: PixelRGBA}
+	f, err := OpenRawVideoFile(path, format, PlayOnce)
+	if err != nil {
+		t.Fatalf("RGBA 5x3: %v", err)
+	}
+	f.Close()
+}
+
+func TestRawVideoFileIgnoredBytes(t *testing.T) {
+	format := VideoFormat{Width: 4, Height: 2, FrameRateNum: 25, FrameRateDen: 1, Pixel: PixelI420}
+	for _, tt := range []struct {
+		size           int
+		frames, ignore int64
+	}{
+		{3 * 12, 3, 0},
+		{3*12 + 5, 3, 5},
+	} {
+		path := filepath.Join(t.TempDir(), "video.yuv")
+		if err := os.WriteFile(path, make([]byte, tt.size), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		f, err := OpenRawVideoFile(path, format, PlayOnce)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.frames.frames != tt.frames || f.IgnoredBytes() != tt.ignore {
+			t.Errorf("%d bytes: %d frames, %d ignored bytes, want %d and %d", tt.size, f.frames.frames, f.IgnoredBytes(), tt.frames, tt.ignore)
+		}
+		f.Close()
+	}
+}
@@ -0,0 +1,424 @@
+package media
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+)
+
+// ResampleQuality trades filter length, and so CPU and latency, for
+// stopband attenuation and passband width.
+type ResampleQuality int
+
+const (
+	ResampleLow    ResampleQuality = iota // 8 taps, ~35dB alias rejection
+	ResampleMedium                        // 32 taps, ~75dB
+	ResampleHigh                          // 64 taps, beyond the PCM16 noise floor
+)
+
+func (q ResampleQuality) String() string {
+	switch q {
+	case ResampleLow:
+		return "low"
+	case ResampleMedium:
+		return "medium"
+	case ResampleHigh:
+		return "high"
+	}
+	return fmt.Sprintf("ResampleQuality(%d)", int(q))
+}
+
+// ParseResampleQuality parses "low", "medium" or "high".
+func ParseResampleQuality(s string) (ResampleQuality, error) {
+	for _, q := range []ResampleQuality{ResampleLow, ResampleMedium, ResampleHigh} {
+		if strings.EqualFold(s, q.String()) {
+			return q, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown resample quality %q, expected low, medium or high", s)
+}
+
+// filterParams returns the taps per phase, the passband edge as a fraction
+// of the lower Nyquist frequency, and the Kaiser window beta.
+func (q ResampleQuality) filterParams() (taps int, rolloff, beta float64) {
+	switch q {
+	case ResampleLow:
+		return 8, 0.80, 4
+	case ResampleMedium:
+		return 32, 0.90, 7
+	}
+	return 64, 0.94, 9.5
+}
+
+// Resampler converts interleaved PCM16 between sample rates and channel
+// layouts. It uses a polyphase windowed-sinc filter and keeps its state
+// between calls, so audio can be fed in chunks of any size.
+type Resampler struct {
+	in, out AudioFormat
+
+	// Rational ratio out/in = up/down, reduced
+	up, down int
+	taps     int
+	phases   [][]float64 // phases[p] are the taps for output phase p/up
+
+	channels int         // channels that are filtered, min(in, out)
+	hist     [][]float64 // per channel input not yet fully consumed
+	pos      int         // index in hist of the next output's base sample
+	phase    int
+}
+
+// NewResampler creates a converter from in to out. Channels can be remixed
+// from and to mono; other layouts must match.
+func NewResampler(in, out AudioFormat, quality ResampleQuality) (*Resampler, error) {
+	if in.SampleRate <= 0 || out.SampleRate <= 0 {
+		return nil, fmt.Errorf("invalid sample rates %d -> %d", in.SampleRate, out.SampleRate)
+	}
+	if in.Channels != out.Channels && in.Channels != 1 && out.Channels != 1 {
+		return nil, fmt.Errorf("cannot remix %d channels to %d, only mono<->multichannel is supported", in.Channels, out.Channels)
+	}
+
+	g := gcd(in.SampleRate, out.SampleRate)
+	r := &Resampler{
+		in:       in,
+		out:      out,
+		up:       out.SampleRate / g,
+		down:     in.SampleRate / g,
+		channels: in.Channels,
+	}
+	if out.Channels < r.channels {
+		r.channels = out.Channels
+	}
+
+	taps, rolloff, beta := quality.filterParams()
+	if r.down > r.up {
+		// The taps are input samples, so when downsampling the filter grows
+		// with the ratio to cover as many output samples and to keep the
+		// transition band as narrow
+		taps = (taps*r.down/r.up + 1) &^ 1
+	}
+	r.taps = taps
+	r.phases = designPhases(r.up, r.down, taps, rolloff, beta)
+
+	// Start with half a filter of silence so the first output lines up with
+	// the first input sample
+	r.hist = make([][]float64, r.channels)
+	for c := range r.hist {
+		r.hist[c] = make([]float64, taps/2-1, 4096)
+	}
+	return r, nil
+}
+
+// designPhases builds the polyphase filter bank. Output phase p is the
+// input position p/up samples after a base sample, and its taps cover the
+// base sample - taps/2 + 1 to base + taps/2.
+func designPhases(up, down, taps int, rolloff, beta float64) [][]float64 {
+	// Cutoff relative to the input Nyquist frequency; downsampling must also
+	// remove everything above the output Nyquist frequency
+	cutoff := rolloff
+	if down > up {
+		cutoff = rolloff * float64(up) / float64(down)
+	}
+
+	half := float64(taps) / 2
+	i0beta := besselI0(beta)
+	phases := make([][]float64, up)
+	for p := range phases {
+		frac := float64(p) / float64(up)
+		coeffs := make([]float64, taps)
+		var sum float64
+		for i := range coeffs {
+			// Distance from the output position in input samples
+			d := float64(i-taps/2+1) - frac
+			x := d / half
+			w := 0.0
+			if x > -1 && x < 1 {
+				w = besselI0(beta*math.Sqrt(1-x*x)) / i0beta
+			}
+			coeffs[i] = cutoff * sinc(cutoff*d) * w
+			sum += coeffs[i]
+		}
+		// Unity gain at DC for every phase
+		for i := range coeffs {
+			coeffs[i] /= sum
+		}
+		phases[p] = coeffs
+	}
+	return phases
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	return math.Sin(math.Pi*x) / (math.Pi * x)
+}
+
+// besselI0 is the zeroth order modified Bessel function of the first kind.
+func besselI0(x float64) float64 {
+	sum, term := 1.0, 1.0
+	for k := 1; k < 50; k++ {
+		term *= (x / (2 * float64(k))) * (x / (2 * float64(k)))
+		sum += term
+		if term < sum*1e-12 {
+			break
+		}
+	}
+	return sum
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// Latency is the delay the filter adds, in output samples per channel.
+func (r *Resampler) Latency() int {
+	return r.taps / 2 * r.up / r.down
+}
+
+// Process converts interleaved PCM16 samples in the input format and
+// appends the result to out. Input samples that cannot be converted yet are
+// kept for the next call.
+func (r *Resampler) Process(in []int16, out []int16) []int16 {
+	frames := len(in) / r.in.Channels
+	for i := 0; i < frames; i++ {
+		frame := in[i*r.in.Channels : (i+1)*r.in.Channels]
+		if r.channels == r.in.Channels {
+			for c := range r.hist {
+				r.hist[c] = append(r.hist[c], float64(frame[c]))
+			}
+			continue
+		}
+		// Downmix to mono
+		var sum float64
+		for _, s := range frame {
+			sum += float64(s)
+		}
+		r.hist[0] = append(r.hist[0], sum/float64(len(frame)))
+	}
+
+	if r.up == r.down {
+		// Only remixing, nothing to filter
+		for i := r.pos; i < len(r.hist[0])-(r.taps/2-1); i++ {
+			out = r.appendFrame(out, i, nil)
+		}
+		r.pos = len(r.hist[0]) - (r.taps/2 - 1)
+	} else {
+		// An output needs the whole filter span of input
+		for r.pos+r.taps <= len(r.hist[0]) {
+			out = r.appendFrame(out, r.pos, r.phases[r.phase])
+			r.phase += r.down
+			r.pos += r.phase / r.up
+			r.phase %= r.up
+		}
+	}
+
+	// Drop input that no future output depends on
+	if r.pos > 0 {
+		for c := range r.hist {
+			n := copy(r.hist[c], r.hist[c][r.pos:])
+			r.hist[c] = r.hist[c][:n]
+		}
+		r.pos = 0
+	}
+	return out
+}
+
+// appendFrame filters one output frame starting at hist index start and
+// writes it with the output channel layout. A nil filter copies the sample
+// at the filter's centre.
+func (r *Resampler) appendFrame(out []int16, start int, coeffs []float64) []int16 {
+	var values [8]float64
+	vals := values[:0]
+	if r.channels > len(values) {
+		vals = make([]float64, 0, r.channels)
+	}
+	for c := 0; c < r.channels; c++ {
+		var v float64
+		if coeffs == nil {
+			v = r.hist[c][start+r.taps/2-1]
+		} else {
+			for i, h := range coeffs {
+				v += h * r.hist[c][start+i]
+			}
+		}
+		vals = append(vals, v)
+	}
+
+	for c := 0; c < r.out.Channels; c++ {
+		v := vals[0]
+		if r.channels > 1 {
+			v = vals[c]
+		}
+		out = append(out, clampPCM16(v))
+	}
+	return out
+}
+
+func clampPCM16(v float64) int16 {
+	v = math.Round(v)
+	switch {
+	case v > math.MaxInt16:
+		return math.MaxInt16
+	case v < math.MinInt16:
+		return math.MinInt16
+	}
+	return int16(v)
+}
+
+// Flush converts the input still held back for the filter, as if silence
+// followed it, and appends the result to out. The resampler then starts a
+// new stream.
+func (r *Resampler) Flush(out []int16) []int16 {
+	if r.up != r.down {
+		// Half a filter of silence lets the outputs up to the last input
+		// sample through
+		silence := make([]int16, r.taps/2*r.in.Channels)
+		out = r.Process(silence, out)
+	}
+	r.Reset()
+	return out
+}
+
+// Reset drops buffered input, e.g. after a seek in the source.
+func (r *Resampler) Reset() {
+	for c := range r.hist {
+		r.hist[c] = r.hist[c][:r.taps/2-1]
+		for i := range r.hist[c] {
+			r.hist[c][i] = 0
+		}
+	}
+	r.pos = 0
+	r.phase = 0
+}
+
+// AudioConverter is an AudioSource that resamples and remixes another
+// source to a fixed format in AudioFrameDuration frames, whatever the
+// length of the source frames. At the end of the source the filter is
+// flushed, the last frame is padded with silence.
+type AudioConverter struct {
+	src       AudioSource
+	format    AudioFormat
+	resampler *Resampler
+
+	in      []int16
+	pending []int16 // converted samples not yet returned
+	flushed bool    // the source ended and the resampler was flushed
+	frame   []byte
+	pos     int64
+}
+
+// ConvertAudio returns src itself if it already produces format, otherwise
+// a converter to it.
+func ConvertAudio(src AudioSource, format AudioFormat, quality ResampleQuality) (AudioSource, error) {
+	if !format.SplitsIntoFrames() {
+		return nil, fmt.Errorf("cannot convert to %v, the rate does not split into %v frames", format, AudioFrameDuration)
+	}
+	if src.AudioFormat() == format {
+		return src, nil
+	}
+	resampler, err := NewResampler(src.AudioFormat(), format, quality)
+	if err != nil {
+		return nil, err
+	}
+	return &AudioConverter{
+		src:       src,
+		format:    format,
+		resampler: resampler,
+		frame:     make([]byte, format.FrameSize()),
+	}, nil
+}
+
+func (a *AudioConverter) AudioFormat() AudioFormat { return a.format }
+
+func (a *AudioConverter) ReadAudio(ctx context.Context) (Frame, error) {
+	want := len(a.frame) / 2
+	for len(a.pending) < want && !a.flushed {
+		frame, err := a.src.ReadAudio(ctx)
+		if err == io.EOF {
+			// The filter still holds the last input samples
+			a.pending = a.resampler.Flush(a.pending)
+			a.flushed = true
+			break
+		}
+		if err != nil {
+			return Frame{}, err
+		}
+		a.in = bytesToPCM16(a.in[:0], frame.Data)
+		a.pending = a.resampler.Process(a.in, a.pending)
+	}
+	if len(a.pending) == 0 {
+		return Frame{}, io.EOF
+	}
+
+	for i := 0; i < want; i++ {
+		var s int16
+		if i < len(a.pending) {
+			s = a.pending[i]
+		}
+		binary.LittleEndian.PutUint16(a.frame[2*i:], uint16(s))
+	}
+	if len(a.pending) < want {
+		a.pending = a.pending[:0]
+	} else {
+		n := copy(a.pending, a.pending[want:])
+		a.pending = a.pending[:n]
+	}
+
+	pts := a.pos
+	a.pos++
+	return Frame{Data: a.frame, PTS: time.Duration(pts) * AudioFrameDuration}, nil
+}
+
+// Skip skips the underlying source when it can seek. Both sides count in
+// AudioFrameDuration frames, so the counts are the same.
+func (a *AudioConverter) Skip(frames int64) error {
+	if s, ok := a.src.(Skipper); ok {
+		if err := s.Skip(frames); err != nil {
+			return err
+		}
+		a.resampler.Reset()
+		a.pending = a.pending[:0]
+		a.flushed = false
+		a.pos += frames
+		return nil
+	}
+	for i := int64(0); i < frames; i++ {
+		if _, err := a.ReadAudio(context.Background()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rewind restarts the underlying source, which must implement Rewinder.
+func (a *AudioConverter) Rewind() error {
+	r, ok := a.src.(Rewinder)
+	if !ok {
+		return fmt.Errorf("audio source cannot be rewound")
+	}
+	if err := r.Rewind(); err != nil {
+		return err
+	}
+	a.resampler.Reset()
+	a.pending = a.pending[:0]
+	a.flushed = false
+	a.pos = 0
+	return nil
+}
+
+// Close closes the underlying source.
+func (a *AudioConverter) Close() error { return a.src.Close() }
+
+func bytesToPCM16(dst []int16, data []byte) []int16 {
+	for i := 0; i+1 < len(data); i += 2 {
+		dst = append(dst, int16(binary.LittleEndian.Uint16(data[i:])))
+	}
+	return dst
+}
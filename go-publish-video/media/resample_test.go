@@ -0,0 +1,221 @@
+package media
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"testing"
+	"time"
+)
+
+var resampleQualities = []ResampleQuality{ResampleLow, ResampleMedium, ResampleHigh}
+
+const toneAmplitude = 16000
+
+// resampleTone converts one second of a sine of freq Hz from inRate to
+// outRate mono and returns the output without the filter's warm-up and
+// tail.
+func resampleTone(t *testing.T, quality ResampleQuality, inRate, outRate int, freq float64) []int16 {
+	t.Helper()
+	r, err := NewResampler(AudioFormat{SampleRate: inRate, Channels: 1}, AudioFormat{SampleRate: outRate, Channels: 1}, quality)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := make([]int16, inRate)
+	for i := range in {
+		in[i] = int16(math.Round(toneAmplitude * math.Sin(2*math.Pi*freq*float64(i)/float64(inRate))))
+	}
+	out := r.Process(in, nil)
+	skip := 2 * r.Latency()
+	if len(out) < 4*skip {
+		t.Fatalf("only %d output samples", len(out))
+	}
+	return out[skip : len(out)-skip]
+}
+
+// attenuationDB is how much weaker out is than the input tone.
+func attenuationDB(out []int16) float64 {
+	var power float64
+	for _, s := range out {
+		power += float64(s) * float64(s)
+	}
+	power /= float64(len(out))
+	return 10 * math.Log10(toneAmplitude*toneAmplitude/2/power)
+}
+
+// toneSNR fits a sine of freq to out and returns its power relative to the
+// remainder, noise and aliases, in dB.
+func toneSNR(out []int16, freq float64, rate int) float64 {
+	var ss, cc, sc, sx, cx float64
+	for i, v := range out {
+		s, c := math.Sincos(2 * math.Pi * freq * float64(i) / float64(rate))
+		ss += s * s
+		cc += c * c
+		sc += s * c
+		sx += s * float64(v)
+		cx += c * float64(v)
+	}
+	det := ss*cc - sc*sc
+	a := (sx*cc - cx*sc) / det
+	b := (cx*ss - sx*sc) / det
+
+	var signal, noise float64
+	for i, v := range out {
+		s, c := math.Sincos(2 * math.Pi * freq * float64(i) / float64(rate))
+		fit := a*s + b*c
+		signal += fit * fit
+		noise += (float64(v) - fit) * (float64(v) - fit)
+	}
+	if noise == 0 {
+		return math.Inf(1)
+	}
+	return 10 * math.Log10(signal/noise)
+}
+
+// Tones above the output Nyquist frequency must not fold back into the
+// output.
+func TestResamplerRejectsAliases(t *testing.T) {
+	minAttenuation := map[ResampleQuality]float64{ResampleLow: 30, ResampleMedium: 70, ResampleHigh: 85}
+	rates := [][2]int{{48000, 16000}, {44100, 16000}, {22050, 16000}, {48000, 8000}, {32000, 24000}}
+	for _, quality := range resampleQualities {
+		for _, rate := range rates {
+			nyquist := float64(rate[1]) / 2
+			for _, f := range []float64{1.1, 1.25, 1.5, 2, 3} {
+				freq := f * nyquist
+				if freq >= float64(rate[0])/2 {
+					continue
+				}
+				t.Run(fmt.Sprintf("%s/%d-%d/%.0fHz", quality, rate[0], rate[1], freq), func(t *testing.T) {
+					out := resampleTone(t, quality, rate[0], rate[1], freq)
+					if att := attenuationDB(out); att < minAttenuation[quality] {
+						t.Errorf("attenuated by %.1fdB, want at least %.0fdB", att, minAttenuation[quality])
+					}
+				})
+			}
+		}
+	}
+}
+
+// Tones in the passband, up to close to the lower Nyquist frequency, come
+// out at the same frequency without noticeable aliases or images.
+func TestResamplerPassband(t *testing.T) {
+	minSNR := map[ResampleQuality]float64{ResampleLow: 35, ResampleMedium: 70, ResampleHigh: 85}
+	rates := [][2]int{{48000, 16000}, {44100, 16000}, {22050, 16000}, {16000, 48000}, {16000, 44100}, {8000, 24000}}
+	for _, quality := range resampleQualities {
+		for _, rate := range rates {
+			nyquist := float64(min(rate[0], rate[1])) / 2
+			for _, f := range []float64{0.1, 0.5, 0.75} {
+				freq := f * nyquist
+				t.Run(fmt.Sprintf("%s/%d-%d/%.0fHz", quality, rate[0], rate[1], freq), func(t *testing.T) {
+					out := resampleTone(t, quality, rate[0], rate[1], freq)
+					if snr := toneSNR(out, freq, rate[1]); snr < minSNR[quality] {
+						t.Errorf("SNR %.1fdB, want at least %.0fdB", snr, minSNR[quality])
+					}
+					// Well inside the passband the gain is unity
+					if att := attenuationDB(out); f <= 0.5 && math.Abs(att) > 0.5 {
+						t.Errorf("gain %.2fdB, want 0dB", -att)
+					}
+				})
+			}
+		}
+	}
+}
+
+// pcmSource plays interleaved PCM16 samples once.
+type pcmSource struct {
+	format  AudioFormat
+	samples []int16
+	pos     int
+	frame   []byte
+}
+
+func (s *pcmSource) AudioFormat() AudioFormat { return s.format }
+
+func (s *pcmSource) ReadAudio(ctx context.Context) (Frame, error) {
+	n := s.format.FrameSize() / 2
+	if s.pos+n > len(s.samples) {
+		return Frame{}, io.EOF
+	}
+	s.frame = s.frame[:0]
+	for _, v := range s.samples[s.pos : s.pos+n] {
+		s.frame = binary.LittleEndian.AppendUint16(s.frame, uint16(v))
+	}
+	pts := AudioFrameDuration * time.Duration(s.pos/n)
+	s.pos += n
+	return Frame{Data: s.frame, PTS: pts}, nil
+}
+
+func (s *pcmSource) Close() error { return nil }
+
+// The samples the filter holds back at the end of the source are flushed,
+// so as much audio comes out as went in.
+func TestAudioConverterFlushesTail(t *testing.T) {
+	const value = 10000
+	for _, rate := range []int{48000, 44100, 22050, 8000} {
+		for _, quality := range resampleQualities {
+			t.Run(fmt.Sprintf("%s/%d", quality, rate), func(t *testing.T) {
+				const frames = 10
+				in := AudioFormat{SampleRate: rate, Channels: 1}
+				samples := make([]int16, frames*in.FrameSize()/2)
+				for i := range samples {
+					samples[i] = value
+				}
+				out := AudioFormat{SampleRate: 16000, Channels: 1}
+				source, err := ConvertAudio(&pcmSource{format: in, samples: samples}, out, quality)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				var converted []int16
+				for i := 0; ; i++ {
+					frame, err := source.ReadAudio(context.Background())
+					if err == io.EOF {
+						break
+					}
+					if err != nil {
+						t.Fatal(err)
+					}
+					if frame.PTS != time.Duration(i)*AudioFrameDuration {
+						t.Errorf("frame %d has PTS %v", i, frame.PTS)
+					}
+					converted = bytesToPCM16(converted, frame.Data)
+				}
+				if got := len(converted) / (out.FrameSize() / 2); got != frames {
+					t.Fatalf("got %d frames, want %d", got, frames)
+				}
+
+				// The input ends within the last frame. Up to there the
+				// signal is kept, only the filter rings at the end
+				end := len(samples) * out.SampleRate / rate
+				var sum float64
+				for _, v := range converted[:end] {
+					sum += float64(v)
+				}
+				if mean := sum / float64(end); math.Abs(mean-value) > value/100 {
+					t.Errorf("mean of the converted samples is %.0f, want %d", mean, value)
+				}
+				if last := converted[end-1]; last < value/4 {
+					t.Errorf("last sample is %d, the tail was dropped", last)
+				}
+				if _, err := source.ReadAudio(context.Background()); err != io.EOF {
+					t.Errorf("read after the end returned %v, want io.EOF", err)
+				}
+			})
+		}
+	}
+}
+
+// Flushing without resampling has nothing to add.
+func TestResamplerFlushRemixOnly(t *testing.T) {
+	r, err := NewResampler(AudioFormat{SampleRate: 16000, Channels: 2}, AudioFormat{SampleRate: 16000, Channels: 1}, ResampleHigh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := r.Process([]int16{100, 300, 1000, 2000}, nil)
+	out = r.Flush(out)
+	if len(out) != 2 || out[0] != 200 || out[1] != 1500 {
+		t.Errorf("got %v, want [200 1500]", out)
+	}
+}
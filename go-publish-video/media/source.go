@@ -0,0 +1,219 @@
+package media
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// AudioFrameDuration is the amount of audio in every frame an AudioSource
+// returns, matching the 10ms chunks the SDK expects.
+const AudioFrameDuration = 10 * time.Millisecond
+
+// AudioFormat describes interleaved PCM16 audio.
+type AudioFormat struct {
+	SampleRate int
+	Channels   int
+}
+
+// FrameSize is the size in bytes of one AudioFrameDuration frame.
+func (f AudioFormat) FrameSize() int {
+	return f.SampleRate / int(time.Second/AudioFrameDuration) * f.Channels * 2
+}
+
+// SplitsIntoFrames reports whether an AudioFrameDuration frame holds a
+// whole number of samples, which publishing PCM16 needs.
+func (f AudioFormat) SplitsIntoFrames() bool {
+	return f.SampleRate > 0 && f.chunkFrames() == 1
+}
+
+// chunkFrames is the number of AudioFrameDuration frames in the shortest
+// span holding a whole number of samples, e.g. 2 (441 samples) at 22050Hz.
+func (f AudioFormat) chunkFrames() int {
+	perSecond := int(time.Second / AudioFrameDuration)
+	return perSecond / gcd(f.SampleRate, perSecond)
+}
+
+// Framed returns f if it splits into AudioFrameDuration frames, otherwise f
+// at the lowest multiple of its rate that does, e.g. 44100Hz for 22050Hz,
+// capped at 48000Hz.
+func (f AudioFormat) Framed() AudioFormat {
+	if f.SampleRate <= 0 {
+		return f
+	}
+	for rate := f.SampleRate; rate <= 48000; rate += f.SampleRate {
+		if (AudioFormat{SampleRate: rate}).SplitsIntoFrames() {
+			f.SampleRate = rate
+			return f
+		}
+	}
+	f.SampleRate = 48000
+	return f
+}
+
+func (f AudioFormat) String() string {
+	return fmt.Sprintf("PCM16 %dHz %dch", f.SampleRate, f.Channels)
+}
+
+// PixelFormat is the memory layout of raw video frames.
+type PixelFormat int
+
+const (
+	// PixelI420 is planar YUV 4:2:0: Y, then U, then V
+	PixelI420 PixelFormat = iota
+	// PixelNV12 is a Y plane followed by interleaved UV at quarter size
+	PixelNV12
+	// PixelRGBA and PixelBGRA are packed 4 bytes per pixel
+	PixelRGBA
+	PixelBGRA
+)
+
+func (p PixelFormat) String() string {
+	switch p {
+	case PixelI420:
+		return "I420"
+	case PixelNV12:
+		return "NV12"
+	case PixelRGBA:
+		return "RGBA"
+	case PixelBGRA:
+		return "BGRA"
+	}
+	return fmt.Sprintf("PixelFormat(%d)", int(p))
+}
+
+// ParsePixelFormat parses "I420", "NV12", "RGBA" or "BGRA".
+func ParsePixelFormat(s string) (PixelFormat, error) {
+	for _, p := range []PixelFormat{PixelI420, PixelNV12, PixelRGBA, PixelBGRA} {
+		if strings.EqualFold(s, p.String()) {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown pixel format %q, expected I420, NV12, RGBA or BGRA", s)
+}
+
+// FrameSize is the size in bytes of one tightly packed width x height frame,
+// for a size that passes CheckSize.
+func (p PixelFormat) FrameSize(width, height int) int {
+	ySize := width * height
+	switch p {
+	case PixelRGBA, PixelBGRA:
+		return 4 * ySize
+	}
+	// Both 4:2:0 layouts carry two quarter-size chroma planes
+	return ySize + ySize/2
+}
+
+// CheckSize rejects frame sizes the format cannot describe. 4:2:0 chroma
+// covers 2x2 pixel blocks, and frames are passed on with the width as stride
+// and no chroma padding, so I420 and NV12 need an even width and height.
+func (p PixelFormat) CheckSize(width, height int) error {
+	switch {
+	case width <= 0 || height <= 0:
+		return fmt.Errorf("invalid %s frame size %dx%d", p, width, height)
+	case (p == PixelI420 || p == PixelNV12) && (width%2 != 0 || height%2 != 0):
+		return fmt.Errorf("invalid %s frame size %dx%d, it must be even", p, width, height)
+	}
+	return nil
+}
+
+// VideoFormat describes raw video at a rational frame rate. The zero
+// PixelFormat is I420.
+type VideoFormat struct {
+	Width        int
+	Height       int
+	FrameRateNum int
+	FrameRateDen int
+	Pixel        PixelFormat
+}
+
+// FrameSize is the size in bytes of one frame.
+func (f VideoFormat) FrameSize() int {
+	return f.Pixel.FrameSize(f.Width, f.Height)
+}
+
+// FrameDuration is the presentation time of one frame.
+func (f VideoFormat) FrameDuration() time.Duration {
+	return f.PTS(1)
+}
+
+// PTS is the presentation time of frame n, without accumulating rounding
+// errors for rates like 30000/1001.
+func (f VideoFormat) PTS(n int64) time.Duration {
+	return time.Duration(n * int64(time.Second) * int64(f.FrameRateDen) / int64(f.FrameRateNum))
+}
+
+func (f VideoFormat) String() string {
+	if f.FrameRateDen == 1 {
+		return fmt.Sprintf("%s %dx%d@%dfps", f.Pixel, f.Width, f.Height, f.FrameRateNum)
+	}
+	return fmt.Sprintf("%s %dx%d@%d/%dfps", f.Pixel, f.Width, f.Height, f.FrameRateNum, f.FrameRateDen)
+}
+
+// Frame is one frame read from a source. PTS is its position on the
+// source's own timeline, starting at 0.
+type Frame struct {
+	Data []byte
+	PTS  time.Duration
+}
+
+// AudioSource produces PCM16 audio in AudioFrameDuration frames. Sources
+// whose rate does not split into them (see AudioFormat.SplitsIntoFrames)
+// produce frames of a few AudioFrameDuration instead and are published
+// through ConvertAudio.
+type AudioSource interface {
+	AudioFormat() AudioFormat
+	// ReadAudio returns the next frame. The data is only valid until the
+	// next call. io.EOF means the source is exhausted.
+	ReadAudio(ctx context.Context) (Frame, error)
+	Close() error
+}
+
+// VideoSource produces frames in the pixel format of its VideoFormat.
+type VideoSource interface {
+	VideoFormat() VideoFormat
+	// ReadVideo returns the next frame. The data is only valid until the
+	// next call. io.EOF means the source is exhausted.
+	ReadVideo(ctx context.Context) (Frame, error)
+	Close() error
+}
+
+// Skipper is implemented by sources that can drop frames without reading
+// them, e.g. by seeking.
+type Skipper interface {
+	Skip(frames int64) error
+}
+
+// Clearer is implemented by live sources that queue media ahead of
+// playback, e.g. VoiceBuffer. Clear drops the queued media and returns how
+// much was dropped.
+type Clearer interface {
+	Clear() time.Duration
+}
+
+// SkipAudio drops n frames from src, seeking when the source supports it.
+func SkipAudio(ctx context.Context, src AudioSource, n int64) error {
+	if s, ok := src.(Skipper); ok {
+		return s.Skip(n)
+	}
+	for i := int64(0); i < n; i++ {
+		if _, err := src.ReadAudio(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SkipVideo drops n frames from src, seeking when the source supports it.
+func SkipVideo(ctx context.Context, src VideoSource, n int64) error {
+	if s, ok := src.(Skipper); ok {
+		return s.Skip(n)
+	}
+	for i := int64(0); i < n; i++ {
+		if _, err := src.ReadVideo(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,298 @@
+package media
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+)
+
+// TestPatternConfig controls the synchronized flash and beep of the test
+// pattern sources. The flash and the beep both start at every multiple of
+// Period on the media timeline, so the offset between them on the receiving
+// side is the A/V offset.
+type TestPatternConfig struct {
+	Period        time.Duration
+	FlashDuration time.Duration
+	ToneHz        float64 // continuous background tone
+	BeepHz        float64
+}
+
+// DefaultTestPatternConfig flashes and beeps for 100ms every second over a
+// quiet 440Hz tone.
+func DefaultTestPatternConfig() TestPatternConfig {
+	return TestPatternConfig{
+		Period:        time.Second,
+		FlashDuration: 100 * time.Millisecond,
+		ToneHz:        440,
+		BeepHz:        1000,
+	}
+}
+
+func (c TestPatternConfig) flashing(pts time.Duration) bool {
+	return pts%c.Period < c.FlashDuration
+}
+
+// yuv is a limited range color.
+type yuv struct{ y, u, v byte }
+
+var (
+	// 75% SMPTE bars
+	barWhite   = BT601.yuv(0.75, 0.75, 0.75)
+	barYellow  = BT601.yuv(0.75, 0.75, 0)
+	barCyan    = BT601.yuv(0, 0.75, 0.75)
+	barGreen   = BT601.yuv(0, 0.75, 0)
+	barMagenta = BT601.yuv(0.75, 0, 0.75)
+	barRed     = BT601.yuv(0.75, 0, 0)
+	barBlue    = BT601.yuv(0, 0, 0.75)
+	barBlack   = BT601.yuv(0, 0, 0)
+	fullWhite  = BT601.yuv(1, 1, 1)
+	minusI     = BT601.yuv(0, 0.2456, 0.4125)
+	plusQ      = BT601.yuv(0.2536, 0, 0.4703)
+	superBlack = yuv{7, 128, 128}
+	darkGray   = yuv{25, 128, 128}
+)
+
+// digitFont is a 5x7 bitmap font for the digits and ':'.
+var digitFont = map[byte][7]byte{
+	'0': {0x0E, 0x11, 0x13, 0x15, 0x19, 0x11, 0x0E},
+	'1': {0x04, 0x0C, 0x04, 0x04, 0x04, 0x04, 0x0E},
+	'2': {0x0E, 0x11, 0x01, 0x02, 0x04, 0x08, 0x1F},
+	'3': {0x1F, 0x02, 0x04, 0x02, 0x01, 0x11, 0x0E},
+	'4': {0x02, 0x06, 0x0A, 0x12, 0x1F, 0x02, 0x02},
+	'5': {0x1F, 0x10, 0x1E, 0x01, 0x01, 0x11, 0x0E},
+	'6': {0x06, 0x08, 0x10, 0x1E, 0x11, 0x11, 0x0E},
+	'7': {0x1F, 0x01, 0x02, 0x04, 0x08, 0x08, 0x08},
+	'8': {0x0E, 0x11, 0x11, 0x0E, 0x11, 0x11, 0x0E},
+	'9': {0x0E, 0x11, 0x11, 0x0F, 0x01, 0x02, 0x0C},
+	':': {0x00, 0x0C, 0x0C, 0x00, 0x0C, 0x0C, 0x00},
+	' ': {},
+}
+
+// TestPatternVideo is a VideoSource drawing SMPTE color bars with a
+// burned-in frame counter and timecode, and a white box that flashes in
+// sync with the beep of TestToneAudio.
+type TestPatternVideo struct {
+	format VideoFormat
+	cfg    TestPatternConfig
+	bars   []byte // pre-rendered background
+	frame  []byte
+	pos    int64
+}
+
+// NewTestPatternVideo creates a pattern in the given size and frame rate.
+// Frames are always I420.
+func NewTestPatternVideo(format VideoFormat, cfg TestPatternConfig) *TestPatternVideo {
+	format.Pixel = PixelI420
+	t := &TestPatternVideo{
+		format: format,
+		cfg:    cfg,
+		bars:   make([]byte, format.FrameSize()),
+		frame:  make([]byte, format.FrameSize()),
+	}
+	t.drawBars()
+	return t
+}
+
+func (t *TestPatternVideo) VideoFormat() VideoFormat { return t.format }
+
+func (t *TestPatternVideo) ReadVideo(ctx context.Context) (Frame, error) {
+	n := t.pos
+	t.pos++
+	pts := t.format.PTS(n)
+
+	copy(t.frame, t.bars)
+	w, h := t.format.Width, t.format.Height
+	if t.cfg.flashing(pts) {
+		fillRect(t.frame, w, h, w/3, h/6, w/3, h/3, fullWhite)
+	}
+
+	// Frame counter and HH:MM:SS:FF timecode
+	fps := int64((t.format.FrameRateNum + t.format.FrameRateDen/2) / t.format.FrameRateDen)
+	if fps < 1 {
+		fps = 1
+	}
+	secs := int64(pts / time.Second)
+	text := fmt.Sprintf("%07d %02d:%02d:%02d:%02d", n, secs/3600, secs/60%60, secs%60, n%fps)
+	scale := h / 100
+	if scale < 1 {
+		scale = 1
+	}
+	textW := len(text) * 6 * scale
+	x := (w - textW) / 2
+	if x < 0 {
+		x = 0
+	}
+	t.drawText(text, x, h*2/3-9*scale, scale)
+
+	return Frame{Data: t.frame, PTS: pts}, nil
+}
+
+func (t *TestPatternVideo) Skip(frames int64) error {
+	t.pos += frames
+	return nil
+}
+
+func (t *TestPatternVideo) Rewind() error {
+	t.pos = 0
+	return nil
+}
+
+func (t *TestPatternVideo) Close() error { return nil }
+
+// drawBars renders the SMPTE pattern: seven 75% bars, a strip of reverse
+// bars, and the -I/white/+Q/black/PLUGE bottom row.
+func (t *TestPatternVideo) drawBars() {
+	w, h := t.format.Width, t.format.Height
+	top := h * 2 / 3
+	mid := h * 3 / 4
+
+	bars := []yuv{barWhite, barYellow, barCyan, barGreen, barMagenta, barRed, barBlue}
+	for i, c := range bars {
+		fillRect(t.bars, w, h, w*i/7, 0, w*(i+1)/7-w*i/7, top, c)
+	}
+	reverse := []yuv{barBlue, barBlack, barMagenta, barBlack, barCyan, barBlack, barWhite}
+	for i, c := range reverse {
+		fillRect(t.bars, w, h, w*i/7, top, w*(i+1)/7-w*i/7, mid-top, c)
+	}
+
+	// Bottom row, roughly following the SMPTE layout
+	bottom := []struct {
+		c     yuv
+		width int // in 1/28ths of the frame width
+	}{
+		{minusI, 5}, {fullWhite, 5}, {plusQ, 5}, {barBlack, 5},
+		{superBlack, 1}, {barBlack, 2}, {darkGray, 1}, {barBlack, 4},
+	}
+	x := 0
+	for _, b := range bottom {
+		bw := w * b.width / 28
+		fillRect(t.bars, w, h, x, mid, bw, h-mid, b.c)
+		x += bw
+	}
+	if x < w {
+		fillRect(t.bars, w, h, x, mid, w-x, h-mid, barBlack)
+	}
+}
+
+// drawText writes text at (x, y) in white on a black box.
+func (t *TestPatternVideo) drawText(text string, x, y, scale int) {
+	w, h := t.format.Width, t.format.Height
+	fillRect(t.frame, w, h, x-scale, y-scale, len(text)*6*scale+scale, 9*scale, barBlack)
+
+	for i := 0; i < len(text); i++ {
+		glyph := digitFont[text[i]]
+		for row := 0; row < 7; row++ {
+			for col := 0; col < 5; col++ {
+				if glyph[row]&(0x10>>col) == 0 {
+					continue
+				}
+				px := x + (i*6+col)*scale
+				py := y + row*scale
+				// Luma only, the box below is already neutral
+				for dy := 0; dy < scale; dy++ {
+					for dx := 0; dx < scale; dx++ {
+						if px+dx < w && py+dy < h && px+dx >= 0 && py+dy >= 0 {
+							t.frame[(py+dy)*w+px+dx] = fullWhite.y
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+// fillRect fills a rectangle of an I420 frame, clipped to the frame.
+func fillRect(frame []byte, w, h, x, y, rw, rh int, c yuv) {
+	x0, y0, x1, y1 := x, y, x+rw, y+rh
+	if x0 < 0 {
+		x0 = 0
+	}
+	if y0 < 0 {
+		y0 = 0
+	}
+	if x1 > w {
+		x1 = w
+	}
+	if y1 > h {
+		y1 = h
+	}
+	if x0 >= x1 || y0 >= y1 {
+		return
+	}
+
+	for row := y0; row < y1; row++ {
+		line := frame[row*w : row*w+w]
+		for col := x0; col < x1; col++ {
+			line[col] = c.y
+		}
+	}
+
+	cw := w / 2
+	uPlane := frame[w*h : w*h+cw*(h/2)]
+	vPlane := frame[w*h+cw*(h/2):]
+	for row := y0 / 2; row < (y1+1)/2 && row < h/2; row++ {
+		for col := x0 / 2; col < (x1+1)/2 && col < cw; col++ {
+			uPlane[row*cw+col] = c.u
+			vPlane[row*cw+col] = c.v
+		}
+	}
+}
+
+// TestToneAudio is an AudioSource producing a quiet sine tone, interrupted
+// by a louder beep in sync with the flash of TestPatternVideo.
+type TestToneAudio struct {
+	format AudioFormat
+	cfg    TestPatternConfig
+	frame  []byte
+	pos    int64
+}
+
+// NewTestToneAudio creates a tone in the given format.
+func NewTestToneAudio(format AudioFormat, cfg TestPatternConfig) *TestToneAudio {
+	return &TestToneAudio{format: format, cfg: cfg, frame: make([]byte, format.FrameSize())}
+}
+
+func (t *TestToneAudio) AudioFormat() AudioFormat { return t.format }
+
+func (t *TestToneAudio) ReadAudio(ctx context.Context) (Frame, error) {
+	const (
+		toneLevel = 0.05 // about -26dBFS
+		beepLevel = 0.5  // about -6dBFS
+	)
+
+	samples := len(t.frame) / 2 / t.format.Channels
+	rate := int64(t.format.SampleRate)
+	periodSamples := rate * int64(t.cfg.Period) / int64(time.Second)
+	beepSamples := rate * int64(t.cfg.FlashDuration) / int64(time.Second)
+
+	for i := 0; i < samples; i++ {
+		s := t.pos*int64(samples) + int64(i)
+		// Phase from the sample index, so long sessions do not drift
+		hz, level := t.cfg.ToneHz, toneLevel
+		if periodSamples > 0 && s%periodSamples < beepSamples {
+			hz, level = t.cfg.BeepHz, beepLevel
+		}
+		v := int16(level * math.MaxInt16 * math.Sin(2*math.Pi*hz*float64(s%rate)/float64(rate)))
+		for c := 0; c < t.format.Channels; c++ {
+			binary.LittleEndian.PutUint16(t.frame[2*(i*t.format.Channels+c):], uint16(v))
+		}
+	}
+
+	frame := Frame{Data: t.frame, PTS: time.Duration(t.pos) * AudioFrameDuration}
+	t.pos++
+	return frame, nil
+}
+
+func (t *TestToneAudio) Skip(frames int64) error {
+	t.pos += frames
+	return nil
+}
+
+func (t *TestToneAudio) Rewind() error {
+	t.pos = 0
+	return nil
+}
+
+func (t *TestToneAudio) Close() error { return nil }
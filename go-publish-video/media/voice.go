@@ -0,0 +1,213 @@
+package media
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/pion/opus"
+)
+
+// VoiceEncoding is the encoding of the audio in a ConvoAI voice chunk.
+type VoiceEncoding int
+
+const (
+	VoicePCM16 VoiceEncoding = iota // signed 16-bit little-endian
+	VoicePCM8                       // unsigned 8-bit
+	// VoiceOpus is one Opus packet per chunk
+	VoiceOpus
+)
+
+func (e VoiceEncoding) String() string {
+	switch e {
+	case VoicePCM16:
+		return "PCM16"
+	case VoicePCM8:
+		return "PCM8"
+	case VoiceOpus:
+		return "OPUS"
+	}
+	return fmt.Sprintf("VoiceEncoding(%d)", int(e))
+}
+
+// ParseVoiceEncoding parses "PCM16", "PCM8" or "OPUS", the names the voice
+// command uses.
+func ParseVoiceEncoding(s string) (VoiceEncoding, error) {
+	for _, e := range []VoiceEncoding{VoicePCM16, VoicePCM8, VoiceOpus} {
+		if strings.EqualFold(s, e.String()) {
+			return e, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown voice encoding %q, expected PCM16, PCM8 or OPUS", s)
+}
+
+// Voice chunks are mono
+const voiceChannels = 1
+
+// VoiceSampleRates are the sample rates PCM voice chunks may have.
+var VoiceSampleRates = []int{8000, 11025, 16000, 22050, 24000, 32000, 44100, 48000}
+
+// opusMaxPacketSamples is the longest Opus packet, 120ms at 48kHz.
+const opusMaxPacketSamples = 5760
+
+// VoiceDecoder turns a stream of voice chunks into PCM16 in the format the
+// publisher sends. It keeps decoder and resampler state between chunks, so
+// the chunks of one stream must be decoded in order by one VoiceDecoder.
+type VoiceDecoder struct {
+	out     AudioFormat
+	quality ResampleQuality
+
+	opus       *opus.Decoder
+	opusFormat AudioFormat // what the Opus decoder produces
+
+	resampler  *Resampler
+	resampleIn AudioFormat
+
+	// rate is the sample rate of the first PCM chunk, which all later PCM
+	// chunks must have
+	rate int
+
+	pcm []int16
+	buf []int16
+	raw []byte
+}
+
+// NewVoiceDecoder creates a decoder producing out. quality is used when a
+// chunk's sample rate differs from out.
+func NewVoiceDecoder(out AudioFormat, quality ResampleQuality) (*VoiceDecoder, error) {
+	if out.SampleRate <= 0 || out.Channels <= 0 {
+		return nil, fmt.Errorf("invalid voice output format %s", out)
+	}
+	return &VoiceDecoder{out: out, quality: quality}, nil
+}
+
+// Decode converts one chunk with the given encoding and sample rate to
+// PCM16 in the output format. Opus chunks are decoded at a rate Opus
+// supports and resampled from there; their sampleRate is only informative.
+// PCM chunks must have one of VoiceSampleRates, the same as the first PCM
+// chunk, so the resampler is not rebuilt for every chunk.
+// The result is only valid until the next call. Some samples may be held
+// back by the resampler until later chunks arrive.
+func (d *VoiceDecoder) Decode(data []byte, encoding VoiceEncoding, sampleRate int) ([]byte, error) {
+	if len(data) == 0 {
+		return d.raw[:0], nil
+	}
+
+	var (
+		pcm    []int16
+		format AudioFormat
+		err    error
+	)
+	if encoding == VoicePCM16 || encoding == VoicePCM8 {
+		if err := d.checkRate(sampleRate); err != nil {
+			return nil, err
+		}
+	}
+	switch encoding {
+	case VoicePCM16:
+		if len(data)%2 != 0 {
+			return nil, fmt.Errorf("PCM16 voice chunk has an odd length of %d bytes", len(data))
+		}
+		format = AudioFormat{SampleRate: sampleRate, Channels: voiceChannels}
+		pcm = bytesToPCM16(d.pcm[:0], data)
+	case VoicePCM8:
+		format = AudioFormat{SampleRate: sampleRate, Channels: voiceChannels}
+		pcm = d.pcm[:0]
+		for _, b := range data {
+			pcm = append(pcm, int16(int(b)-128)<<8)
+		}
+	case VoiceOpus:
+		pcm, err = d.decodeOpus(data)
+		if err != nil {
+			return nil, err
+		}
+		format = d.opusFormat
+	default:
+		return nil, fmt.Errorf("unsupported voice encoding %s", encoding)
+	}
+	d.pcm = pcm
+
+	if format != d.out {
+		if d.resampler == nil || format != d.resampleIn {
+			// A new input format starts a new stream, whatever the old
+			// resampler still held is dropped
+			d.resampler, err = NewResampler(format, d.out, d.quality)
+			if err != nil {
+				return nil, err
+			}
+			d.resampleIn = format
+		}
+		d.buf = d.resampler.Process(pcm, d.buf[:0])
+		pcm = d.buf
+	}
+
+	if cap(d.raw) < 2*len(pcm) {
+		d.raw = make([]byte, 2*len(pcm))
+	}
+	d.raw = d.raw[:2*len(pcm)]
+	for i, s := range pcm {
+		binary.LittleEndian.PutUint16(d.raw[2*i:], uint16(s))
+	}
+	return d.raw, nil
+}
+
+// checkRate accepts one of VoiceSampleRates for the first PCM chunk and
+// only that rate afterwards.
+func (d *VoiceDecoder) checkRate(sampleRate int) error {
+	if d.rate != 0 {
+		if sampleRate != d.rate {
+			return fmt.Errorf("voice sample rate %d differs from the stream's %d", sampleRate, d.rate)
+		}
+		return nil
+	}
+	for _, rate := range VoiceSampleRates {
+		if sampleRate == rate {
+			d.rate = rate
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported voice sample rate %d, expected one of %v", sampleRate, VoiceSampleRates)
+}
+
+// decodeOpus decodes one packet. The decoder outputs the publisher's format
+// directly when Opus supports it, so most streams need no resampling.
+func (d *VoiceDecoder) decodeOpus(packet []byte) ([]int16, error) {
+	if _, err := opusPacketSamples(packet); err != nil {
+		return nil, fmt.Errorf("malformed Opus packet: %v", err)
+	}
+
+	if d.opus == nil {
+		format := AudioFormat{SampleRate: opusRate, Channels: d.out.Channels}
+		switch d.out.SampleRate {
+		case 8000, 12000, 16000, 24000, 48000:
+			format.SampleRate = d.out.SampleRate
+		}
+		if format.Channels > 2 {
+			format.Channels = voiceChannels
+		}
+		decoder, err := opus.NewDecoderWithOutput(format.SampleRate, format.Channels)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create Opus decoder: %v", err)
+		}
+		d.opus = &decoder
+		d.opusFormat = format
+	}
+
+	size := opusMaxPacketSamples * d.opusFormat.SampleRate / opusRate * d.opusFormat.Channels
+	if cap(d.pcm) < size {
+		d.pcm = make([]int16, size)
+	}
+	pcm := d.pcm[:size]
+	samples, err := d.opus.DecodeToInt16(packet, pcm)
+	if err != nil {
+		return nil, fmt.Errorf("malformed Opus packet: %v", err)
+	}
+	return pcm[:samples*d.opusFormat.Channels], nil
+}
+
+// Reset drops the decoder and resampler state, e.g. when a new utterance
+// does not continue the previous one. The PCM sample rate stays fixed.
+func (d *VoiceDecoder) Reset() {
+	d.opus = nil
+	d.resampler = nil
+}
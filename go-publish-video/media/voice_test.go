@@ -0,0 +1,49 @@
+package media
+
+import "testing"
+
+func TestVoiceDecoderSampleRate(t *testing.T) {
+	out := AudioFormat{SampleRate: 16000, Channels: 1}
+	chunk := make([]byte, 320)
+
+	for _, rate := range []int{0, -1, 12345, 47999, 96000} {
+		d, err := NewVoiceDecoder(out, ResampleLow)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.Decode(chunk, VoicePCM16, rate); err == nil {
+			t.Errorf("rate %d accepted", rate)
+		}
+	}
+
+	for _, rate := range VoiceSampleRates {
+		d, err := NewVoiceDecoder(out, ResampleLow)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.Decode(chunk, VoicePCM16, rate); err != nil {
+			t.Errorf("rate %d: %v", rate, err)
+		}
+	}
+}
+
+func TestVoiceDecoderKeepsFirstRate(t *testing.T) {
+	d, err := NewVoiceDecoder(AudioFormat{SampleRate: 16000, Channels: 1}, ResampleLow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk := make([]byte, 320)
+	if _, err := d.Decode(chunk, VoicePCM16, 24000); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Decode(chunk, VoicePCM8, 48000); err == nil {
+		t.Error("chunk with another rate accepted")
+	}
+	d.Reset()
+	if _, err := d.Decode(chunk, VoicePCM16, 16000); err == nil {
+		t.Error("chunk with another rate accepted after Reset")
+	}
+	if _, err := d.Decode(chunk, VoicePCM8, 24000); err != nil {
+		t.Errorf("chunk with the first rate: %v", err)
+	}
+}
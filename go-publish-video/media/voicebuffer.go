@@ -0,0 +1,131 @@
+package media
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// VoiceBuffer is a live AudioSource fed with PCM16 as it arrives, e.g. from
+// a network connection. It plays silence while it has no complete frame, so
+// the audio stream never stalls between utterances.
+type VoiceBuffer struct {
+	format   AudioFormat
+	maxBytes int
+
+	mu     sync.Mutex
+	data   []byte
+	ended  bool // the last utterance is complete, pad its partial frame
+	closed bool
+
+	frame []byte
+	pos   int64
+}
+
+// NewVoiceBuffer creates a buffer in format holding at most maxBuffered of
+// audio that has not been played yet.
+func NewVoiceBuffer(format AudioFormat, maxBuffered time.Duration) *VoiceBuffer {
+	frames := int(maxBuffered / AudioFrameDuration)
+	if frames < 1 {
+		frames = 1
+	}
+	return &VoiceBuffer{
+		format:   format,
+		maxBytes: frames * format.FrameSize(),
+		frame:    make([]byte, format.FrameSize()),
+	}
+}
+
+// Write queues PCM16 in the buffer's format. It fails without queueing
+// anything if the buffer would exceed its limit.
+func (b *VoiceBuffer) Write(pcm []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return io.ErrClosedPipe
+	}
+	if len(b.data)+len(pcm) > b.maxBytes {
+		return fmt.Errorf("voice buffer full, %v of audio is waiting to be played", b.durationLocked())
+	}
+	b.data = append(b.data, pcm...)
+	b.ended = false
+	return nil
+}
+
+// End marks the end of an utterance, so a trailing partial frame is padded
+// with silence and played instead of waiting for more audio.
+func (b *VoiceBuffer) End() {
+	b.mu.Lock()
+	b.ended = true
+	b.mu.Unlock()
+}
+
+// Clear drops all queued audio and returns how much was dropped.
+func (b *VoiceBuffer) Clear() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	dropped := b.durationLocked()
+	b.data = b.data[:0]
+	b.ended = false
+	return dropped
+}
+
+// Buffered is the amount of queued audio that has not been played.
+func (b *VoiceBuffer) Buffered() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.durationLocked()
+}
+
+func (b *VoiceBuffer) durationLocked() time.Duration {
+	bytesPerSecond := 2 * b.format.SampleRate * b.format.Channels
+	return time.Duration(int64(len(b.data)) * int64(time.Second) / int64(bytesPerSecond))
+}
+
+func (b *VoiceBuffer) AudioFormat() AudioFormat { return b.format }
+
+// ReadAudio returns the next queued frame, or silence if there is none.
+func (b *VoiceBuffer) ReadAudio(ctx context.Context) (Frame, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return Frame{}, io.EOF
+	}
+
+	n := 0
+	if len(b.data) >= len(b.frame) || b.ended {
+		n = copy(b.frame, b.data)
+		rest := copy(b.data, b.data[n:])
+		b.data = b.data[:rest]
+		if len(b.data) == 0 {
+			b.ended = false
+		}
+	}
+	for i := n; i < len(b.frame); i++ {
+		b.frame[i] = 0
+	}
+
+	pts := time.Duration(b.pos) * AudioFrameDuration
+	b.pos++
+	return Frame{Data: b.frame, PTS: pts}, nil
+}
+
+// Skip does nothing: queued audio is not tied to the clock and is played
+// once streaming resumes, instead of being dropped for the time it waited.
+func (b *VoiceBuffer) Skip(frames int64) error {
+	b.mu.Lock()
+	b.pos += frames
+	b.mu.Unlock()
+	return nil
+}
+
+// Close makes ReadAudio report io.EOF, ending the audio stream.
+func (b *VoiceBuffer) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	b.data = nil
+	b.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,299 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"time"
+)
+
+// WAVEncoding is a sample encoding the WAV reader can convert to PCM16.
+type WAVEncoding int
+
+const (
+	WAVPCM8 WAVEncoding = iota + 1 // unsigned 8-bit
+	WAVPCM16
+	WAVFloat32
+)
+
+func (e WAVEncoding) String() string {
+	switch e {
+	case WAVPCM8:
+		return "PCM8"
+	case WAVPCM16:
+		return "PCM16"
+	case WAVFloat32:
+		return "float32"
+	}
+	return fmt.Sprintf("WAVEncoding(%d)", int(e))
+}
+
+func (e WAVEncoding) bytesPerSample() int {
+	switch e {
+	case WAVPCM8:
+		return 1
+	case WAVPCM16:
+		return 2
+	}
+	return 4
+}
+
+const (
+	wavFormatPCM        = 0x0001
+	wavFormatIEEEFloat  = 0x0003
+	wavFormatExtensible = 0xFFFE
+)
+
+// WAVHeader describes the audio in a WAV file.
+type WAVHeader struct {
+	Encoding   WAVEncoding
+	SampleRate int
+	Channels   int
+	DataOffset int64
+	DataSize   int64 // -1 if the data chunk runs to the end of the file
+}
+
+// AudioFormat returns the PCM16 format samples of the file are delivered in.
+func (h WAVHeader) AudioFormat() AudioFormat {
+	return AudioFormat{SampleRate: h.SampleRate, Channels: h.Channels}
+}
+
+// IsWAVFile reports whether the file starts with a RIFF/WAVE header.
+func IsWAVFile(path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	magic := make([]byte, 12)
+	if _, err := io.ReadFull(file, magic); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return false, nil
+		}
+		return false, err
+	}
+	return bytes.Equal(magic[0:4], []byte("RIFF")) && bytes.Equal(magic[8:12], []byte("WAVE")), nil
+}
+
+// ReadWAVHeader parses the RIFF chunks of a WAV file up to its data chunk.
+func ReadWAVHeader(path string) (WAVHeader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return WAVHeader{}, err
+	}
+	defer file.Close()
+
+	header, err := readWAVHeader(file)
+	if err != nil {
+		return WAVHeader{}, fmt.Errorf("%s: %v", path, err)
+	}
+	return header, nil
+}
+
+func readWAVHeader(r io.ReadSeeker) (WAVHeader, error) {
+	riff := make([]byte, 12)
+	if _, err := io.ReadFull(r, riff); err != nil {
+		return WAVHeader{}, fmt.Errorf("failed to read RIFF header: %v", err)
+	}
+	if !bytes.Equal(riff[0:4], []byte("RIFF")) || !bytes.Equal(riff[8:12], []byte("WAVE")) {
+		return WAVHeader{}, fmt.Errorf("not a RIFF/WAVE file")
+	}
+
+	var header WAVHeader
+	offset := int64(12)
+	chunk := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return WAVHeader{}, fmt.Errorf("no data chunk found: %v", err)
+		}
+		id := string(chunk[0:4])
+		size := int64(binary.LittleEndian.Uint32(chunk[4:8]))
+		offset += 8
+
+		switch id {
+		case "fmt ":
+			if size < 16 {
+				return WAVHeader{}, fmt.Errorf("fmt chunk too short (%d bytes)", size)
+			}
+			body := make([]byte, size)
+			if _, err := io.ReadFull(r, body); err != nil {
+				return WAVHeader{}, fmt.Errorf("failed to read fmt chunk: %v", err)
+			}
+			if err := header.parseFmt(body); err != nil {
+				return WAVHeader{}, err
+			}
+
+		case "data":
+			if header.Encoding == 0 {
+				return WAVHeader{}, fmt.Errorf("data chunk before fmt chunk")
+			}
+			header.DataOffset = offset
+			header.DataSize = size
+			// Streaming writers leave the size unset
+			if size == 0 || size == math.MaxUint32 {
+				header.DataSize = -1
+			}
+			return header, nil
+
+		default:
+			// LIST, fact, cue and other metadata
+			if _, err := r.Seek(size, io.SeekCurrent); err != nil {
+				return WAVHeader{}, err
+			}
+		}
+
+		// Chunks are padded to an even size
+		if size%2 == 1 {
+			if _, err := r.Seek(1, io.SeekCurrent); err != nil {
+				return WAVHeader{}, err
+			}
+			size++
+		}
+		offset += size
+	}
+}
+
+func (h *WAVHeader) parseFmt(body []byte) error {
+	formatTag := binary.LittleEndian.Uint16(body[0:2])
+	h.Channels = int(binary.LittleEndian.Uint16(body[2:4]))
+	h.SampleRate = int(binary.LittleEndian.Uint32(body[4:8]))
+	bits := int(binary.LittleEndian.Uint16(body[14:16]))
+
+	// WAVE_FORMAT_EXTENSIBLE keeps the real format tag in its sub-format GUID
+	if formatTag == wavFormatExtensible {
+		if len(body) < 26 {
+			return fmt.Errorf("extensible fmt chunk too short (%d bytes)", len(body))
+		}
+		formatTag = binary.LittleEndian.Uint16(body[24:26])
+	}
+
+	switch {
+	case formatTag == wavFormatPCM && bits == 8:
+		h.Encoding = WAVPCM8
+	case formatTag == wavFormatPCM && bits == 16:
+		h.Encoding = WAVPCM16
+	case formatTag == wavFormatIEEEFloat && bits == 32:
+		h.Encoding = WAVFloat32
+	default:
+		return fmt.Errorf("unsupported WAV encoding (format tag 0x%04x, %d bits), supported: PCM 8/16-bit and 32-bit float", formatTag, bits)
+	}
+
+	switch {
+	case h.Channels < 1:
+		return fmt.Errorf("invalid WAV channel count %d", h.Channels)
+	case h.SampleRate <= 0:
+		return fmt.Errorf("invalid WAV sample rate %dHz", h.SampleRate)
+	}
+	return nil
+}
+
+// WAVFile is an AudioSource reading a WAV file, converting its samples to
+// PCM16. Rates that do not split into AudioFrameDuration frames, such as
+// 22050Hz, are read in chunks of several frames (441 samples, 20ms) and
+// have to be converted to a rate that does before publishing.
+type WAVFile struct {
+	header WAVHeader
+	frames *frameFile
+	out    []byte
+
+	chunkFrames int64 // AudioFrameDuration frames per chunk read
+	skipped     int64 // frames skipped short of a whole chunk
+}
+
+// OpenWAVFile opens a WAV file with 8/16-bit PCM or 32-bit float samples.
+// A partial last chunk is padded with silence.
+func OpenWAVFile(path string, mode PlayMode) (*WAVFile, error) {
+	header, err := ReadWAVHeader(path)
+	if err != nil {
+		return nil, err
+	}
+	format := header.AudioFormat()
+	chunkFrames := format.chunkFrames()
+	samples := format.SampleRate * chunkFrames / int(time.Second/AudioFrameDuration) * format.Channels
+	frames, err := openFrameFile(path, header.DataOffset, header.DataSize, samples*header.Encoding.bytesPerSample(), true, mode.forAudio())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audio file %s: %v", path, err)
+	}
+	if header.Encoding == WAVPCM8 {
+		// 8-bit PCM is unsigned, silence is the midpoint
+		frames.padByte = 0x80
+	}
+	return &WAVFile{
+		header:      header,
+		frames:      frames,
+		out:         make([]byte, 2*samples),
+		chunkFrames: int64(chunkFrames),
+	}, nil
+}
+
+func (w *WAVFile) Header() WAVHeader { return w.header }
+
+func (w *WAVFile) AudioFormat() AudioFormat { return w.header.AudioFormat() }
+
+func (w *WAVFile) ReadAudio(ctx context.Context) (Frame, error) {
+	data, n, err := w.frames.read()
+	if err != nil {
+		return Frame{}, err
+	}
+
+	switch w.header.Encoding {
+	case WAVPCM16:
+		copy(w.out, data)
+	case WAVPCM8:
+		for i, b := range data {
+			binary.LittleEndian.PutUint16(w.out[2*i:], uint16(int16(int(b)-128)<<8))
+		}
+	case WAVFloat32:
+		for i := 0; i < len(data)/4; i++ {
+			v := math.Float32frombits(binary.LittleEndian.Uint32(data[4*i:]))
+			binary.LittleEndian.PutUint16(w.out[2*i:], uint16(floatToPCM16(v)))
+		}
+	}
+	return Frame{Data: w.out, PTS: time.Duration(n*w.chunkFrames) * AudioFrameDuration}, nil
+}
+
+// Skip skips AudioFrameDuration frames. With longer chunks the frames short
+// of a whole chunk are carried over to the next skip.
+func (w *WAVFile) Skip(frames int64) error {
+	w.skipped += frames
+	chunks := w.skipped / w.chunkFrames
+	w.skipped %= w.chunkFrames
+	return w.frames.skip(chunks)
+}
+
+func (w *WAVFile) Rewind() error {
+	w.skipped = 0
+	return w.frames.rewind()
+}
+
+func (w *WAVFile) Close() error { return w.frames.file.Close() }
+
+func floatToPCM16(v float32) int16 {
+	switch {
+	case v != v: // NaN
+		return 0
+	case v >= 1:
+		return math.MaxInt16
+	case v <= -1:
+		return math.MinInt16
+	}
+	return int16(v * math.MaxInt16)
+}
+
+// OpenAudioFile opens a WAV file, detected by its signature, or otherwise
+// headerless PCM16 in the raw format.
+func OpenAudioFile(path string, raw AudioFormat, mode PlayMode) (AudioSource, error) {
+	isWAV, err := IsWAVFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audio file %s: %v", path, err)
+	}
+	if isWAV {
+		return OpenWAVFile(path, mode)
+	}
+	return OpenRawAudioFile(path, raw, mode)
+}
@@ -0,0 +1,151 @@
+package media
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestWAV writes samples as a mono PCM16 WAV file.
+func writeTestWAV(t *testing.T, rate int, samples []int16) string {
+	t.Helper()
+	data := make([]byte, 2*len(samples))
+	for i, s := range samples {
+		binary.LittleEndian.PutUint16(data[2*i:], uint16(s))
+	}
+	header := make([]byte, 44)
+	copy(header[0:], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(36+len(data)))
+	copy(header[8:], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(header[16:], 16)
+	binary.LittleEndian.PutUint16(header[20:], wavFormatPCM)
+	binary.LittleEndian.PutUint16(header[22:], 1)
+	binary.LittleEndian.PutUint32(header[24:], uint32(rate))
+	binary.LittleEndian.PutUint32(header[28:], uint32(2*rate))
+	binary.LittleEndian.PutUint16(header[32:], 2)
+	binary.LittleEndian.PutUint16(header[34:], 16)
+	copy(header[36:], "data")
+	binary.LittleEndian.PutUint32(header[40:], uint32(len(data)))
+
+	path := filepath.Join(t.TempDir(), "test.wav")
+	if err := os.WriteFile(path, append(header, data...), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestAudioFormatFramed(t *testing.T) {
+	tests := []struct {
+		rate, framed int
+		splits       bool
+	}{
+		{16000, 16000, true},
+		{44100, 44100, true},
+		{22050, 44100, false},
+		{11025, 44100, false},
+		{8000, 8000, true},
+		{7350, 14700, false},
+		{47999, 48000, false},
+	}
+	for _, tt := range tests {
+		format := AudioFormat{SampleRate: tt.rate, Channels: 1}
+		if got := format.SplitsIntoFrames(); got != tt.splits {
+			t.Errorf("%dHz: SplitsIntoFrames() = %v, want %v", tt.rate, got, tt.splits)
+		}
+		if got := format.Framed(); got.SampleRate != tt.framed || got.Channels != 1 {
+			t.Errorf("%dHz: Framed() = %v, want %dHz", tt.rate, got, tt.framed)
+		}
+	}
+}
+
+// 22050Hz does not split into 10ms frames, so the file is read in 20ms
+// chunks of 441 samples.
+func TestWAVFileReadsChunks(t *testing.T) {
+	samples := make([]int16, 22050)
+	for i := range samples {
+		samples[i] = int16(i)
+	}
+	w, err := OpenWAVFile(writeTestWAV(t, 22050, samples), PlayOnce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		frame, err := w.ReadAudio(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(frame.Data) != 2*441 {
+			t.Fatalf("chunk %d: %d bytes, want %d", i, len(frame.Data), 2*441)
+		}
+		if want := time.Duration(i) * 20 * time.Millisecond; frame.PTS != want {
+			t.Errorf("chunk %d: PTS %v, want %v", i, frame.PTS, want)
+		}
+		if first := int16(binary.LittleEndian.Uint16(frame.Data)); first != int16(441*i) {
+			t.Errorf("chunk %d starts with sample %d, want %d", i, first, 441*i)
+		}
+	}
+
+	// Skipping 3 frames moves one chunk and carries one frame over, the
+	// next frame completes another chunk
+	if err := w.Skip(3); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Skip(1); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := w.ReadAudio(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 100 * time.Millisecond; frame.PTS != want {
+		t.Errorf("after skipping: PTS %v, want %v", frame.PTS, want)
+	}
+}
+
+func TestWAVFileConvertsToFramedRate(t *testing.T) {
+	for _, rate := range []int{22050, 11025} {
+		w, err := OpenWAVFile(writeTestWAV(t, rate, make([]int16, rate)), PlayOnce)
+		if err != nil {
+			t.Fatalf("%dHz: %v", rate, err)
+		}
+		format := w.AudioFormat().Framed()
+		source, err := ConvertAudio(w, format, ResampleLow)
+		if err != nil {
+			t.Fatalf("%dHz: %v", rate, err)
+		}
+
+		// One second of input is 100 output frames of 10ms
+		frames := 0
+		for {
+			frame, err := source.ReadAudio(context.Background())
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%dHz: %v", rate, err)
+			}
+			if len(frame.Data) != format.FrameSize() {
+				t.Fatalf("%dHz: frame of %d bytes, want %d", rate, len(frame.Data), format.FrameSize())
+			}
+			frames++
+		}
+		source.Close()
+		if frames != 100 {
+			t.Errorf("%dHz: %d frames, want 100", rate, frames)
+		}
+	}
+}
+
+func TestConvertAudioRejectsUnframedRate(t *testing.T) {
+	src := &pcmSource{format: AudioFormat{SampleRate: 16000, Channels: 1}}
+	if _, err := ConvertAudio(src, AudioFormat{SampleRate: 22050, Channels: 1}, ResampleLow); err == nil {
+		t.Error("converting to 22050Hz succeeded")
+	}
+}
@@ -0,0 +1,304 @@
+package media
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	y4mSignature   = "YUV4MPEG2"
+	y4mFrameMarker = "FRAME"
+	// Headers are short; this only guards against reading a non-Y4M file
+	// as one endless line.
+	y4mMaxLine = 1024
+)
+
+// Y4MHeader holds the stream parameters of a YUV4MPEG2 file.
+type Y4MHeader struct {
+	Width        int
+	Height       int
+	FrameRateNum int
+	FrameRateDen int
+	Interlacing  byte   // 'p' progressive, 't'/'b' field order, 'm' mixed, '?' unknown
+	Colorspace   string // e.g. "420jpeg"; empty means the 420jpeg default
+	AspectNum    int
+	AspectDen    int
+}
+
+// VideoFormat returns the format frames of the file are delivered in.
+func (h Y4MHeader) VideoFormat() VideoFormat {
+	return VideoFormat{Width: h.Width, Height: h.Height, FrameRateNum: h.FrameRateNum, FrameRateDen: h.FrameRateDen}
+}
+
+// ParseY4MHeader parses the stream header line, without the trailing newline.
+func ParseY4MHeader(line string) (Y4MHeader, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 || fields[0] != y4mSignature {
+		return Y4MHeader{}, fmt.Errorf("missing %s signature", y4mSignature)
+	}
+
+	h := Y4MHeader{Interlacing: '?'}
+	for _, field := range fields[1:] {
+		value := field[1:]
+		var err error
+		switch field[0] {
+		case 'W':
+			h.Width, err = strconv.Atoi(value)
+		case 'H':
+			h.Height, err = strconv.Atoi(value)
+		case 'F':
+			h.FrameRateNum, h.FrameRateDen, err = parseRatio(value)
+		case 'A':
+			h.AspectNum, h.AspectDen, err = parseRatio(value)
+		case 'I':
+			if len(value) != 1 {
+				err = fmt.Errorf("invalid value %q", value)
+			} else {
+				h.Interlacing = value[0]
+			}
+		case 'C':
+			h.Colorspace = value
+		case 'X':
+			// Application-specific, ignored
+		default:
+			err = fmt.Errorf("unknown parameter")
+		}
+		if err != nil {
+			return Y4MHeader{}, fmt.Errorf("invalid Y4M header field %q: %v", field, err)
+		}
+	}
+
+	switch {
+	case h.Width <= 0 || h.Height <= 0:
+		return Y4MHeader{}, fmt.Errorf("invalid Y4M frame size %dx%d", h.Width, h.Height)
+	case h.Width%2 != 0 || h.Height%2 != 0:
+		return Y4MHeader{}, fmt.Errorf("Y4M frame size %dx%d is not even, as I420 requires", h.Width, h.Height)
+	case h.FrameRateNum <= 0 || h.FrameRateDen <= 0:
+		return Y4MHeader{}, fmt.Errorf("Y4M header has no valid frame rate (F)")
+	}
+	return h, nil
+}
+
+func parseRatio(value string) (int, int, error) {
+	num, den, ok := strings.Cut(value, ":")
+	if !ok {
+		return 0, 0, fmt.Errorf("expected n:d")
+	}
+	n, err := strconv.Atoi(num)
+	if err != nil {
+		return 0, 0, err
+	}
+	d, err := strconv.Atoi(den)
+	if err != nil {
+		return 0, 0, err
+	}
+	return n, d, nil
+}
+
+// checkI420 reports whether frames with this header can be sent as I420.
+func (h Y4MHeader) checkI420() error {
+	switch h.Colorspace {
+	case "", "420", "420jpeg", "420paldv", "420mpeg2":
+	default:
+		return fmt.Errorf("unsupported Y4M colorspace %q, only 8-bit 4:2:0 is supported", h.Colorspace)
+	}
+	switch h.Interlacing {
+	case 'p', '?':
+	default:
+		return fmt.Errorf("unsupported Y4M interlacing %q, only progressive video is supported", h.Interlacing)
+	}
+	return nil
+}
+
+// readLine reads up to and excluding the next newline.
+func readLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if err == nil {
+			return string(line[:len(line)-1]), nil
+		}
+		if err != bufio.ErrBufferFull {
+			if err == io.EOF && len(line) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		if len(line) > y4mMaxLine {
+			return "", fmt.Errorf("line longer than %d bytes", y4mMaxLine)
+		}
+	}
+}
+
+// IsY4MFile reports whether the file starts with the YUV4MPEG2 signature.
+func IsY4MFile(path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	magic := make([]byte, len(y4mSignature))
+	if _, err := io.ReadFull(file, magic); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return false, nil
+		}
+		return false, err
+	}
+	return bytes.Equal(magic, []byte(y4mSignature)), nil
+}
+
+// ReadY4MHeader reads only the stream header of a Y4M file.
+func ReadY4MHeader(path string) (Y4MHeader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Y4MHeader{}, err
+	}
+	defer file.Close()
+
+	line, err := readLine(bufio.NewReader(file))
+	if err != nil {
+		return Y4MHeader{}, fmt.Errorf("failed to read Y4M header of %s: %v", path, err)
+	}
+	return ParseY4MHeader(line)
+}
+
+// Y4MFile is a VideoSource reading a YUV4MPEG2 file.
+type Y4MFile struct {
+	header Y4MHeader
+	frames *frameFile
+}
+
+// OpenY4MFile opens a Y4M file, validates that its frames are I420 and
+// indexes them. A truncated last frame is ignored.
+func OpenY4MFile(path string, mode PlayMode) (*Y4MFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open video file %s: %v", path, err)
+	}
+
+	reader := bufio.NewReader(file)
+	line, err := readLine(reader)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to read Y4M header of %s: %v", path, err)
+	}
+	header, err := ParseY4MHeader(line)
+	if err == nil {
+		err = header.checkI420()
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	frameSize := header.VideoFormat().FrameSize()
+	offsets, err := indexY4MFrames(file, reader, int64(len(line)+1), int64(frameSize))
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(offsets) == 0 {
+		file.Close()
+		return nil, fmt.Errorf("%s: Y4M file contains no complete frame", path)
+	}
+
+	return &Y4MFile{
+		header: header,
+		frames: &frameFile{
+			file:      file,
+			mode:      mode,
+			offsets:   offsets,
+			frameSize: int64(frameSize),
+			frames:    int64(len(offsets)),
+			lastSize:  int64(frameSize),
+			buf:       make([]byte, frameSize),
+		},
+	}, nil
+}
+
+// indexY4MFrames returns the data offset of every complete frame, starting
+// with the FRAME marker at offset.
+func indexY4MFrames(file *os.File, reader *bufio.Reader, offset, frameSize int64) ([]int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	var offsets []int64
+	for {
+		line, err := readLine(reader)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return offsets, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, y4mFrameMarker) {
+			return nil, fmt.Errorf("expected Y4M %s marker at offset %d, got %q", y4mFrameMarker, offset, truncate(line, 16))
+		}
+		// Per-frame parameters may not change the frame layout
+		for _, field := range strings.Fields(line[len(y4mFrameMarker):]) {
+			if field[0] == 'I' && field != "Ip" {
+				return nil, fmt.Errorf("unsupported interlaced Y4M frame at offset %d", offset)
+			}
+		}
+
+		data := offset + int64(len(line)+1)
+		if data+frameSize > info.Size() {
+			return offsets, nil
+		}
+		offsets = append(offsets, data)
+
+		offset = data + frameSize
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			return nil, err
+		}
+		reader.Reset(file)
+	}
+}
+
+func (y *Y4MFile) Header() Y4MHeader { return y.header }
+
+func (y *Y4MFile) VideoFormat() VideoFormat { return y.header.VideoFormat() }
+
+func (y *Y4MFile) ReadVideo(ctx context.Context) (Frame, error) {
+	data, n, err := y.frames.read()
+	if err != nil {
+		return Frame{}, err
+	}
+	return Frame{Data: data, PTS: y.header.VideoFormat().PTS(n)}, nil
+}
+
+func (y *Y4MFile) Skip(frames int64) error { return y.frames.skip(frames) }
+
+func (y *Y4MFile) Rewind() error { return y.frames.rewind() }
+
+func (y *Y4MFile) Close() error { return y.frames.file.Close() }
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n] + "..."
+	}
+	return s
+}
+
+// OpenVideoFile opens a Y4M file, detected by its signature, or otherwise
+// headerless video in the raw format.
+func OpenVideoFile(path string, raw VideoFormat, mode PlayMode) (VideoSource, error) {
+	isY4M, err := IsY4MFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open video file %s: %v", path, err)
+	}
+	if isY4M {
+		return OpenY4MFile(path, mode)
+	}
+	return OpenRawVideoFile(path, raw, mode)
+}
@@ -1,8 +1,12 @@
+//go:build !child
+
 package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/binary"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -10,25 +14,43 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"go-publish-video/ipc/ipcgen"
+	"go-publish-video/media"
 	flatbuffers "github.com/google/flatbuffers/go"
 )
 
 type ParentController struct {
-	cmd          *exec.Cmd
-	stdin        io.WriteCloser
-	stdout       io.ReadCloser
-	stderr       io.ReadCloser
+	child        *childProcess
 	logger       *log.Logger
 	mu           sync.Mutex
-	isConnected  bool
-	shutdownChan chan struct{}
+	writeMu      sync.Mutex // serializes writes to the child, which may block
+	conn         *connectionState
+	clock        *media.Clock // shared timeline for audio and video, zeroed at CONNECTED
 	wg           sync.WaitGroup
 
+	// ctx carries the values of the context passed to Start for the lifetime
+	// of the controller's goroutines; cancel is called by Stop
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Child supervision
+	opts           *Options
+	events         chan ControllerEvent
+	supervisorDone chan struct{}
+
+	// Resets the activity idle timeout
+	activity chan struct{}
+
+	// Stop runs once, also when the idle timeout triggered it
+	stopOnce   sync.Once
+	stopResult ShutdownResult
+
 	// Media configuration
 	audioFile      string
 	videoFile      string
@@ -42,10 +64,75 @@ type ParentController struct {
 	videoCodec     string
 }
 
+// childProcess tracks a single incarnation of the child. A new one is created
+// every time the supervisor restarts the child.
+type childProcess struct {
+	cmd       *exec.Cmd
+	stdin     *os.File
+	done      chan struct{} // closed once the process has exited
+	exitErr   error
+	failed    chan ipcgen.ConnectionStatus
+	closeAck  chan struct{} // closed when the child confirms CLOSE
+	connected bool
+	lostTimer *time.Timer // restarts the child unless the lost connection recovers
+}
+
+type ControllerEventType int
+
+const (
+	EventChildExited ControllerEventType = iota
+	EventChildFailed
+	EventRestarting
+	EventRestarted
+	EventRestartFailed
+	EventRestartsExhausted
+	EventEndOfMedia
+	EventIdleWarning
+	EventIdleTimeout
+)
+
+var controllerEventNames = map[ControllerEventType]string{
+	EventChildExited:       "CHILD_EXITED",
+	EventChildFailed:       "CHILD_FAILED",
+	EventRestarting:        "RESTARTING",
+	EventRestarted:         "RESTARTED",
+	EventRestartFailed:     "RESTART_FAILED",
+	EventRestartsExhausted: "RESTARTS_EXHAUSTED",
+	EventEndOfMedia:        "END_OF_MEDIA",
+	EventIdleWarning:       "IDLE_WARNING",
+	EventIdleTimeout:       "IDLE_TIMEOUT",
+}
+
+func (t ControllerEventType) String() string {
+	if name, ok := controllerEventNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("ControllerEventType(%d)", int(t))
+}
+
+type ControllerEvent struct {
+	Type    ControllerEventType
+	Time    time.Time
+	Attempt int
+	Backoff time.Duration
+	Status  ipcgen.ConnectionStatus
+	Err     error
+	Stream  string        // "audio" or "video" for EventEndOfMedia
+	Idle    time.Duration // time without activity for the idle events
+}
+
 func NewParentController(opts *Options) *ParentController {
+	opts.setDefaults()
+	ctx, cancel := context.WithCancel(context.Background())
 	return &ParentController{
 		logger:         log.New(os.Stderr, "[parent] ", log.LstdFlags|log.Lshortfile),
-		shutdownChan:   make(chan struct{}),
+		ctx:            ctx,
+		cancel:         cancel,
+		conn:           newConnectionState(),
+		clock:          media.NewClock(),
+		events:         make(chan ControllerEvent, 32),
+		activity:       make(chan struct{}, 1),
+		opts:           opts,
 		audioFile:      opts.AudioFile,
 		videoFile:      opts.VideoFile,
 		sampleRate:     opts.SampleRate,
@@ -66,6 +153,8 @@ type Options struct {
 	Token          string
 	AudioFile      string
 	VideoFile      string
+	ImageFile      string // PNG/JPEG published as still video instead of VideoFile
+	PixelFormat    media.PixelFormat // layout of headerless VideoFile frames
 	SampleRate     int
 	AudioChannels  int
 	VideoWidth     int
@@ -75,13 +164,246 @@ type Options struct {
 	VideoBitrate   int
 	MinVideoBitrate int
 	EnableStringUID bool
+
+	// Child restart policy. Zero values use the defaults below; a negative
+	// MaxRestarts disables restarts
+	MaxRestarts       int
+	RestartBackoff    time.Duration
+	RestartMaxBackoff time.Duration
+
+	// ConnectionLostGrace is how long the SDK may try to recover a lost
+	// connection before the child is restarted, zero uses the default below
+	ConnectionLostGrace time.Duration
+
+	// Shutdown timeouts, zero values use the defaults below
+	CloseAckTimeout time.Duration
+	ExitTimeout     time.Duration
+	// ShutdownTimeout bounds the shutdowns the controller starts itself,
+	// e.g. after the activity idle timeout, 0 disables it
+	ShutdownTimeout time.Duration
+
+	// WriteTimeout bounds every IPC write to the child, 0 disables it
+	WriteTimeout time.Duration
+
+	// ClockReportInterval controls how often A/V timing is logged, 0 disables it
+	ClockReportInterval time.Duration
+
+	// Media sources for StreamAudio/StreamVideo. When nil the raw AudioFile
+	// and VideoFile are read in a loop. Sources set here are not closed by
+	// the controller.
+	AudioSource media.AudioSource
+	VideoSource media.VideoSource
+
+	// EncodedVideoSource replaces VideoSource with compressed video that the
+	// child publishes through the SDK's encoded-image path, without
+	// re-encoding it. Its codec and size must match VideoCodec and
+	// VideoWidth/VideoHeight. It is not closed by the controller.
+	EncodedVideoSource media.EncodedVideoSource
+	// EncodedVideo starts the child in encoded mode for callers that send
+	// frames with SendEncodedVideoFrame themselves; implied by
+	// EncodedVideoSource
+	EncodedVideo bool
+
+	// EncodedAudioSource replaces AudioSource with compressed audio that the
+	// child publishes through the SDK's encoded audio path. Its sample rate
+	// and channels must match SampleRate and AudioChannels. It is not closed
+	// by the controller.
+	EncodedAudioSource media.EncodedAudioSource
+	// EncodedAudio starts the child in encoded audio mode for callers that
+	// send frames with SendEncodedAudioFrame themselves; implied by
+	// EncodedAudioSource
+	EncodedAudio bool
+
+	// What the file sources do at the end of their media
+	PlayMode media.PlayMode
+
+	// Quality used when an audio source has to be resampled
+	ResampleQuality media.ResampleQuality
+
+	// How video sources of another size, and still images, are scaled to
+	// the configured size
+	VideoConvert media.ConvertConfig
+
+	// ActivityIdleTimeout stops the child once nothing happened for this
+	// long: no RecordActivity call, remote user joining or stream message.
+	// 0 disables it
+	ActivityIdleTimeout time.Duration
+
+	// InterruptFade is how long Interrupt fades out the audio that is about
+	// to be played instead of cutting it off
+	InterruptFade time.Duration
+
+	// Child playout buffer, see media.PlayoutConfig
+	PlayoutDelay     time.Duration
+	PlayoutMaxBuffer time.Duration
+	PlayoutMaxLate   time.Duration
+
+	// Child process environment
+	ChildBinary  string   // defaults to "child" next to the parent executable
+	ChildWorkDir string   // defaults to the parent's working directory
+	ChildEnv     []string // extra KEY=VALUE entries, applied last
+	SDKLibPath   string   // prepended to LD_LIBRARY_PATH; defaults to agora_sdk next to the child
+	SDKLogPath   string   // Agora SDK log file written by the child
+}
+
+// Defaults for the restart, recovery and shutdown Options left at zero.
+const (
+	defaultMaxRestarts         = 5
+	defaultRestartBackoff      = 1 * time.Second
+	defaultRestartMaxBackoff   = 30 * time.Second
+	defaultConnectionLostGrace = 30 * time.Second
+	defaultCloseAckTimeout     = 10 * time.Second
+	defaultExitTimeout         = 5 * time.Second
+)
+
+// setDefaults fills in the restart and shutdown options left at zero, for
+// controllers that are not configured from the command line.
+func (o *Options) setDefaults() {
+	if o.MaxRestarts == 0 {
+		o.MaxRestarts = defaultMaxRestarts
+	}
+	if o.RestartBackoff <= 0 {
+		o.RestartBackoff = defaultRestartBackoff
+	}
+	if o.RestartMaxBackoff <= 0 {
+		o.RestartMaxBackoff = defaultRestartMaxBackoff
+	}
+	if o.ConnectionLostGrace <= 0 {
+		o.ConnectionLostGrace = defaultConnectionLostGrace
+	}
+	if o.CloseAckTimeout <= 0 {
+		o.CloseAckTimeout = defaultCloseAckTimeout
+	}
+	if o.ExitTimeout <= 0 {
+		o.ExitTimeout = defaultExitTimeout
+	}
+}
+
+// ChildError is returned by Start when the child reports that it could not
+// initialize the SDK or connect to the channel.
+type ChildError struct {
+	Status  ipcgen.ConnectionStatus
+	Message string
+	Details string
+}
+
+func (e *ChildError) Error() string {
+	msg := fmt.Sprintf("child reported %s: %s", ipcgen.EnumNamesConnectionStatus[e.Status], e.Message)
+	if e.Details != "" {
+		msg += fmt.Sprintf(" (%s)", e.Details)
+	}
+	return msg
 }
 
-func (p *ParentController) Start(opts *Options) error {
+// ErrChildExited is returned by Start when the child terminates before it
+// reports a connection status.
+var ErrChildExited = errors.New("child process exited before connecting")
+
+// ErrIdleTimeout is the reason the child is stopped after
+// Options.ActivityIdleTimeout without activity.
+var ErrIdleTimeout = errors.New("idle timeout")
+
+type sessionIDKey struct{}
+
+// ContextWithSessionID attaches a session ID that the controller includes in
+// its log output.
+func ContextWithSessionID(ctx context.Context, sessionID string) context.Context {
+	return context.WithValue(ctx, sessionIDKey{}, sessionID)
+}
+
+func SessionIDFromContext(ctx context.Context) (string, bool) {
+	sessionID, ok := ctx.Value(sessionIDKey{}).(string)
+	return sessionID, ok && sessionID != ""
+}
+
+// Start launches the child and blocks until it reports CONNECTED. It returns
+// a *ChildError as soon as the child reports INITIALIZED_FAILURE or FAILED,
+// ErrChildExited if the child dies first, and the context error if ctx is
+// done before either happens.
+func (p *ParentController) Start(ctx context.Context, opts *Options) error {
+	if sessionID, ok := SessionIDFromContext(ctx); ok {
+		p.logger.SetPrefix(fmt.Sprintf("[parent %s] ", sessionID))
+	}
 	p.logger.Printf("Starting child process with %s codec...", opts.VideoCodec)
+	opts.setDefaults()
+	p.opts = opts
 
-	// Build command with all necessary flags
-	args := []string{
+	// Keep the caller's request-scoped values for the controller's goroutines,
+	// but not its deadline: that only bounds the connection attempt
+	p.cancel()
+	p.ctx, p.cancel = context.WithCancel(context.WithoutCancel(ctx))
+
+	if err := p.resolveChildPaths(); err != nil {
+		return err
+	}
+
+	// Each session gets a fresh timeline, zeroed when the child first connects
+	p.clock = media.NewClock()
+
+	// Subscribe before spawning so no status can be missed
+	changes, unsubscribe := p.conn.Subscribe()
+	defer unsubscribe()
+
+	child, err := p.spawnChild()
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			p.logger.Printf("Gave up waiting for connection, state=%s", ipcgen.EnumNamesConnectionStatus[p.conn.State()])
+			p.abortChild(child)
+			return fmt.Errorf("waiting for child to connect to Agora: %w", ctx.Err())
+
+		case <-child.done:
+			// The final status is delivered before the pipes close, so
+			// prefer it over the bare exit
+			for {
+				select {
+				case change := <-changes:
+					if err := startFailure(change); err != nil {
+						return err
+					}
+					continue
+				default:
+				}
+				break
+			}
+			return fmt.Errorf("%w: %v", ErrChildExited, child.exitErr)
+
+		case change := <-changes:
+			if change.To == ipcgen.ConnectionStatusCONNECTED {
+				p.logger.Printf("Child successfully connected to Agora with %s codec", opts.VideoCodec)
+				p.startSupervisor()
+				p.startClockReporter()
+				p.startIdleTimer()
+				return nil
+			}
+			if err := startFailure(change); err != nil {
+				p.abortChild(child)
+				return err
+			}
+		}
+	}
+}
+
+func startFailure(change StateChange) error {
+	switch change.To {
+	case ipcgen.ConnectionStatusINITIALIZED_FAILURE, ipcgen.ConnectionStatusFAILED:
+		return &ChildError{Status: change.To, Message: change.Message, Details: change.Details}
+	}
+	return nil
+}
+
+func (p *ParentController) abortChild(child *childProcess) {
+	child.cmd.Process.Kill()
+	<-child.done
+}
+
+func (p *ParentController) childArgs() []string {
+	opts := p.opts
+	return []string{
 		"-appID", opts.AppID,
 		"-channelName", opts.ChannelName,
 		"-userID", opts.UserID,
@@ -95,71 +417,262 @@ func (p *ParentController) Start(opts *Options) error {
 		"-bitrate", fmt.Sprintf("%d", opts.VideoBitrate),
 		"-minBitrate", fmt.Sprintf("%d", opts.MinVideoBitrate),
 		"-enableStringUID", fmt.Sprintf("%t", opts.EnableStringUID),
+		"-sdkLogPath", opts.SDKLogPath,
+		"-playoutDelay", opts.PlayoutDelay.String(),
+		"-playoutMaxBuffer", opts.PlayoutMaxBuffer.String(),
+		"-playoutMaxLate", opts.PlayoutMaxLate.String(),
+		"-encodedVideo", fmt.Sprintf("%t", opts.EncodedVideo || opts.EncodedVideoSource != nil),
+		"-encodedAudio", fmt.Sprintf("%t", opts.EncodedAudio || opts.EncodedAudioSource != nil),
+	}
+}
+
+// resolveChildPaths fills in the child binary and SDK library locations so the
+// parent does not depend on being started from the build directory.
+func (p *ParentController) resolveChildPaths() error {
+	opts := p.opts
+
+	if opts.ChildBinary == "" {
+		exe, err := os.Executable()
+		if err != nil {
+			return fmt.Errorf("failed to locate parent executable: %v", err)
+		}
+		opts.ChildBinary = filepath.Join(filepath.Dir(exe), "child")
+	}
+	childPath, err := filepath.Abs(opts.ChildBinary)
+	if err != nil {
+		return fmt.Errorf("failed to resolve child binary %s: %v", opts.ChildBinary, err)
+	}
+	if _, err := os.Stat(childPath); err != nil {
+		return fmt.Errorf("child binary not found: %v", err)
+	}
+	opts.ChildBinary = childPath
+
+	if opts.SDKLibPath == "" {
+		candidate := filepath.Join(filepath.Dir(childPath), "agora_sdk")
+		if info, err := os.Stat(candidate); err == nil && info.IsDir() {
+			opts.SDKLibPath = candidate
+		}
+	}
+
+	p.logger.Printf("Child binary: %s, working directory: %q, SDK libraries: %q",
+		opts.ChildBinary, opts.ChildWorkDir, opts.SDKLibPath)
+	return nil
+}
+
+func (p *ParentController) childEnv() []string {
+	env := os.Environ()
+	if p.opts.SDKLibPath != "" {
+		libPath := p.opts.SDKLibPath
+		if existing := os.Getenv("LD_LIBRARY_PATH"); existing != "" {
+			libPath += string(os.PathListSeparator) + existing
+		}
+		env = append(env, "LD_LIBRARY_PATH="+libPath)
 	}
+	// Later entries win, so explicit settings override the ones above
+	return append(env, p.opts.ChildEnv...)
+}
 
-	p.cmd = exec.Command("./child", args...)
+// spawnChild starts a new child process from the stored options, makes it the
+// current child and starts the goroutines that read its output.
+func (p *ParentController) spawnChild() (*childProcess, error) {
+	// Build command with all necessary flags
+	cmd := exec.Command(p.opts.ChildBinary, p.childArgs()...)
+	cmd.Dir = p.opts.ChildWorkDir
+	cmd.Env = p.childEnv()
 
-	// Setup pipes
-	var err error
-	p.stdin, err = p.cmd.StdinPipe()
+	// Setup pipes. Stdin is an *os.File so writes can be given deadlines.
+	stdinReader, stdin, err := os.Pipe()
 	if err != nil {
-		return fmt.Errorf("failed to create stdin pipe: %v", err)
+		return nil, fmt.Errorf("failed to create stdin pipe: %v", err)
 	}
+	cmd.Stdin = stdinReader
 
-	p.stdout, err = p.cmd.StdoutPipe()
+	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		return fmt.Errorf("failed to create stdout pipe: %v", err)
+		return nil, fmt.Errorf("failed to create stdout pipe: %v", err)
 	}
 
-	p.stderr, err = p.cmd.StderrPipe()
+	stderr, err := cmd.StderrPipe()
 	if err != nil {
-		return fmt.Errorf("failed to create stderr pipe: %v", err)
+		return nil, fmt.Errorf("failed to create stderr pipe: %v", err)
 	}
 
 	// Start the child process
-	if err := p.cmd.Start(); err != nil {
-		return fmt.Errorf("failed to start child process: %v", err)
+	err = cmd.Start()
+	stdinReader.Close()
+	if err != nil {
+		stdin.Close()
+		return nil, fmt.Errorf("failed to start child process: %v", err)
 	}
 
-	p.logger.Printf("Child process started with PID %d", p.cmd.Process.Pid)
+	p.logger.Printf("Child process started with PID %d", cmd.Process.Pid)
 
-	// Start goroutines for handling child output
-	p.wg.Add(2)
-	go p.readChildStderr()
-	go p.readChildMessages()
+	child := &childProcess{
+		cmd:    cmd,
+		stdin:  stdin,
+		done:   make(chan struct{}),
+		failed:   make(chan ipcgen.ConnectionStatus, 1),
+		closeAck: make(chan struct{}),
+	}
 
-	// Wait for connection to be established
-	timeout := time.After(30 * time.Second) // Increased timeout
-	ticker := time.NewTicker(100 * time.Millisecond)
-	defer ticker.Stop()
+	p.mu.Lock()
+	p.child = child
+	p.mu.Unlock()
+
+	// Every child incarnation starts from scratch
+	p.conn.reset()
+
+	// Start goroutines for handling child output. Wait must only be called
+	// once both pipes have been drained.
+	var readers sync.WaitGroup
+	readers.Add(2)
+	go func() {
+		defer readers.Done()
+		p.readChildStderr(stderr)
+	}()
+	go func() {
+		defer readers.Done()
+		p.readChildMessages(child, stdout)
+	}()
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		readers.Wait()
+		child.exitErr = cmd.Wait()
+		close(child.done)
+
+		// Stop the streaming loops from writing into a dead pipe
+		p.mu.Lock()
+		current := p.child == child
+		p.mu.Unlock()
+		if current {
+			p.setConnectionState(ipcgen.ConnectionStatusDISCONNECTED, "child process exited", "")
+		}
+	}()
+
+	return child, nil
+}
+
+func (p *ParentController) Events() <-chan ControllerEvent {
+	return p.events
+}
+
+func (p *ParentController) emitEvent(event ControllerEvent) {
+	event.Time = time.Now()
+	select {
+	case p.events <- event:
+	default:
+		p.logger.Printf("Event channel full, dropping %s event", event.Type)
+	}
+}
 
+func (p *ParentController) State() ipcgen.ConnectionStatus {
+	return p.conn.State()
+}
+
+// SubscribeState returns a channel that receives every accepted connection
+// state transition, and a function that cancels the subscription.
+func (p *ParentController) SubscribeState() (<-chan StateChange, func()) {
+	return p.conn.Subscribe()
+}
+
+func (p *ParentController) setConnectionState(next ipcgen.ConnectionStatus, message, details string) {
+	prev, err := p.conn.Transition(next, message, details)
+	if err != nil {
+		p.logger.Printf("Rejected connection state change: %v", err)
+		return
+	}
+	if prev != next {
+		p.logger.Printf("Connection state: %s -> %s",
+			ipcgen.EnumNamesConnectionStatus[prev], ipcgen.EnumNamesConnectionStatus[next])
+	}
+}
+
+func (p *ParentController) startSupervisor() {
+	p.supervisorDone = make(chan struct{})
+	go p.supervise(p.ctx)
+}
+
+// supervise watches the current child and restarts it with exponential
+// backoff when it exits, reports FAILED or loses its connection for longer
+// than ConnectionLostGrace. It returns when the controller is stopped or the
+// restart budget is exhausted.
+func (p *ParentController) supervise(ctx context.Context) {
+	defer close(p.supervisorDone)
+
+	p.mu.Lock()
+	child := p.child
+	p.mu.Unlock()
+
+	attempt := 0
 	for {
 		select {
-		case <-timeout:
-			p.mu.Lock()
-			connected := p.isConnected
-			p.mu.Unlock()
-			if connected {
-				p.logger.Printf("Child successfully connected to Agora with %s codec", opts.VideoCodec)
-				return nil
+		case <-ctx.Done():
+			return
+		case <-child.done:
+			p.logger.Printf("Child process exited unexpectedly: %v", child.exitErr)
+			p.emitEvent(ControllerEvent{Type: EventChildExited, Err: child.exitErr})
+		case status := <-child.failed:
+			p.logger.Printf("Child reported terminal status %s, killing it", ipcgen.EnumNamesConnectionStatus[status])
+			p.emitEvent(ControllerEvent{Type: EventChildFailed, Status: status})
+			child.cmd.Process.Kill()
+			<-child.done
+		}
+
+		p.mu.Lock()
+		if child.connected {
+			// The last child made it to CONNECTED, so start a fresh budget
+			attempt = 0
+		}
+		p.mu.Unlock()
+
+		for {
+			attempt++
+			if attempt > p.opts.MaxRestarts {
+				p.logger.Printf("Giving up after %d restart attempts", attempt-1)
+				p.emitEvent(ControllerEvent{Type: EventRestartsExhausted, Attempt: attempt - 1})
+				return
 			}
-			p.logger.Printf("DEBUG: Timeout waiting for connection. isConnected=%v", connected)
-			return fmt.Errorf("timeout waiting for child to connect to Agora")
-		case <-ticker.C:
-			p.mu.Lock()
-			connected := p.isConnected
-			p.mu.Unlock()
-			if connected {
-				p.logger.Printf("Child successfully connected to Agora with %s codec", opts.VideoCodec)
-				return nil
+
+			backoff := p.restartBackoff(attempt)
+			p.logger.Printf("Restarting child in %v (attempt %d/%d)", backoff, attempt, p.opts.MaxRestarts)
+			p.emitEvent(ControllerEvent{Type: EventRestarting, Attempt: attempt, Backoff: backoff})
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+
+			next, err := p.spawnChild()
+			if err != nil {
+				p.logger.Printf("Failed to restart child: %v", err)
+				p.emitEvent(ControllerEvent{Type: EventRestartFailed, Attempt: attempt, Err: err})
+				continue
 			}
+			child = next
+			p.emitEvent(ControllerEvent{Type: EventRestarted, Attempt: attempt})
+			break
 		}
 	}
 }
 
-func (p *ParentController) readChildStderr() {
-	defer p.wg.Done()
-	scanner := bufio.NewScanner(p.stderr)
+// restartBackoff is the delay before restart attempt (counting from 1):
+// RestartBackoff doubled for every earlier attempt, at most RestartMaxBackoff.
+func (p *ParentController) restartBackoff(attempt int) time.Duration {
+	backoff := p.opts.RestartBackoff
+	for i := 1; i < attempt && backoff < p.opts.RestartMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > p.opts.RestartMaxBackoff {
+		return p.opts.RestartMaxBackoff
+	}
+	return backoff
+}
+
+func (p *ParentController) readChildStderr(stderr io.Reader) {
+	scanner := bufio.NewScanner(stderr)
 	for scanner.Scan() {
 		p.logger.Printf("[child-stderr] %s", scanner.Text())
 	}
@@ -168,10 +681,8 @@ func (p *ParentController) readChildStderr() {
 	}
 }
 
-func (p *ParentController) readChildMessages() {
-	defer p.wg.Done()
-	reader := bufio.NewReader(p.stdout)
-	messageCount := 0
+func (p *ParentController) readChildMessages(child *childProcess, stdout io.Reader) {
+	reader := bufio.NewReader(stdout)
 
 	for {
 		// Read length prefix
@@ -186,11 +697,8 @@ func (p *ParentController) readChildMessages() {
 		}
 
 		msgLen := binary.BigEndian.Uint32(lenBytes)
-		messageCount++
-		p.logger.Printf("DEBUG: Message #%d, length: %d bytes", messageCount, msgLen)
-		
 		if msgLen == 0 {
-			p.logger.Printf("DEBUG: Received 0-length message")
+			p.logger.Printf("Ignoring 0-length message from child")
 			continue
 		}
 
@@ -202,26 +710,18 @@ func (p *ParentController) readChildMessages() {
 		}
 
 		// Parse and handle message
-		p.handleChildMessage(msgBuf)
+		p.handleChildMessage(child, msgBuf)
 	}
 }
 
-func (p *ParentController) handleChildMessage(msgBuf []byte) {
+func (p *ParentController) handleChildMessage(child *childProcess, msgBuf []byte) {
 	msg := ipcgen.GetRootAsIPCMessage(msgBuf, 0)
-	
-	// DEBUG: Log every message type
 	msgType := msg.MessageType()
-	p.logger.Printf("DEBUG: Received message type: %s (value: %d)", 
-		ipcgen.EnumNamesMessageType[msgType], msgType)
-	
+
 	switch msgType {
 	case ipcgen.MessageTypeSTATUS_RESPONSE:
-		p.logger.Printf("DEBUG: Processing STATUS_RESPONSE")
-		
 		// Get payload bytes
 		payloadLen := msg.PayloadLength()
-		p.logger.Printf("DEBUG: STATUS_RESPONSE payload length: %d", payloadLen)
-		
 		if payloadLen > 0 {
 			payloadBytes := make([]byte, payloadLen)
 			for i := 0; i < payloadLen; i++ {
@@ -231,29 +731,62 @@ func (p *ParentController) handleChildMessage(msgBuf []byte) {
 			// Parse StatusResponsePayload
 			status := ipcgen.GetRootAsStatusResponsePayload(payloadBytes, 0)
 			statusValue := status.Status()
-			
-			p.logger.Printf("DEBUG: Status value: %d, Expected CONNECTED value: %d", 
-				statusValue, ipcgen.ConnectionStatusCONNECTED)
-			p.logger.Printf("DEBUG: Status name: %s", 
-				ipcgen.EnumNamesConnectionStatus[statusValue])
-			
+
 			p.logger.Printf("Status: %s, Message: %s, Info: %s",
 				ipcgen.EnumNamesConnectionStatus[statusValue],
 				string(status.ErrorMessage()),
 				string(status.AdditionalInfo()))
 			
-			// Update connection state based on status
+			p.mu.Lock()
+			current := p.child == child
 			if statusValue == ipcgen.ConnectionStatusCONNECTED {
-				p.logger.Printf("DEBUG: *** CONNECTED status received! Setting isConnected = true ***")
+				child.connected = true
+			}
+			p.mu.Unlock()
+
+			// Ignore late messages from a child that has already been replaced
+			if !current {
+				p.logger.Printf("Ignoring status %s from previous child",
+					ipcgen.EnumNamesConnectionStatus[statusValue])
+				return
+			}
+
+			// The first connection fixes the zero point of the media clock;
+			// reconnects keep it so timestamps stay monotonic
+			if statusValue == ipcgen.ConnectionStatusCONNECTED && p.clock.Start(time.Now()) {
+				p.logger.Printf("Media clock started")
+			}
+
+			if statusValue == ipcgen.ConnectionStatusDISCONNECTED && string(status.AdditionalInfo()) == closeAckInfo {
+				select {
+				case <-child.closeAck:
+				default:
+					close(child.closeAck)
+				}
+			}
+
+			// TOKEN_WILL_EXPIRE is a notification, not a connection state
+			if statusValue != ipcgen.ConnectionStatusTOKEN_WILL_EXPIRE {
+				p.setConnectionState(statusValue, string(status.ErrorMessage()), string(status.AdditionalInfo()))
+			}
+
+			switch statusValue {
+			case ipcgen.ConnectionStatusFAILED:
+				p.reportChildFailure(child, statusValue)
+			case ipcgen.ConnectionStatusCONNECTION_LOST:
+				// The SDK keeps reconnecting, only a connection that stays
+				// lost needs a new child
+				p.watchConnectionLost(child)
+			case ipcgen.ConnectionStatusCONNECTED, ipcgen.ConnectionStatusRECONNECTED:
 				p.mu.Lock()
-				p.isConnected = true
+				if child.lostTimer != nil {
+					child.lostTimer.Stop()
+					child.lostTimer = nil
+				}
 				p.mu.Unlock()
-			} else {
-				p.logger.Printf("DEBUG: Status is %s (not CONNECTED)", 
-					ipcgen.EnumNamesConnectionStatus[statusValue])
 			}
 		} else {
-			p.logger.Printf("DEBUG: STATUS_RESPONSE has no payload!")
+			p.logger.Printf("Ignoring STATUS_RESPONSE without payload")
 		}
 		
 	case ipcgen.MessageTypeLOG_RESPONSE:
@@ -272,32 +805,297 @@ func (p *ParentController) handleChildMessage(msgBuf []byte) {
 				string(logMsg.Message()))
 		}
 		
+	case ipcgen.MessageTypeACTIVITY_RESPONSE:
+		// Remote users and their stream messages keep the session active
+		p.RecordActivity()
+
 	default:
 		p.logger.Printf("Received unexpected message type from child: %s (value: %d)", 
 			ipcgen.EnumNamesMessageType[msgType], msgType)
 	}
 }
 
-func (p *ParentController) sendMessage(msgBytes []byte) error {
+// reportChildFailure lets the supervisor decide whether to restart the child.
+func (p *ParentController) reportChildFailure(child *childProcess, status ipcgen.ConnectionStatus) {
+	select {
+	case child.failed <- status:
+	default:
+	}
+}
+
+// watchConnectionLost reports the child as failed if its connection does not
+// recover within ConnectionLostGrace.
+func (p *ParentController) watchConnectionLost(child *childProcess) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
+	if child.lostTimer != nil {
+		return
+	}
+	grace := p.opts.ConnectionLostGrace
+	var timer *time.Timer
+	timer = time.AfterFunc(grace, func() {
+		p.mu.Lock()
+		lost := child.lostTimer == timer
+		child.lostTimer = nil
+		p.mu.Unlock()
+		if lost {
+			p.logger.Printf("Connection not recovered within %v", grace)
+			p.reportChildFailure(child, ipcgen.ConnectionStatusCONNECTION_LOST)
+		}
+	})
+	child.lostTimer = timer
+}
 
-	// Write length prefix
-	lenBytes := make([]byte, 4)
-	binary.BigEndian.PutUint32(lenBytes, uint32(len(msgBytes)))
+type StateChange struct {
+	From    ipcgen.ConnectionStatus
+	To      ipcgen.ConnectionStatus
+	Message string
+	Details string
+	Time    time.Time
+}
+
+// validTransitions lists the connection states that may follow each state,
+// following the order in which the child reports SDK callbacks. CONNECTED can
+// arrive before INITIALIZED_SUCCESS because the child reports the latter only
+// after Connect() returns.
+var validTransitions = map[ipcgen.ConnectionStatus][]ipcgen.ConnectionStatus{
+	ipcgen.ConnectionStatusUNINITIALIZED: {
+		ipcgen.ConnectionStatusINITIALIZED_SUCCESS, ipcgen.ConnectionStatusINITIALIZED_FAILURE,
+		ipcgen.ConnectionStatusCONNECTED, ipcgen.ConnectionStatusFAILED, ipcgen.ConnectionStatusDISCONNECTED,
+	},
+	ipcgen.ConnectionStatusINITIALIZED_SUCCESS: {
+		ipcgen.ConnectionStatusCONNECTED, ipcgen.ConnectionStatusRECONNECTING, ipcgen.ConnectionStatusCONNECTION_LOST,
+		ipcgen.ConnectionStatusFAILED, ipcgen.ConnectionStatusDISCONNECTED,
+	},
+	ipcgen.ConnectionStatusINITIALIZED_FAILURE: {
+		ipcgen.ConnectionStatusDISCONNECTED,
+	},
+	ipcgen.ConnectionStatusCONNECTED: {
+		ipcgen.ConnectionStatusRECONNECTING, ipcgen.ConnectionStatusCONNECTION_LOST,
+		ipcgen.ConnectionStatusFAILED, ipcgen.ConnectionStatusDISCONNECTED,
+	},
+	ipcgen.ConnectionStatusRECONNECTING: {
+		ipcgen.ConnectionStatusRECONNECTED, ipcgen.ConnectionStatusCONNECTED, ipcgen.ConnectionStatusCONNECTION_LOST,
+		ipcgen.ConnectionStatusFAILED, ipcgen.ConnectionStatusDISCONNECTED,
+	},
+	ipcgen.ConnectionStatusRECONNECTED: {
+		ipcgen.ConnectionStatusRECONNECTING, ipcgen.ConnectionStatusCONNECTION_LOST,
+		ipcgen.ConnectionStatusFAILED, ipcgen.ConnectionStatusDISCONNECTED,
+	},
+	ipcgen.ConnectionStatusCONNECTION_LOST: {
+		ipcgen.ConnectionStatusRECONNECTING, ipcgen.ConnectionStatusRECONNECTED, ipcgen.ConnectionStatusCONNECTED,
+		ipcgen.ConnectionStatusFAILED, ipcgen.ConnectionStatusDISCONNECTED,
+	},
+	ipcgen.ConnectionStatusDISCONNECTED: {
+		ipcgen.ConnectionStatusCONNECTED, ipcgen.ConnectionStatusFAILED,
+	},
+	ipcgen.ConnectionStatusFAILED: {
+		ipcgen.ConnectionStatusDISCONNECTED,
+	},
+}
+
+// connectionState is the parent's view of the child's Agora connection.
+type connectionState struct {
+	mu          sync.Mutex
+	state       ipcgen.ConnectionStatus
+	changed     chan struct{} // closed and replaced on every transition
+	subscribers map[chan StateChange]struct{}
+}
+
+func newConnectionState() *connectionState {
+	return &connectionState{
+		state:       ipcgen.ConnectionStatusUNINITIALIZED,
+		changed:     make(chan struct{}),
+		subscribers: make(map[chan StateChange]struct{}),
+	}
+}
+
+func (c *connectionState) State() ipcgen.ConnectionStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+// Streamable reports whether media can be sent to the child.
+func (c *connectionState) Streamable() bool {
+	state := c.State()
+	return state == ipcgen.ConnectionStatusCONNECTED || state == ipcgen.ConnectionStatusRECONNECTED
+}
+
+// Transition moves to next if the current state allows it and returns the
+// previous state. Repeating the current state is accepted as a no-op.
+func (c *connectionState) Transition(next ipcgen.ConnectionStatus, message, details string) (ipcgen.ConnectionStatus, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	prev := c.state
+	if prev == next {
+		return prev, nil
+	}
+
+	allowed := false
+	for _, candidate := range validTransitions[prev] {
+		if candidate == next {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return prev, fmt.Errorf("invalid transition %s -> %s",
+			ipcgen.EnumNamesConnectionStatus[prev], ipcgen.EnumNamesConnectionStatus[next])
+	}
+
+	c.setLocked(next, message, details)
+	return prev, nil
+}
+
+// reset returns to UNINITIALIZED for a freshly spawned child, whatever state
+// the previous child left behind.
+func (c *connectionState) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state != ipcgen.ConnectionStatusUNINITIALIZED {
+		c.setLocked(ipcgen.ConnectionStatusUNINITIALIZED, "child restarted", "")
+	}
+}
+
+func (c *connectionState) setLocked(next ipcgen.ConnectionStatus, message, details string) {
+	change := StateChange{From: c.state, To: next, Message: message, Details: details, Time: time.Now()}
+	c.state = next
+	close(c.changed)
+	c.changed = make(chan struct{})
+
+	for ch := range c.subscribers {
+		select {
+		case ch <- change:
+		default:
+			// Slow subscribers miss intermediate states but can always
+			// read the current one through State()
+		}
+	}
+}
+
+func (c *connectionState) Subscribe() (<-chan StateChange, func()) {
+	ch := make(chan StateChange, 16)
+	c.mu.Lock()
+	c.subscribers[ch] = struct{}{}
+	c.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			c.mu.Lock()
+			delete(c.subscribers, ch)
+			c.mu.Unlock()
+		})
+	}
+}
+
+// WaitStreamable blocks until media can be sent again. It returns false if
+// ctx is done first.
+func (c *connectionState) WaitStreamable(ctx context.Context) bool {
+	for {
+		c.mu.Lock()
+		state := c.state
+		changed := c.changed
+		c.mu.Unlock()
+
+		if state == ipcgen.ConnectionStatusCONNECTED || state == ipcgen.ConnectionStatusRECONNECTED {
+			return true
+		}
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-changed:
+		}
+	}
+}
+
+// sendMessage writes one length-prefixed message to the child. The write is
+// abandoned when ctx is done or its deadline (or the configured write timeout)
+// passes, so a stuck child cannot block the caller forever.
+func (p *ParentController) sendMessage(ctx context.Context, msgBytes []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	child := p.child
+	p.mu.Unlock()
+	if child == nil {
+		return fmt.Errorf("child process not running")
+	}
+
+	// p.mu is not held while blocked here: reading the child's replies
+	// needs it, and a child that cannot reply may stop reading
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
 
-	if _, err := p.stdin.Write(lenBytes); err != nil {
-		return fmt.Errorf("failed to write message length: %v", err)
+	deadline, hasDeadline := ctx.Deadline()
+	if p.opts.WriteTimeout > 0 {
+		if timeout := time.Now().Add(p.opts.WriteTimeout); !hasDeadline || timeout.Before(deadline) {
+			deadline, hasDeadline = timeout, true
+		}
+	}
+	if !hasDeadline {
+		deadline = time.Time{}
+	}
+	child.stdin.SetWriteDeadline(deadline)
+
+	// Interrupt the write as soon as ctx is cancelled
+	if done := ctx.Done(); done != nil {
+		finished := make(chan struct{})
+		defer close(finished)
+		go func() {
+			select {
+			case <-done:
+				child.stdin.SetWriteDeadline(time.Now())
+			case <-finished:
+			}
+		}()
 	}
 
-	if _, err := p.stdin.Write(msgBytes); err != nil {
-		return fmt.Errorf("failed to write message payload: %v", err)
+	// Write length prefix and payload in one go
+	buf := make([]byte, 4+len(msgBytes))
+	binary.BigEndian.PutUint32(buf, uint32(len(msgBytes)))
+	copy(buf[4:], msgBytes)
+
+	n, err := child.stdin.Write(buf)
+	if err != nil {
+		if n > 0 {
+			// A partial message leaves the child unable to find the next
+			// length prefix, so let the supervisor replace it
+			p.logger.Printf("Partial write (%d of %d bytes) to child, killing it", n, len(buf))
+			child.cmd.Process.Kill()
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return fmt.Errorf("failed to write message: %w", ctxErr)
+		}
+		return fmt.Errorf("failed to write message: %v", err)
 	}
 
 	return nil
 }
 
-func (p *ParentController) SendVideoFrame(data []byte, timestampNano int64) error {
+// SendVideoFrame sends one I420 frame. timestampNano is the presentation time
+// relative to the media clock zero, see MediaSamplePayload.
+func (p *ParentController) SendVideoFrame(ctx context.Context, data []byte, timestampNano int64) error {
+	return p.SendVideoFrameFormat(ctx, data, media.PixelI420, timestampNano)
+}
+
+// SendVideoFrameFormat sends one frame in the given pixel format, with rows
+// packed at the configured width.
+func (p *ParentController) SendVideoFrameFormat(ctx context.Context, data []byte, format media.PixelFormat, timestampNano int64) error {
+	pixelFormat, err := ipcPixelFormat(format)
+	if err != nil {
+		return err
+	}
+	// The child reads frames at the configured size without chroma padding
+	if err := format.CheckSize(p.videoWidth, p.videoHeight); err != nil {
+		return err
+	}
+
 	// First create the MediaSamplePayload
 	innerBuilder := flatbuffers.NewBuilder(len(data) + 64)
 	
@@ -312,6 +1110,7 @@ func (p *ParentController) SendVideoFrame(data []byte, timestampNano int64) erro
 	ipcgen.MediaSamplePayloadStart(innerBuilder)
 	ipcgen.MediaSamplePayloadAddData(innerBuilder, dataOffset)
 	ipcgen.MediaSamplePayloadAddTimestampUnixNano(innerBuilder, timestampNano)
+	ipcgen.MediaSamplePayloadAddPixelFormat(innerBuilder, pixelFormat)
 	mediaSampleOffset := ipcgen.MediaSamplePayloadEnd(innerBuilder)
 	innerBuilder.Finish(mediaSampleOffset)
 	
@@ -336,12 +1135,94 @@ func (p *ParentController) SendVideoFrame(data []byte, timestampNano int64) erro
 	msg := ipcgen.IPCMessageEnd(outerBuilder)
 	outerBuilder.Finish(msg)
 	
-	return p.sendMessage(outerBuilder.FinishedBytes())
+	return p.sendMessage(ctx, outerBuilder.FinishedBytes())
 }
 
-func (p *ParentController) SendAudioFrame(data []byte, timestampNano int64) error {
-	// First create the MediaSamplePayload
-	innerBuilder := flatbuffers.NewBuilder(len(data) + 64)
+// SendEncodedVideoFrame sends one compressed frame to a child publishing
+// encoded video. key marks frames that decode on their own.
+func (p *ParentController) SendEncodedVideoFrame(ctx context.Context, data []byte, format media.EncodedVideoFormat, key bool, timestampNano int64) error {
+	codec, err := ipcVideoCodec(format.Codec)
+	if err != nil {
+		return err
+	}
+
+	// First create the EncodedVideoSamplePayload
+	innerBuilder := flatbuffers.NewBuilder(len(data) + 64)
+
+	// Create data vector for EncodedVideoSamplePayload
+	ipcgen.EncodedVideoSamplePayloadStartDataVector(innerBuilder, len(data))
+	for i := len(data) - 1; i >= 0; i-- {
+		innerBuilder.PrependByte(data[i])
+	}
+	dataOffset := innerBuilder.EndVector(len(data))
+
+	// Create EncodedVideoSamplePayload
+	ipcgen.EncodedVideoSamplePayloadStart(innerBuilder)
+	ipcgen.EncodedVideoSamplePayloadAddData(innerBuilder, dataOffset)
+	ipcgen.EncodedVideoSamplePayloadAddCodec(innerBuilder, codec)
+	ipcgen.EncodedVideoSamplePayloadAddKeyFrame(innerBuilder, key)
+	ipcgen.EncodedVideoSamplePayloadAddWidth(innerBuilder, int32(format.Width))
+	ipcgen.EncodedVideoSamplePayloadAddHeight(innerBuilder, int32(format.Height))
+	ipcgen.EncodedVideoSamplePayloadAddFrameRate(innerBuilder, int32(roundEncodedFrameRate(format)))
+	ipcgen.EncodedVideoSamplePayloadAddTimestampNano(innerBuilder, timestampNano)
+	sampleOffset := ipcgen.EncodedVideoSamplePayloadEnd(innerBuilder)
+	innerBuilder.Finish(sampleOffset)
+
+	// Get the serialized EncodedVideoSamplePayload bytes
+	sampleBytes := innerBuilder.FinishedBytes()
+
+	// Now create the outer IPCMessage with the EncodedVideoSamplePayload bytes as payload
+	outerBuilder := flatbuffers.NewBuilder(len(sampleBytes) + 64)
+
+	// Create payload vector for IPCMessage
+	ipcgen.IPCMessageStartPayloadVector(outerBuilder, len(sampleBytes))
+	for i := len(sampleBytes) - 1; i >= 0; i-- {
+		outerBuilder.PrependByte(sampleBytes[i])
+	}
+	payloadOffset := outerBuilder.EndVector(len(sampleBytes))
+
+	// Create IPCMessage
+	ipcgen.IPCMessageStart(outerBuilder)
+	ipcgen.IPCMessageAddMessageType(outerBuilder, ipcgen.MessageTypeWRITE_ENCODED_VIDEO_COMMAND)
+	ipcgen.IPCMessageAddPayloadType(outerBuilder, ipcgen.MessagePayloadEncodedVideoSample)
+	ipcgen.IPCMessageAddPayload(outerBuilder, payloadOffset)
+	msg := ipcgen.IPCMessageEnd(outerBuilder)
+	outerBuilder.Finish(msg)
+
+	return p.sendMessage(ctx, outerBuilder.FinishedBytes())
+}
+
+func ipcVideoCodec(codec media.VideoCodec) (ipcgen.VideoCodec, error) {
+	switch codec {
+	case media.CodecH264:
+		return ipcgen.VideoCodecH264, nil
+	case media.CodecVP8:
+		return ipcgen.VideoCodecVP8, nil
+	case media.CodecAV1:
+		return ipcgen.VideoCodecAV1, nil
+	}
+	return 0, fmt.Errorf("unsupported video codec %s", codec)
+}
+
+func ipcPixelFormat(format media.PixelFormat) (ipcgen.PixelFormat, error) {
+	switch format {
+	case media.PixelI420:
+		return ipcgen.PixelFormatI420, nil
+	case media.PixelNV12:
+		return ipcgen.PixelFormatNV12, nil
+	case media.PixelRGBA:
+		return ipcgen.PixelFormatRGBA, nil
+	case media.PixelBGRA:
+		return ipcgen.PixelFormatBGRA, nil
+	}
+	return 0, fmt.Errorf("unsupported pixel format %s", format)
+}
+
+// SendAudioFrame sends PCM16 audio. timestampNano is the presentation time of
+// its first sample relative to the media clock zero, see MediaSamplePayload.
+func (p *ParentController) SendAudioFrame(ctx context.Context, data []byte, timestampNano int64) error {
+	// First create the MediaSamplePayload
+	innerBuilder := flatbuffers.NewBuilder(len(data) + 64)
 	
 	// Create data vector for MediaSamplePayload
 	ipcgen.MediaSamplePayloadStartDataVector(innerBuilder, len(data))
@@ -378,219 +1259,961 @@ func (p *ParentController) SendAudioFrame(data []byte, timestampNano int64) erro
 	msg := ipcgen.IPCMessageEnd(outerBuilder)
 	outerBuilder.Finish(msg)
 	
-	return p.sendMessage(outerBuilder.FinishedBytes())
+	return p.sendMessage(ctx, outerBuilder.FinishedBytes())
+}
+
+// SendEncodedAudioFrame sends one compressed frame to a child publishing
+// encoded audio. Every frame lasts format.SamplesPerFrame samples.
+func (p *ParentController) SendEncodedAudioFrame(ctx context.Context, data []byte, format media.EncodedAudioFormat, timestampNano int64) error {
+	codec, err := ipcAudioCodec(format.Codec)
+	if err != nil {
+		return err
+	}
+
+	// First create the EncodedAudioSamplePayload
+	innerBuilder := flatbuffers.NewBuilder(len(data) + 64)
+
+	// Create data vector for EncodedAudioSamplePayload
+	ipcgen.EncodedAudioSamplePayloadStartDataVector(innerBuilder, len(data))
+	for i := len(data) - 1; i >= 0; i-- {
+		innerBuilder.PrependByte(data[i])
+	}
+	dataOffset := innerBuilder.EndVector(len(data))
+
+	// Create EncodedAudioSamplePayload
+	ipcgen.EncodedAudioSamplePayloadStart(innerBuilder)
+	ipcgen.EncodedAudioSamplePayloadAddData(innerBuilder, dataOffset)
+	ipcgen.EncodedAudioSamplePayloadAddCodec(innerBuilder, codec)
+	ipcgen.EncodedAudioSamplePayloadAddSampleRate(innerBuilder, int32(format.SampleRate))
+	ipcgen.EncodedAudioSamplePayloadAddChannels(innerBuilder, int32(format.Channels))
+	ipcgen.EncodedAudioSamplePayloadAddSamplesPerChannel(innerBuilder, int32(format.SamplesPerFrame))
+	ipcgen.EncodedAudioSamplePayloadAddTimestampNano(innerBuilder, timestampNano)
+	sampleOffset := ipcgen.EncodedAudioSamplePayloadEnd(innerBuilder)
+	innerBuilder.Finish(sampleOffset)
+
+	// Get the serialized EncodedAudioSamplePayload bytes
+	sampleBytes := innerBuilder.FinishedBytes()
+
+	// Now create the outer IPCMessage with the EncodedAudioSamplePayload bytes as payload
+	outerBuilder := flatbuffers.NewBuilder(len(sampleBytes) + 64)
+
+	// Create payload vector for IPCMessage
+	ipcgen.IPCMessageStartPayloadVector(outerBuilder, len(sampleBytes))
+	for i := len(sampleBytes) - 1; i >= 0; i-- {
+		outerBuilder.PrependByte(sampleBytes[i])
+	}
+	payloadOffset := outerBuilder.EndVector(len(sampleBytes))
+
+	// Create IPCMessage
+	ipcgen.IPCMessageStart(outerBuilder)
+	ipcgen.IPCMessageAddMessageType(outerBuilder, ipcgen.MessageTypeWRITE_ENCODED_AUDIO_COMMAND)
+	ipcgen.IPCMessageAddPayloadType(outerBuilder, ipcgen.MessagePayloadEncodedAudioSample)
+	ipcgen.IPCMessageAddPayload(outerBuilder, payloadOffset)
+	msg := ipcgen.IPCMessageEnd(outerBuilder)
+	outerBuilder.Finish(msg)
+
+	return p.sendMessage(ctx, outerBuilder.FinishedBytes())
+}
+
+func ipcAudioCodec(codec media.AudioCodec) (ipcgen.AudioCodec, error) {
+	switch codec {
+	case media.CodecOpus:
+		return ipcgen.AudioCodecOPUS, nil
+	case media.CodecAAC:
+		return ipcgen.AudioCodecAAC_LC, nil
+	}
+	return 0, fmt.Errorf("unsupported audio codec %s", codec)
 }
 
-func (p *ParentController) SendCloseCommand() error {
-	builder := flatbuffers.NewBuilder(64)
+// SendCloseCommand asks the child to leave the channel and exit. A non-empty
+// reason is sent along in a ClosePayload for the child to log.
+func (p *ParentController) SendCloseCommand(ctx context.Context, reason string) error {
+	return p.sendMessage(ctx, newCloseCommand(reason))
+}
+
+// SendInterruptCommand makes the child drop the media it has queued and the
+// SDK's pending audio. Audio due within fade is faded out.
+func (p *ParentController) SendInterruptCommand(ctx context.Context, fade time.Duration) error {
+	// First create the InterruptPayload
+	innerBuilder := flatbuffers.NewBuilder(64)
+	ipcgen.InterruptPayloadStart(innerBuilder)
+	ipcgen.InterruptPayloadAddFadeOutMs(innerBuilder, int32(fade/time.Millisecond))
+	interruptOffset := ipcgen.InterruptPayloadEnd(innerBuilder)
+	innerBuilder.Finish(interruptOffset)
+
+	// Get the serialized InterruptPayload bytes
+	interruptBytes := innerBuilder.FinishedBytes()
+
+	// Now create the outer IPCMessage with the InterruptPayload bytes as payload
+	outerBuilder := flatbuffers.NewBuilder(len(interruptBytes) + 64)
+
+	// Create payload vector for IPCMessage
+	ipcgen.IPCMessageStartPayloadVector(outerBuilder, len(interruptBytes))
+	for i := len(interruptBytes) - 1; i >= 0; i-- {
+		outerBuilder.PrependByte(interruptBytes[i])
+	}
+	payloadOffset := outerBuilder.EndVector(len(interruptBytes))
 
-	// Create empty payload vector
-	ipcgen.IPCMessageStartPayloadVector(builder, 0)
-	payloadOffset := builder.EndVector(0)
+	// Create IPCMessage
+	ipcgen.IPCMessageStart(outerBuilder)
+	ipcgen.IPCMessageAddMessageType(outerBuilder, ipcgen.MessageTypeINTERRUPT_COMMAND)
+	ipcgen.IPCMessageAddPayloadType(outerBuilder, ipcgen.MessagePayloadInterrupt)
+	ipcgen.IPCMessageAddPayload(outerBuilder, payloadOffset)
+	msg := ipcgen.IPCMessageEnd(outerBuilder)
+	outerBuilder.Finish(msg)
 
-	ipcgen.IPCMessageStart(builder)
-	ipcgen.IPCMessageAddMessageType(builder, ipcgen.MessageTypeCLOSE_COMMAND)
-	ipcgen.IPCMessageAddPayloadType(builder, ipcgen.MessagePayloadNONE)
-	ipcgen.IPCMessageAddPayload(builder, payloadOffset)
-	msg := ipcgen.IPCMessageEnd(builder)
-	builder.Finish(msg)
+	return p.sendMessage(ctx, outerBuilder.FinishedBytes())
+}
 
-	return p.sendMessage(builder.FinishedBytes())
+// Interrupt cuts off the media being published, e.g. when a user barges in
+// on speech. Audio sources that queue ahead of playback (media.Clearer)
+// drop what they have not sent yet, and the child drops what it has queued.
+// It returns how much audio the source dropped.
+func (p *ParentController) Interrupt(ctx context.Context) (time.Duration, error) {
+	var dropped time.Duration
+	for _, source := range []interface{}{p.opts.AudioSource, p.opts.EncodedAudioSource} {
+		if clearer, ok := source.(media.Clearer); ok {
+			dropped += clearer.Clear()
+		}
+	}
+	// Nothing reaches the child while it is not connected
+	if !p.conn.Streamable() {
+		return dropped, nil
+	}
+	if err := p.SendInterruptCommand(ctx, p.opts.InterruptFade); err != nil {
+		return dropped, fmt.Errorf("failed to send interrupt command: %v", err)
+	}
+	return dropped, nil
 }
 
-func (p *ParentController) Stop() {
-	p.logger.Println("Stopping child process...")
+type ShutdownResult int
+
+const (
+	// ShutdownClean means the child acknowledged CLOSE after leaving the
+	// channel and then exited on its own.
+	ShutdownClean ShutdownResult = iota
+	// ShutdownForced means the child did not acknowledge CLOSE or did not
+	// exit in time and had to be killed.
+	ShutdownForced
+	// ShutdownChildDead means there was no running child to shut down.
+	ShutdownChildDead
+)
 
-	// Send close command
-	if err := p.SendCloseCommand(); err != nil {
-		p.logger.Printf("Error sending close command: %v", err)
+func (r ShutdownResult) String() string {
+	switch r {
+	case ShutdownClean:
+		return "clean"
+	case ShutdownForced:
+		return "forced"
+	case ShutdownChildDead:
+		return "child already dead"
 	}
+	return fmt.Sprintf("ShutdownResult(%d)", int(r))
+}
 
-	// Give child time to clean up
-	time.Sleep(1 * time.Second)
+// Stop shuts the child down in order: it sends CLOSE, waits for the child to
+// acknowledge with DISCONNECTED once its Agora resources are released, closes
+// stdin and waits for the process to exit, killing it if any step times out
+// or ctx is done. Only the first call shuts down, later ones wait for it and
+// return its result.
+func (p *ParentController) Stop(ctx context.Context) ShutdownResult {
+	result := p.stop(ctx, "")
 
-	// Close stdin to signal EOF
-	if p.stdin != nil {
-		p.stdin.Close()
+	// Wait for goroutines
+	p.wg.Wait()
+	return result
+}
+
+// stop is Stop with a reason for the child, e.g. ErrIdleTimeout. Unlike
+// Stop it does not wait for the controller's goroutines, so they can call it.
+func (p *ParentController) stop(ctx context.Context, reason string) ShutdownResult {
+	p.stopOnce.Do(func() {
+		p.stopResult = p.shutdown(ctx, reason)
+	})
+	return p.stopResult
+}
+
+func (p *ParentController) shutdown(ctx context.Context, reason string) ShutdownResult {
+	if reason != "" {
+		p.logger.Printf("Stopping child process: %s", reason)
+	} else {
+		p.logger.Println("Stopping child process...")
 	}
 
-	// Wait for child to exit or timeout
-	done := make(chan error, 1)
-	go func() {
-		done <- p.cmd.Wait()
-	}()
+	// Stop supervising so the child is not restarted while shutting down
+	p.cancel()
+	if p.supervisorDone != nil {
+		<-p.supervisorDone
+	}
+
+	p.mu.Lock()
+	child := p.child
+	p.mu.Unlock()
+
+	result := p.shutdownChild(ctx, child, reason)
+	p.logger.Printf("Parent controller stopped, shutdown was %s", result)
+	return result
+}
 
+func (p *ParentController) shutdownChild(ctx context.Context, child *childProcess, reason string) ShutdownResult {
+	if child == nil {
+		return ShutdownChildDead
+	}
 	select {
-	case err := <-done:
-		if err != nil {
-			p.logger.Printf("Child process exited with error: %v", err)
+	case <-child.done:
+		p.logger.Printf("Child process had already exited: %v", child.exitErr)
+		return ShutdownChildDead
+	default:
+	}
+
+	result := ShutdownClean
+
+	// Send close command and wait for the child to leave the channel
+	if err := p.SendCloseCommand(ctx, reason); err != nil {
+		p.logger.Printf("Error sending close command: %v", err)
+		result = ShutdownForced
+	} else {
+		select {
+		case <-child.closeAck:
+			p.logger.Println("Child acknowledged close command")
+		case <-child.done:
+			p.logger.Println("Child exited without acknowledging close command")
+			result = ShutdownForced
+		case <-time.After(p.opts.CloseAckTimeout):
+			p.logger.Printf("Child did not acknowledge close command within %v", p.opts.CloseAckTimeout)
+			result = ShutdownForced
+		case <-ctx.Done():
+			p.logger.Printf("Stopped waiting for close acknowledgement: %v", ctx.Err())
+			result = ShutdownForced
+		}
+	}
+
+	// Close stdin to signal EOF
+	child.stdin.Close()
+
+	// Wait for child to exit or timeout
+	select {
+	case <-child.done:
+		if child.exitErr != nil {
+			p.logger.Printf("Child process exited with error: %v", child.exitErr)
 		} else {
 			p.logger.Println("Child process exited cleanly")
 		}
-	case <-time.After(5 * time.Second):
+	case <-time.After(p.opts.ExitTimeout):
 		p.logger.Println("Child process didn't exit in time, killing...")
-		p.cmd.Process.Kill()
-		<-done
+		child.cmd.Process.Kill()
+		<-child.done
+		result = ShutdownForced
+	case <-ctx.Done():
+		p.logger.Printf("Stopped waiting for child to exit (%v), killing...", ctx.Err())
+		child.cmd.Process.Kill()
+		<-child.done
+		result = ShutdownForced
 	}
-
-	// Wait for goroutines
-	p.wg.Wait()
-	p.logger.Println("Parent controller stopped")
+	return result
 }
 
-func (p *ParentController) StreamAudio(stopChan <-chan struct{}) {
+func (p *ParentController) StreamAudio(ctx context.Context) {
+	ctx, cancel := p.streamContext(ctx)
+	defer cancel()
+	if p.opts.EncodedAudioSource != nil {
+		p.streamEncodedAudio(ctx, p.opts.EncodedAudioSource)
+		return
+	}
 	defer p.logger.Println("Audio streaming stopped")
 
-	file, err := os.Open(p.audioFile)
-	if err != nil {
-		p.logger.Printf("Failed to open audio file %s: %v", p.audioFile, err)
-		return
+	source := p.opts.AudioSource
+	if source == nil {
+		file, err := p.openAudioFiles()
+		if err != nil {
+			p.logger.Printf("%v", err)
+			return
+		}
+		defer file.Close()
+		source = file
 	}
-	defer file.Close()
 
-	// Calculate frame size for 10ms of audio (PCM16)
-	samplesPerFrame := p.sampleRate / 100 // 10ms
-	frameSize := samplesPerFrame * p.audioChannels * 2 // 2 bytes per sample for PCM16
-	frameBuf := make([]byte, frameSize)
+	// The child's audio track is configured from the options, so convert
+	// sources in any other format
+	format := media.AudioFormat{SampleRate: p.sampleRate, Channels: p.audioChannels}
+	if sourceFormat := source.AudioFormat(); sourceFormat != format {
+		converted, err := media.ConvertAudio(source, format, p.opts.ResampleQuality)
+		if err != nil {
+			p.logger.Printf("Cannot convert audio source from %s to %s: %v", sourceFormat, format, err)
+			return
+		}
+		p.logger.Printf("Converting audio source from %s to %s (%s quality)", sourceFormat, format, p.opts.ResampleQuality)
+		source = converted
+	}
+	frameSize := format.FrameSize()
+
+	p.pace(ctx, pacedStream{
+		name: "audio",
+		// 100 frames per second (10ms) on the shared media clock
+		schedule: p.clock.NewSchedule("audio", int(time.Second/media.AudioFrameDuration), 1),
+		frames:   "audio frames",
+		skip: func(ctx context.Context, n int64) error {
+			return media.SkipAudio(ctx, source, n)
+		},
+		send: func(ctx context.Context, pts time.Duration) (bool, error) {
+			frame, err := source.ReadAudio(ctx)
+			if err != nil {
+				return false, err
+			}
+			if len(frame.Data) != frameSize {
+				p.logger.Printf("Dropping audio frame of %d bytes, expected %d", len(frame.Data), frameSize)
+				return false, nil
+			}
+			if err := p.SendAudioFrame(ctx, frame.Data, int64(pts)); err != nil {
+				p.logger.Printf("Error sending audio frame: %v", err)
+			}
+			return true, nil
+		},
+	})
+}
 
-	// Calculate frame interval (10ms)
-	frameInterval := time.Duration(10) * time.Millisecond
-	ticker := time.NewTicker(frameInterval)
-	defer ticker.Stop()
+func (p *ParentController) StreamVideo(ctx context.Context) {
+	ctx, cancel := p.streamContext(ctx)
+	defer cancel()
+	if p.opts.EncodedVideoSource != nil {
+		p.streamEncodedVideo(ctx, p.opts.EncodedVideoSource)
+		return
+	}
+	defer p.logger.Println("Video streaming stopped")
 
-	frameCount := 0
-	startTime := time.Now()
+	source := p.opts.VideoSource
+	if source == nil {
+		file, err := p.openVideoFiles()
+		if err != nil {
+			p.logger.Printf("%v", err)
+			return
+		}
+		defer file.Close()
+		source = file
+	}
 
-	for {
-		select {
-		case <-stopChan:
+	// The encoder is configured from the options, so scale sources of any
+	// other size
+	format := source.VideoFormat()
+	if format.Width != p.videoWidth || format.Height != p.videoHeight {
+		target := media.VideoFormat{Width: p.videoWidth, Height: p.videoHeight}
+		converted, err := media.ConvertVideo(source, target, p.opts.VideoConvert)
+		if err != nil {
+			p.logger.Printf("Cannot convert video source from %s to %dx%d: %v", format, p.videoWidth, p.videoHeight, err)
 			return
-		case <-ticker.C:
-			// Check if connected
-			p.mu.Lock()
-			connected := p.isConnected
-			p.mu.Unlock()
-			
-			if !connected {
-				continue
+		}
+		source = converted
+		p.logger.Printf("Converting video source from %s to %s (%s)", format, source.VideoFormat(), p.opts.VideoConvert)
+		format = source.VideoFormat()
+	}
+	if roundFrameRate(format) != p.frameRate {
+		p.logger.Printf("WARN: Video source runs at %s but the encoder is configured for %dfps", format, p.frameRate)
+	}
+	frameSize := format.FrameSize()
+
+	p.logger.Printf("Starting video stream: %s codec, %s, frame size: %d bytes",
+		p.videoCodec, format, frameSize)
+
+	p.pace(ctx, pacedStream{
+		name:     "video",
+		schedule: p.clock.NewSchedule("video", format.FrameRateNum, format.FrameRateDen),
+		frames:   p.videoCodec + " video frames",
+		skip: func(ctx context.Context, n int64) error {
+			return media.SkipVideo(ctx, source, n)
+		},
+		send: func(ctx context.Context, pts time.Duration) (bool, error) {
+			frame, err := source.ReadVideo(ctx)
+			if err != nil {
+				return false, err
 			}
+			if len(frame.Data) != frameSize {
+				p.logger.Printf("Dropping video frame of %d bytes, expected %d", len(frame.Data), frameSize)
+				return false, nil
+			}
+			if err := p.SendVideoFrameFormat(ctx, frame.Data, format.Pixel, int64(pts)); err != nil {
+				p.logger.Printf("Error sending video frame: %v", err)
+			}
+			return true, nil
+		},
+	})
+}
+
+// streamEncodedVideo sends compressed frames on the media clock. Frames
+// depend on the ones before them, so after frames were skipped or could not
+// be sent, everything up to the next key frame is dropped.
+func (p *ParentController) streamEncodedVideo(ctx context.Context, source media.EncodedVideoSource) {
+	defer p.logger.Println("Video streaming stopped")
 
-			// Read frame from file
-			n, err := file.Read(frameBuf)
+	// Encoded frames cannot be scaled, the child publishes them as they are
+	format := source.EncodedVideoFormat()
+	if format.Width != p.videoWidth || format.Height != p.videoHeight || format.Codec.String() != p.videoCodec {
+		p.logger.Printf("WARN: Encoded video source is %s but the child is configured for %s %dx%d", format, p.videoCodec, p.videoWidth, p.videoHeight)
+	}
+
+	p.logger.Printf("Starting encoded video stream: %s", format)
+
+	waitingFrames := 0
+	needKey := true
+	p.pace(ctx, pacedStream{
+		name:     "video",
+		schedule: p.clock.NewSchedule("video", format.FrameRateNum, format.FrameRateDen),
+		frames:   "encoded video frames",
+		// A restarted child has to start from a key frame
+		resumed: func() { needKey = true },
+		skip: func(ctx context.Context, n int64) error {
+			needKey = true
+			return media.SkipEncodedVideo(ctx, source, n)
+		},
+		send: func(ctx context.Context, pts time.Duration) (bool, error) {
+			frame, err := source.ReadEncodedVideo(ctx)
 			if err != nil {
-				if err == io.EOF {
-					// Loop back to beginning
-					file.Seek(0, 0)
-					continue
-				}
-				p.logger.Printf("Error reading audio file: %v", err)
-				return
+				return false, err
+			}
+			if needKey && !frame.Key {
+				waitingFrames++
+				return false, nil
+			}
+			if needKey && waitingFrames > 0 {
+				p.logger.Printf("Resumed encoded video at a key frame after dropping %d frames", waitingFrames)
 			}
+			needKey, waitingFrames = false, 0
 
-			if n != frameSize {
-				// Partial frame at end of file, loop back
-				file.Seek(0, 0)
-				continue
+			if err := p.SendEncodedVideoFrame(ctx, frame.Data, format, frame.Key, int64(pts)); err != nil {
+				p.logger.Printf("Error sending video frame: %v", err)
+				needKey = true
 			}
+			return true, nil
+		},
+	})
+}
+
+// streamEncodedAudio sends compressed frames on the media clock. Every frame
+// decodes on its own, so skipped frames are simply dropped.
+func (p *ParentController) streamEncodedAudio(ctx context.Context, source media.EncodedAudioSource) {
+	defer p.logger.Println("Audio streaming stopped")
+
+	// Encoded frames cannot be resampled, the child publishes them as they are
+	format := source.EncodedAudioFormat()
+	if format.SampleRate != p.sampleRate || format.Channels != p.audioChannels {
+		p.logger.Printf("WARN: Encoded audio source is %s but the child is configured for %dHz %dch", format, p.sampleRate, p.audioChannels)
+	}
 
-			// Send audio frame
-			timestamp := time.Since(startTime).Nanoseconds()
-			if err := p.SendAudioFrame(frameBuf, timestamp); err != nil {
+	p.logger.Printf("Starting encoded audio stream: %s", format)
+
+	p.pace(ctx, pacedStream{
+		name:     "audio",
+		schedule: p.clock.NewSchedule("audio", format.SampleRate, format.SamplesPerFrame),
+		frames:   "encoded audio frames",
+		skip: func(ctx context.Context, n int64) error {
+			return media.SkipEncodedAudio(ctx, source, n)
+		},
+		send: func(ctx context.Context, pts time.Duration) (bool, error) {
+			frame, err := source.ReadEncodedAudio(ctx)
+			if err != nil {
+				return false, err
+			}
+			if err := p.SendEncodedAudioFrame(ctx, frame.Data, format, int64(pts)); err != nil {
 				p.logger.Printf("Error sending audio frame: %v", err)
 			}
+			return true, nil
+		},
+	})
+}
 
-			frameCount++
-			if frameCount%100 == 0 { // Log every second
-				p.logger.Printf("Sent %d audio frames (%.2f seconds)", frameCount, float64(frameCount)/100.0)
+// pacedStream is one stream for pace.
+type pacedStream struct {
+	name     string // "audio" or "video"
+	schedule *media.Schedule
+	frames   string // what the progress log counts, e.g. "audio frames"
+
+	// skip discards frames from the source
+	skip func(ctx context.Context, n int64) error
+	// send reads the next frame and sends it at pts. It returns false for a
+	// frame it dropped, and io.EOF once the source has ended.
+	send func(ctx context.Context, pts time.Duration) (bool, error)
+	// resumed, if set, is called when streaming resumes after a pause
+	resumed func()
+}
+
+// pace sends the frames of a stream on the shared media clock until ctx is
+// done or its source ends.
+func (p *ParentController) pace(ctx context.Context, stream pacedStream) {
+	logEvery := int(time.Second / stream.schedule.FrameDuration())
+	if logEvery < 1 {
+		logEvery = 1
+	}
+	frameCount := 0
+
+	for {
+		// Frames are due at absolute points on the shared clock, so a slow
+		// send delays only this frame instead of shifting the whole stream
+		tick, err := stream.schedule.Next(ctx)
+		if err != nil {
+			return
+		}
+
+		// Pause while the child is not connected and resume once it is
+		if !p.conn.Streamable() {
+			p.logger.Printf("Paused %s streaming, connection state: %s", stream.name,
+				ipcgen.EnumNamesConnectionStatus[p.conn.State()])
+			if !p.conn.WaitStreamable(ctx) {
+				return
 			}
+			p.logger.Printf("Resumed %s streaming", stream.name)
+			if stream.resumed != nil {
+				stream.resumed()
+			}
+			// The next tick skips the frames that fell due while paused
+			continue
+		}
+
+		// Drop the frames the clock skipped so the source stays in step with the clock
+		if tick.Skipped > 0 {
+			if err := stream.skip(ctx, tick.Skipped); err != nil {
+				p.logger.Printf("Error skipping %s frames: %v", stream.name, err)
+				return
+			}
+		}
+
+		sent, err := stream.send(ctx, tick.PTS)
+		if err == io.EOF {
+			p.logger.Printf("End of the %s source after %d frames", stream.name, frameCount)
+			p.emitEvent(ControllerEvent{Type: EventEndOfMedia, Stream: stream.name})
+			return
+		}
+		if err != nil {
+			p.logger.Printf("Error reading %s source: %v", stream.name, err)
+			return
+		}
+		if !sent {
+			continue
+		}
+
+		frameCount++
+		if frameCount%logEvery == 0 { // Log every second
+			p.logger.Printf("Sent %d %s (%.2f seconds)", frameCount, stream.frames,
+				stream.schedule.PTS(int64(frameCount)).Seconds())
 		}
 	}
 }
 
-func (p *ParentController) StreamVideo(stopChan <-chan struct{}) {
-	defer p.logger.Println("Video streaming stopped")
+// streamContext returns a context for a stream that is also cancelled once
+// the controller stops, so streams end when it stops itself, e.g. on the
+// activity idle timeout.
+func (p *ParentController) streamContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(p.ctx, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// openAudioFiles opens AudioFile, a comma-separated playlist, as one source.
+// WAV files describe themselves, anything else is raw PCM16 in the
+// configured format.
+func (p *ParentController) openAudioFiles() (media.AudioSource, error) {
+	format := media.AudioFormat{SampleRate: p.sampleRate, Channels: p.audioChannels}
+	paths := splitPlaylist(p.audioFile)
+	if len(paths) == 1 {
+		return media.OpenAudioFile(paths[0], format, p.opts.PlayMode)
+	}
 
-	file, err := os.Open(p.videoFile)
+	items := make([]media.AudioSource, 0, len(paths))
+	closeItems := func() {
+		for _, item := range items {
+			item.Close()
+		}
+	}
+	for _, path := range paths {
+		file, err := media.OpenAudioFile(path, format, media.PlayOnce)
+		if err != nil {
+			closeItems()
+			return nil, err
+		}
+		// Items may come in different formats, the playlist needs one
+		item, err := media.ConvertAudio(file, format, p.opts.ResampleQuality)
+		if err != nil {
+			file.Close()
+			closeItems()
+			return nil, fmt.Errorf("cannot convert %s to %s: %v", path, format, err)
+		}
+		items = append(items, item)
+	}
+	playlist, err := media.NewAudioPlaylist(items, p.opts.PlayMode)
+	if err != nil {
+		closeItems()
+		return nil, err
+	}
+	return playlist, nil
+}
+
+// openVideoFiles opens VideoFile, a comma-separated playlist, as one source.
+// Y4M files describe themselves, anything else is raw I420 in the
+// configured format.
+func (p *ParentController) openVideoFiles() (media.VideoSource, error) {
+	format := media.VideoFormat{Width: p.videoWidth, Height: p.videoHeight, FrameRateNum: p.frameRate, FrameRateDen: 1, Pixel: p.opts.PixelFormat}
+	if p.opts.ImageFile != "" {
+		return media.OpenImageFile(p.opts.ImageFile, format, p.opts.VideoConvert)
+	}
+	paths := splitPlaylist(p.videoFile)
+	if len(paths) == 1 {
+		return p.openVideoFile(paths[0], format, p.opts.PlayMode)
+	}
+
+	items := make([]media.VideoSource, 0, len(paths))
+	closeItems := func() {
+		for _, item := range items {
+			item.Close()
+		}
+	}
+	for _, path := range paths {
+		item, err := p.openVideoFile(path, format, media.PlayOnce)
+		if err != nil {
+			closeItems()
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	playlist, err := media.NewVideoPlaylist(items, p.opts.PlayMode)
 	if err != nil {
-		p.logger.Printf("Failed to open video file %s: %v", p.videoFile, err)
+		closeItems()
+		return nil, err
+	}
+	return playlist, nil
+}
+
+// openVideoFile opens one video file and reports a trailing partial frame
+// of raw video, which is dropped.
+func (p *ParentController) openVideoFile(path string, format media.VideoFormat, mode media.PlayMode) (media.VideoSource, error) {
+	source, err := media.OpenVideoFile(path, format, mode)
+	if err != nil {
+		return nil, err
+	}
+	if raw, ok := source.(*media.RawVideoFile); ok && raw.IgnoredBytes() > 0 {
+		p.logger.Printf("WARN: %s ends with a partial frame, dropping its %d bytes (%s frames are %d bytes)",
+			path, raw.IgnoredBytes(), format.Pixel, format.FrameSize())
+	}
+	return source, nil
+}
+
+// splitPlaylist splits a comma-separated list of files.
+func splitPlaylist(files string) []string {
+	var paths []string
+	for _, path := range strings.Split(files, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			paths = append(paths, path)
+		}
+	}
+	if len(paths) == 0 {
+		// Let opening the empty path report the error
+		paths = append(paths, "")
+	}
+	return paths
+}
+
+// MediaClockStats returns the timing of each stream against the shared media clock.
+func (p *ParentController) MediaClockStats() media.ClockStats {
+	return p.clock.Stats()
+}
+
+func (p *ParentController) startClockReporter() {
+	if p.opts.ClockReportInterval <= 0 {
 		return
 	}
-	defer file.Close()
+	p.wg.Add(1)
+	go p.reportClock(p.ctx, p.opts.ClockReportInterval)
+}
 
-	// Calculate frame size for YUV420
-	ySize := p.videoWidth * p.videoHeight
-	uvSize := ySize / 4
-	frameSize := ySize + 2*uvSize // Y + U + V planes
-	frameBuf := make([]byte, frameSize)
+// reportClock periodically logs how far each stream lags the media clock
+// and the resulting audio/video offset.
+func (p *ParentController) reportClock(ctx context.Context, interval time.Duration) {
+	defer p.wg.Done()
 
-	// Calculate frame interval
-	frameInterval := time.Duration(1000/p.frameRate) * time.Millisecond
-	ticker := time.NewTicker(frameInterval)
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
-	frameCount := 0
-	startTime := time.Now()
-	
-	p.logger.Printf("Starting video stream: %s codec, %dx%d@%dfps, frame size: %d bytes", 
-		p.videoCodec, p.videoWidth, p.videoHeight, p.frameRate, frameSize)
-
 	for {
 		select {
-		case <-stopChan:
+		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			// Check if connected
-			p.mu.Lock()
-			connected := p.isConnected
-			p.mu.Unlock()
-			
-			if !connected {
+			stats := p.clock.Stats()
+			if len(stats.Streams) == 0 {
 				continue
 			}
+			p.logger.Printf("Media clock: %s, A/V offset %v", stats, stats.Drift("audio", "video"))
+		}
+	}
+}
 
-			// Read frame from file
-			n, err := file.Read(frameBuf)
-			if err != nil {
-				if err == io.EOF {
-					// Loop back to beginning
-					file.Seek(0, 0)
-					continue
+// RecordActivity resets the activity idle timeout, e.g. when voice audio
+// arrives. Remote users joining and stream messages count without it.
+func (p *ParentController) RecordActivity() {
+	select {
+	case p.activity <- struct{}{}:
+	default:
+	}
+}
+
+func (p *ParentController) startIdleTimer() {
+	if p.opts.ActivityIdleTimeout <= 0 {
+		return
+	}
+	p.wg.Add(1)
+	go p.watchIdle(p.ctx, p.opts.ActivityIdleTimeout)
+}
+
+// idleWarningLead is how long before the idle timeout expires it is warned
+// about, at most half the timeout.
+func idleWarningLead(timeout time.Duration) time.Duration {
+	const lead = 30 * time.Second
+	if timeout/2 < lead {
+		return timeout / 2
+	}
+	return lead
+}
+
+// watchIdle stops the child with ErrIdleTimeout once there was no activity
+// for timeout, after emitting EventIdleWarning ahead of it. The shutdown
+// also ends StreamAudio and StreamVideo.
+func (p *ParentController) watchIdle(ctx context.Context, timeout time.Duration) {
+	defer p.wg.Done()
+
+	warnAfter := timeout - idleWarningLead(timeout)
+	timer := time.NewTimer(warnAfter)
+	defer timer.Stop()
+	warned := false
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.activity:
+			if warned {
+				p.logger.Println("Activity resumed, idle timeout reset")
+				warned = false
+			}
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
 				}
-				p.logger.Printf("Error reading video file: %v", err)
-				return
 			}
-
-			if n != frameSize {
-				// Partial frame at end of file, loop back
-				file.Seek(0, 0)
+			timer.Reset(warnAfter)
+		case <-timer.C:
+			if !warned {
+				warned = true
+				p.logger.Printf("No activity for %v, stopping the child in %v unless there is activity", warnAfter, timeout-warnAfter)
+				p.emitEvent(ControllerEvent{Type: EventIdleWarning, Idle: warnAfter})
+				timer.Reset(timeout - warnAfter)
 				continue
 			}
-
-			// Send video frame
-			timestamp := time.Since(startTime).Nanoseconds()
-			if err := p.SendVideoFrame(frameBuf, timestamp); err != nil {
-				p.logger.Printf("Error sending video frame: %v", err)
+			p.logger.Printf("No activity for %v", timeout)
+			p.emitEvent(ControllerEvent{Type: EventIdleTimeout, Idle: timeout, Err: ErrIdleTimeout})
+			// ctx is cancelled by the shutdown, only its values are kept
+			stopCtx := context.WithoutCancel(ctx)
+			if p.opts.ShutdownTimeout > 0 {
+				var cancel context.CancelFunc
+				stopCtx, cancel = context.WithTimeout(stopCtx, p.opts.ShutdownTimeout)
+				defer cancel()
 			}
+			p.stop(stopCtx, ErrIdleTimeout.Error())
+			return
+		}
+	}
+}
 
-			frameCount++
-			if frameCount%(p.frameRate) == 0 { // Log every second
-				p.logger.Printf("Sent %d video frames (%.2f seconds) with %s codec", 
-					frameCount, float64(frameCount)/float64(p.frameRate), p.videoCodec)
-			}
+// roundFrameRate is the integer frame rate closest to the format's.
+func roundFrameRate(format media.VideoFormat) int {
+	return (format.FrameRateNum + format.FrameRateDen/2) / format.FrameRateDen
+}
+
+func roundEncodedFrameRate(format media.EncodedVideoFormat) int {
+	return (format.FrameRateNum + format.FrameRateDen/2) / format.FrameRateDen
+}
+
+// openEncodedVideoFile opens VideoFile as the EncodedVideoSource if it is an
+// IVF or Annex-B H.264 file, and takes the codec, size and frame rate from
+// it. Encoded video is published as it is, so explicit values must agree
+// with the file.
+func openEncodedVideoFile(opts *Options, explicit map[string]bool) error {
+	paths := splitPlaylist(opts.VideoFile)
+	isEncoded, err := media.IsEncodedVideoFile(paths[0])
+	if err != nil || !isEncoded {
+		// A missing file is reported when streaming starts
+		return nil
+	}
+	if len(paths) > 1 {
+		return fmt.Errorf("encoded video file %s cannot be part of a playlist", paths[0])
+	}
+
+	source, err := media.OpenEncodedVideoFile(paths[0], opts.FrameRate, opts.PlayMode)
+	if err != nil {
+		return err
+	}
+	format := source.EncodedVideoFormat()
+	if explicit["videoCodec"] && !strings.EqualFold(opts.VideoCodec, format.Codec.String()) {
+		source.Close()
+		return fmt.Errorf("-videoCodec=%s does not match the codec of %s (%s)", opts.VideoCodec, paths[0], format)
+	}
+	opts.VideoCodec = format.Codec.String()
+	err = applyHeaderFields(paths[0], format, explicit, []headerField{
+		{"width", &opts.VideoWidth, format.Width},
+		{"height", &opts.VideoHeight, format.Height},
+		{"frameRate", &opts.FrameRate, roundEncodedFrameRate(format)},
+	})
+	if err != nil {
+		source.Close()
+		return err
+	}
+	opts.EncodedVideoSource = source
+	return nil
+}
+
+// applyY4MHeader fills the video options from the header of a Y4M video
+// file. An explicit size is kept and the video is scaled to it; an explicit
+// frame rate must agree with the header.
+func applyY4MHeader(opts *Options, explicit map[string]bool) error {
+	// Playlist items must share the format of the first file
+	path := splitPlaylist(opts.VideoFile)[0]
+	isY4M, err := media.IsY4MFile(path)
+	if err != nil || !isY4M {
+		// A missing file is reported when streaming starts
+		return nil
+	}
+	header, err := media.ReadY4MHeader(path)
+	if err != nil {
+		return err
+	}
+
+	format := header.VideoFormat()
+	if !explicit["width"] && !explicit["height"] {
+		opts.VideoWidth, opts.VideoHeight = format.Width, format.Height
+	}
+	return applyHeaderFields(path, format, explicit, []headerField{
+		{"frameRate", &opts.FrameRate, roundFrameRate(format)},
+	})
+}
+
+// openEncodedAudioFile opens AudioFile as the EncodedAudioSource if it is an
+// Ogg/Opus or ADTS AAC file, and takes the sample rate and channels from it.
+// Encoded audio is published as it is, so explicit values must agree with
+// the file.
+func openEncodedAudioFile(opts *Options, explicit map[string]bool) error {
+	paths := splitPlaylist(opts.AudioFile)
+	isEncoded, err := media.IsEncodedAudioFile(paths[0])
+	if err != nil || !isEncoded {
+		// A missing file is reported when streaming starts
+		return nil
+	}
+	if len(paths) > 1 {
+		return fmt.Errorf("encoded audio file %s cannot be part of a playlist", paths[0])
+	}
+
+	source, err := media.OpenEncodedAudioFile(paths[0], opts.PlayMode)
+	if err != nil {
+		return err
+	}
+	format := source.EncodedAudioFormat()
+	err = applyHeaderFields(paths[0], format, explicit, []headerField{
+		{"sampleRate", &opts.SampleRate, format.SampleRate},
+		{"audioChannels", &opts.AudioChannels, format.Channels},
+	})
+	if err != nil {
+		source.Close()
+		return err
+	}
+	opts.EncodedAudioSource = source
+	return nil
+}
+
+// applyWAVHeader fills the audio options from the header of a WAV audio
+// file. Values set on the command line take precedence.
+func applyWAVHeader(opts *Options, explicit map[string]bool) error {
+	// Later playlist items are converted to the format of the first file
+	path := splitPlaylist(opts.AudioFile)[0]
+	isWAV, err := media.IsWAVFile(path)
+	if err != nil || !isWAV {
+		// A missing file is reported when streaming starts
+		return nil
+	}
+	header, err := media.ReadWAVHeader(path)
+	if err != nil {
+		return err
+	}
+
+	// Explicit values are the format to publish in; the file is converted to it.
+	// Rates like 22050Hz are published at a multiple that splits into 10ms frames
+	format := header.AudioFormat()
+	if !explicit["sampleRate"] {
+		opts.SampleRate = format.Framed().SampleRate
+	}
+	if !explicit["audioChannels"] {
+		opts.AudioChannels = format.Channels
+	}
+	return nil
+}
+
+// headerField is an option that a media file header can provide.
+type headerField struct {
+	flag  string
+	value *int
+	want  int
+}
+
+func applyHeaderFields(path string, format fmt.Stringer, explicit map[string]bool, fields []headerField) error {
+	for _, f := range fields {
+		if explicit[f.flag] && *f.value != f.want {
+			return fmt.Errorf("-%s=%d does not match the header of %s (%s)", f.flag, *f.value, path, format)
 		}
+		*f.value = f.want
 	}
+	return nil
+}
+
+// stringListFlag collects every occurrence of a repeatable flag.
+type stringListFlag []string
+
+func (f *stringListFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringListFlag) Set(value string) error {
+	if !strings.Contains(value, "=") {
+		return fmt.Errorf("expected KEY=VALUE, got %q", value)
+	}
+	*f = append(*f, value)
+	return nil
 }
 
 func main() {
 	opts := &Options{}
+	var connectTimeout time.Duration
+
+	// "parent serve [flags]" publishes ConvoAI voice sessions instead of the
+	// media files; it shares the flags below
+	serveMode := len(os.Args) > 1 && os.Args[1] == "serve"
+	if serveMode {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
 
 	// Parse command-line flags
 	flag.StringVar(&opts.AppID, "appID", "", "Agora App ID (required)")
 	flag.StringVar(&opts.ChannelName, "channelName", "test-channel", "Agora Channel Name")
 	flag.StringVar(&opts.UserID, "userID", "100", "Agora User ID")
 	flag.StringVar(&opts.Token, "token", "", "Agora Token (optional)")
-	flag.StringVar(&opts.AudioFile, "audioFile", "test_data/send_audio_16k_1ch.pcm", "Audio file path (PCM format)")
-	flag.StringVar(&opts.VideoFile, "videoFile", "test_data/send_video_cif.yuv", "Video file path (YUV420 format)")
+	flag.StringVar(&opts.AudioFile, "audioFile", "test_data/send_audio_16k_1ch.pcm", "Audio file path (WAV, Ogg/Opus or ADTS AAC, or headerless PCM16 matching -sampleRate/-audioChannels); a comma-separated list of PCM or WAV files is played as a playlist. Opus and AAC are published without re-encoding")
+	resampleQuality := flag.String("resampleQuality", "high", "Audio resampling quality when the audio file's format differs from -sampleRate/-audioChannels (low, medium, high)")
+	flag.StringVar(&opts.VideoFile, "videoFile", "test_data/send_video_cif.yuv", "Video file path (Y4M, or headerless YUV420 matching -width/-height/-frameRate); a comma-separated list is played as a playlist. IVF (VP8/AV1) and Annex-B H.264 (.h264) files are published without re-encoding")
+	videoFit := flag.String("videoFit", "letterbox", "How video of another size or aspect ratio is fitted: letterbox, crop, or stretch")
+	scaleFilter := flag.String("scaleFilter", "area", "Video scaling filter: area (averages when shrinking) or bilinear")
+	colorMatrix := flag.String("colorMatrix", "bt601", "RGB to YUV matrix for RGBA/BGRA sources that are converted: bt601 or bt709")
+	pixelFormat := flag.String("pixelFormat", "I420", "Pixel format of a headerless -videoFile: I420, NV12, RGBA or BGRA")
+	flag.StringVar(&opts.ImageFile, "image", "", "PNG or JPEG image to publish as still video at -width/-height/-frameRate instead of -videoFile, letterboxed to keep its aspect ratio")
+	testPattern := flag.Bool("testPattern", false, "Send generated SMPTE bars with a frame counter and a sine tone instead of the media files; a flash and a beep mark every -testPatternPeriod for A/V offset measurement")
+	testPatternPeriod := flag.Duration("testPatternPeriod", time.Second, "Interval between the synchronized flashes and beeps of -testPattern")
+	playMode := flag.String("playMode", "loop", "What to do at the end of the media files: loop, once, or pingpong (video plays back and forth, audio loops)")
 	flag.IntVar(&opts.SampleRate, "sampleRate", 16000, "Audio sample rate")
 	flag.IntVar(&opts.AudioChannels, "audioChannels", 1, "Audio channels")
 	flag.IntVar(&opts.VideoWidth, "width", 352, "Video width")
@@ -600,16 +2223,185 @@ func main() {
 	flag.IntVar(&opts.VideoBitrate, "bitrate", 1000, "Video target bitrate in Kbps")
 	flag.IntVar(&opts.MinVideoBitrate, "minBitrate", 100, "Video minimum bitrate in Kbps")
 	flag.BoolVar(&opts.EnableStringUID, "enableStringUID", true, "Enable string UID support in Agora SDK")
+	flag.IntVar(&opts.MaxRestarts, "maxRestarts", defaultMaxRestarts, "Maximum consecutive child restart attempts before giving up (negative disables restarts)")
+	flag.DurationVar(&opts.RestartBackoff, "restartBackoff", defaultRestartBackoff, "Initial delay before restarting a failed child")
+	flag.DurationVar(&opts.CloseAckTimeout, "closeAckTimeout", defaultCloseAckTimeout, "Maximum time to wait for the child to leave the channel on shutdown")
+	flag.DurationVar(&opts.WriteTimeout, "writeTimeout", 2*time.Second, "Maximum time a single IPC write to the child may block (0 disables)")
+	flag.DurationVar(&opts.ClockReportInterval, "clockReportInterval", 10*time.Second, "How often to log A/V timing against the media clock (0 disables)")
+	playoutDefaults := media.DefaultPlayoutConfig()
+	flag.DurationVar(&opts.PlayoutDelay, "playoutDelay", playoutDefaults.Delay, "Latency added by the child's playout buffer to absorb jitter")
+	flag.DurationVar(&opts.PlayoutMaxBuffer, "playoutMaxBuffer", playoutDefaults.MaxBuffered, "How far ahead of its presentation time the child buffers a sample")
+	flag.DurationVar(&opts.PlayoutMaxLate, "playoutMaxLate", playoutDefaults.MaxLate, "How late a sample may reach the child and still be played")
+	flag.DurationVar(&opts.ActivityIdleTimeout, "activityIdleTimeout", 0, "Stop once no remote user joined and no stream message arrived for this long (0 disables); serve sessions use their activity_idle_timeout instead, 120s by default")
+	flag.DurationVar(&opts.InterruptFade, "interruptFade", 20*time.Millisecond, "How long an interrupt fades out the audio about to be played instead of cutting it off")
+	flag.DurationVar(&opts.ExitTimeout, "exitTimeout", defaultExitTimeout, "Maximum time to wait for the child to exit before killing it")
+	flag.DurationVar(&opts.ShutdownTimeout, "shutdownTimeout", 20*time.Second, "Maximum time for a shutdown the parent starts itself, e.g. on the activity idle timeout (0 to disable)")
+	flag.StringVar(&opts.ChildBinary, "childBinary", "", "Path to the child binary (default: child next to the parent executable)")
+	flag.StringVar(&opts.ChildWorkDir, "childWorkDir", "", "Working directory for the child process (default: current directory)")
+	flag.Var((*stringListFlag)(&opts.ChildEnv), "childEnv", "Extra KEY=VALUE environment variable for the child (repeatable)")
+	flag.StringVar(&opts.SDKLibPath, "sdkLibPath", "", "Directory containing the Agora SDK libraries (default: agora_sdk next to the child binary)")
+	flag.StringVar(&opts.SDKLogPath, "sdkLogPath", "./agora_child_sdk.log", "Agora SDK log file for the child, relative to its working directory")
+	flag.DurationVar(&connectTimeout, "connectTimeout", 30*time.Second, "Maximum time to wait for the child to connect to Agora")
+	flag.DurationVar(&opts.RestartMaxBackoff, "restartMaxBackoff", defaultRestartMaxBackoff, "Maximum delay between child restart attempts")
+	flag.DurationVar(&opts.ConnectionLostGrace, "connectionLostGrace", defaultConnectionLostGrace, "How long the SDK may try to recover a lost connection before the child is restarted")
+	listenAddr := flag.String("listen", ":8765", "serve: address of the WebSocket server")
+	sessionToken := flag.String("sessionToken", "", "serve: static bearer token clients may present instead of a session API token")
+	apiKey := flag.String("apiKey", "", "serve: x-api-key for the session API (POST /session/start, DELETE /session/stop); empty disables the API")
+	websocketAddress := flag.String("websocketAddress", "", "serve: websocket_address returned by the session API (default: ws://<request host>/)")
+	maxVoiceBuffer := flag.Duration("maxVoiceBuffer", 5*time.Minute, "serve: how much voice audio a session may queue ahead of playback")
 
 	flag.Parse()
 
-	// Validate required parameters
-	if opts.AppID == "" {
+	// Validate required parameters; in serve mode the channel comes from
+	// each session
+	if serveMode && *sessionToken == "" && *apiKey == "" {
+		fmt.Println("Error: -apiKey or -sessionToken is required for serve")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if opts.AppID == "" && !serveMode {
 		fmt.Println("Error: -appID is required")
 		flag.Usage()
 		os.Exit(1)
 	}
 
+	quality, err := media.ParseResampleQuality(*resampleQuality)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	opts.ResampleQuality = quality
+
+	opts.PixelFormat, err = media.ParsePixelFormat(*pixelFormat)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	opts.VideoConvert.Fit, err = media.ParseFitMode(*videoFit)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	opts.VideoConvert.Filter, err = media.ParseScaleFilter(*scaleFilter)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	opts.VideoConvert.Matrix, err = media.ParseColorMatrix(*colorMatrix)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	opts.PlayMode, err = media.ParsePlayMode(*playMode)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if opts.PlayMode == media.PlayPingPong && (len(splitPlaylist(opts.AudioFile)) > 1 || len(splitPlaylist(opts.VideoFile)) > 1) {
+		fmt.Println("Error: -playMode pingpong cannot be used with playlists")
+		os.Exit(1)
+	}
+
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	var newVideoSource func(session *Options) error
+	if opts.ImageFile != "" && (*testPattern || explicit["videoFile"]) {
+		fmt.Println("Error: -image cannot be combined with -testPattern or -videoFile")
+		os.Exit(1)
+	}
+
+	if *testPattern {
+		// Generated media, in exactly the configured formats
+		if opts.VideoWidth <= 0 || opts.VideoHeight <= 0 || opts.VideoWidth%2 != 0 || opts.VideoHeight%2 != 0 {
+			fmt.Printf("Error: -testPattern needs an even frame size, got %dx%d\n", opts.VideoWidth, opts.VideoHeight)
+			os.Exit(1)
+		}
+		if opts.FrameRate <= 0 || opts.SampleRate <= 0 || opts.SampleRate%100 != 0 || opts.AudioChannels <= 0 {
+			fmt.Println("Error: -testPattern needs a positive -frameRate, a -sampleRate divisible by 100 and at least one audio channel")
+			os.Exit(1)
+		}
+		if *testPatternPeriod <= 0 {
+			fmt.Println("Error: -testPatternPeriod must be positive")
+			os.Exit(1)
+		}
+		patternConfig := media.DefaultTestPatternConfig()
+		patternConfig.Period = *testPatternPeriod
+		if patternConfig.FlashDuration > patternConfig.Period/2 {
+			patternConfig.FlashDuration = patternConfig.Period / 2
+		}
+		opts.VideoSource = media.NewTestPatternVideo(media.VideoFormat{
+			Width:        opts.VideoWidth,
+			Height:       opts.VideoHeight,
+			FrameRateNum: opts.FrameRate,
+			FrameRateDen: 1,
+		}, patternConfig)
+		opts.AudioSource = media.NewTestToneAudio(media.AudioFormat{SampleRate: opts.SampleRate, Channels: opts.AudioChannels}, patternConfig)
+		if serveMode {
+			// Every session gets its own generator
+			opts.VideoSource = nil
+			opts.AudioSource = nil
+			newVideoSource = func(session *Options) error {
+				session.VideoSource = media.NewTestPatternVideo(media.VideoFormat{
+					Width:        session.VideoWidth,
+					Height:       session.VideoHeight,
+					FrameRateNum: session.FrameRate,
+					FrameRateDen: 1,
+				}, patternConfig)
+				return nil
+			}
+		}
+	} else {
+		// Take the media formats from Y4M/WAV headers unless they were given
+		// explicitly; encoded video and audio dictate their own
+		if opts.ImageFile == "" {
+			if err := openEncodedVideoFile(opts, explicit); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		if opts.ImageFile == "" && opts.EncodedVideoSource == nil {
+			if err := applyY4MHeader(opts, explicit); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		if serveMode && opts.EncodedVideoSource != nil {
+			// Encoded video cannot be shared, every session reads the file
+			opts.EncodedVideoSource.Close()
+			opts.EncodedVideoSource = nil
+			newVideoSource = func(session *Options) error {
+				source, err := media.OpenEncodedVideoFile(session.VideoFile, session.FrameRate, session.PlayMode)
+				if err != nil {
+					return err
+				}
+				if codec := source.EncodedVideoFormat().Codec.String(); codec != session.VideoCodec {
+					source.Close()
+					return fmt.Errorf("video_encoding %s does not match the %s video of %s", session.VideoCodec, codec, session.VideoFile)
+				}
+				session.EncodedVideoSource = source
+				return nil
+			}
+		}
+		// Sessions publish their voice input instead of -audioFile
+		if !serveMode {
+			if err := openEncodedAudioFile(opts, explicit); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		if !serveMode && opts.EncodedAudioSource == nil {
+			if err := applyWAVHeader(opts, explicit); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			if format := (media.AudioFormat{SampleRate: opts.SampleRate}); !format.SplitsIntoFrames() {
+				fmt.Printf("Error: -sampleRate %d does not split into %v frames, use a rate divisible by 100\n", opts.SampleRate, media.AudioFrameDuration)
+				os.Exit(1)
+			}
+		}
+	}
+
 	// Validate codec selection
 	supportedCodecs := map[string]bool{
 		"H264": true,
@@ -636,6 +2428,41 @@ func main() {
 		}
 	}
 
+	if serveMode {
+		server := NewVoiceServer(*opts)
+		server.NewVideoSource = newVideoSource
+		server.ConnectTimeout = connectTimeout
+		server.MaxVoiceBuffer = *maxVoiceBuffer
+
+		var api *SessionAPI
+		if *apiKey != "" {
+			api = NewSessionAPI(*apiKey, server)
+			api.WebSocketAddress = *websocketAddress
+			server.IdleTimeout = api.IdleTimeout
+			server.Settings = api.Settings
+			server.SessionEnded = api.Remove
+		}
+		switch {
+		case api != nil && *sessionToken != "":
+			static := staticTokenAuth(*sessionToken)
+			server.Authenticate = func(token string) (string, bool) {
+				if sessionID, ok := api.Authenticate(token); ok {
+					return sessionID, true
+				}
+				return static(token)
+			}
+		case api != nil:
+			server.Authenticate = api.Authenticate
+		default:
+			server.Authenticate = staticTokenAuth(*sessionToken)
+		}
+		if err := serveVoice(server, api, *listenAddr); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Log configuration
 	fmt.Println("=====================================")
 	fmt.Println("Agora Video/Audio Publisher")
@@ -658,23 +2485,35 @@ func main() {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
+	ctx := context.Background()
+
 	// Start child process
-	if err := controller.Start(opts); err != nil {
+	startCtx, cancelStart := context.WithTimeout(ctx, connectTimeout)
+	err = controller.Start(startCtx, opts)
+	cancelStart()
+	if err != nil {
 		controller.logger.Fatalf("Failed to start child process: %v", err)
 	}
 
 	// Start streaming
-	stopChan := make(chan struct{})
+	streamCtx, stopStreaming := context.WithCancel(ctx)
 	var streamWg sync.WaitGroup
 
 	streamWg.Add(2)
 	go func() {
 		defer streamWg.Done()
-		controller.StreamAudio(stopChan)
+		controller.StreamAudio(streamCtx)
 	}()
 	go func() {
 		defer streamWg.Done()
-		controller.StreamVideo(stopChan)
+		controller.StreamVideo(streamCtx)
+	}()
+
+	// With -playMode once both streams end on their own
+	streamsDone := make(chan struct{})
+	go func() {
+		streamWg.Wait()
+		close(streamsDone)
 	}()
 
 	controller.logger.Printf("Streaming started with %s codec. Press Ctrl+C to stop.", opts.VideoCodec)
@@ -684,18 +2523,61 @@ func main() {
 	fmt.Printf("View stream at: https://webdemo.agora.io/basicVideoCall/index.html\n")
 	fmt.Printf("Use App ID: %s\n", opts.AppID)
 	fmt.Printf("Join Channel: %s\n", opts.ChannelName)
-	fmt.Println("=====================================\n")
+	fmt.Print("=====================================\n\n")
+
+	// Log supervision events and give up once the child can't be restarted
+	// or was stopped for inactivity
+	gaveUp := make(chan struct{})
+	idle := make(chan struct{})
+	go func() {
+		for event := range controller.Events() {
+			switch event.Type {
+			case EventEndOfMedia:
+				controller.logger.Printf("Controller event: %s (%s)", event.Type, event.Stream)
+				continue
+			case EventIdleWarning:
+				controller.logger.Printf("Controller event: %s (idle=%v)", event.Type, event.Idle)
+				continue
+			case EventIdleTimeout:
+				controller.logger.Printf("Controller event: %s (idle=%v)", event.Type, event.Idle)
+				close(idle)
+				return
+			}
+			controller.logger.Printf("Controller event: %s (attempt=%d, backoff=%v, err=%v)",
+				event.Type, event.Attempt, event.Backoff, event.Err)
+			if event.Type == EventRestartsExhausted {
+				close(gaveUp)
+				return
+			}
+		}
+	}()
 
 	// Wait for interrupt signal
-	<-sigChan
-	controller.logger.Println("Received interrupt signal, shutting down...")
+	select {
+	case <-sigChan:
+		controller.logger.Println("Received interrupt signal, shutting down...")
+	case <-gaveUp:
+		controller.logger.Println("Child could not be restarted, shutting down...")
+	case <-idle:
+		controller.logger.Println("No activity, shutting down...")
+	case <-streamsDone:
+		controller.logger.Println("All media has been played, shutting down...")
+	}
 
 	// Stop streaming
-	close(stopChan)
+	stopStreaming()
 	streamWg.Wait()
 
 	// Stop child process
-	controller.Stop()
+	if result := controller.Stop(ctx); result != ShutdownClean {
+		controller.logger.Printf("Child shutdown was not clean: %s", result)
+	}
+	if opts.EncodedVideoSource != nil {
+		opts.EncodedVideoSource.Close()
+	}
+	if opts.EncodedAudioSource != nil {
+		opts.EncodedAudioSource.Close()
+	}
 
 	controller.logger.Println("Parent process exited")
 }
@@ -0,0 +1,467 @@
+//go:build !child
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	flatbuffers "github.com/google/flatbuffers/go"
+	"go-publish-video/ipc/ipcgen"
+	"go-publish-video/media"
+)
+
+func TestRestartBackoff(t *testing.T) {
+	tests := []struct {
+		name    string
+		initial time.Duration
+		max     time.Duration
+		attempt int
+		want    time.Duration
+	}{
+		{"first attempt", time.Second, 30 * time.Second, 1, time.Second},
+		{"second attempt doubles", time.Second, 30 * time.Second, 2, 2 * time.Second},
+		{"fifth attempt", time.Second, 30 * time.Second, 5, 16 * time.Second},
+		{"capped", time.Second, 30 * time.Second, 6, 30 * time.Second},
+		{"stays capped", time.Second, 30 * time.Second, 100, 30 * time.Second},
+		{"reaches max exactly", time.Second, 4 * time.Second, 3, 4 * time.Second},
+		{"initial above max", time.Minute, 30 * time.Second, 1, 30 * time.Second},
+		{"initial above max, later attempt", time.Minute, 30 * time.Second, 3, 30 * time.Second},
+		{"zero initial uses the default", 0, 30 * time.Second, 4, 8 * defaultRestartBackoff},
+		{"zero max uses the default", time.Second, 0, 10, defaultRestartMaxBackoff},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewParentController(&Options{RestartBackoff: tt.initial, RestartMaxBackoff: tt.max})
+			if got := p.restartBackoff(tt.attempt); got != tt.want {
+				t.Errorf("restartBackoff(%d) = %v, want %v", tt.attempt, got, tt.want)
+			}
+		})
+	}
+}
+
+// Controllers built without the command line flags get the same restart and
+// shutdown policy as the parent binary.
+func TestNewParentControllerDefaults(t *testing.T) {
+	opts := &Options{}
+	p := NewParentController(opts)
+	if opts.MaxRestarts != defaultMaxRestarts || opts.CloseAckTimeout != defaultCloseAckTimeout || opts.ExitTimeout != defaultExitTimeout {
+		t.Errorf("defaults not applied: %+v", opts)
+	}
+	if got := p.restartBackoff(1); got != defaultRestartBackoff {
+		t.Errorf("restartBackoff(1) = %v, want %v", got, defaultRestartBackoff)
+	}
+
+	// Explicit values are kept, a negative MaxRestarts disables restarts
+	opts = &Options{MaxRestarts: -1, CloseAckTimeout: time.Second, ExitTimeout: 2 * time.Second}
+	NewParentController(opts)
+	if opts.MaxRestarts != -1 || opts.CloseAckTimeout != time.Second || opts.ExitTimeout != 2*time.Second {
+		t.Errorf("explicit values changed: %+v", opts)
+	}
+}
+
+func TestConnectionStateTransition(t *testing.T) {
+	const (
+		uninitialized  = ipcgen.ConnectionStatusUNINITIALIZED
+		initialized    = ipcgen.ConnectionStatusINITIALIZED_SUCCESS
+		initFailed     = ipcgen.ConnectionStatusINITIALIZED_FAILURE
+		connected      = ipcgen.ConnectionStatusCONNECTED
+		reconnecting   = ipcgen.ConnectionStatusRECONNECTING
+		reconnected    = ipcgen.ConnectionStatusRECONNECTED
+		connectionLost = ipcgen.ConnectionStatusCONNECTION_LOST
+		disconnected   = ipcgen.ConnectionStatusDISCONNECTED
+		failed         = ipcgen.ConnectionStatusFAILED
+	)
+	tests := []struct {
+		from, to ipcgen.ConnectionStatus
+		allowed  bool
+	}{
+		// Startup, CONNECTED may overtake INITIALIZED_SUCCESS
+		{uninitialized, initialized, true},
+		{uninitialized, connected, true},
+		{uninitialized, initFailed, true},
+		{initialized, connected, true},
+		{initFailed, disconnected, true},
+
+		// Reconnects
+		{connected, reconnecting, true},
+		{reconnecting, reconnected, true},
+		{reconnecting, connected, true},
+		{reconnected, reconnecting, true},
+		{connected, connectionLost, true},
+		{connectionLost, reconnected, true},
+
+		// Shutdown and failure
+		{connected, disconnected, true},
+		{disconnected, connected, true},
+		{connected, failed, true},
+		{failed, disconnected, true},
+
+		// Repeating the current state is a no-op
+		{connected, connected, true},
+		{failed, failed, true},
+
+		// Rejected
+		{uninitialized, reconnecting, false},
+		{uninitialized, reconnected, false},
+		{initialized, uninitialized, false},
+		{initialized, reconnected, false},
+		{initFailed, connected, false},
+		{connected, uninitialized, false},
+		{connected, initialized, false},
+		{connected, reconnected, false},
+		{disconnected, reconnecting, false},
+		{failed, connected, false},
+		{failed, reconnecting, false},
+	}
+	for _, tt := range tests {
+		name := ipcgen.EnumNamesConnectionStatus[tt.from] + "->" + ipcgen.EnumNamesConnectionStatus[tt.to]
+		t.Run(name, func(t *testing.T) {
+			c := newConnectionState()
+			c.state = tt.from
+			prev, err := c.Transition(tt.to, "", "")
+			if prev != tt.from {
+				t.Errorf("previous state %s, want %s", ipcgen.EnumNamesConnectionStatus[prev], ipcgen.EnumNamesConnectionStatus[tt.from])
+			}
+			want := tt.from
+			if tt.allowed {
+				want = tt.to
+			}
+			if (err == nil) != tt.allowed {
+				t.Errorf("allowed = %v, want %v (err %v)", err == nil, tt.allowed, err)
+			}
+			if got := c.State(); got != want {
+				t.Errorf("state %s, want %s", ipcgen.EnumNamesConnectionStatus[got], ipcgen.EnumNamesConnectionStatus[want])
+			}
+		})
+	}
+}
+
+// Every state has an entry, so no state is a dead end by omission.
+func TestValidTransitionsCoverAllStates(t *testing.T) {
+	for status, name := range ipcgen.EnumNamesConnectionStatus {
+		if status == ipcgen.ConnectionStatusTOKEN_WILL_EXPIRE {
+			// A notification, never a connection state
+			continue
+		}
+		if _, ok := validTransitions[status]; !ok {
+			t.Errorf("no transitions from %s", name)
+		}
+	}
+}
+
+// statusMessage builds a STATUS_RESPONSE the way the child sends it.
+func statusMessage(status ipcgen.ConnectionStatus, info string) []byte {
+	inner := flatbuffers.NewBuilder(64)
+	infoOffset := inner.CreateString(info)
+	ipcgen.StatusResponsePayloadStart(inner)
+	ipcgen.StatusResponsePayloadAddStatus(inner, status)
+	ipcgen.StatusResponsePayloadAddAdditionalInfo(inner, infoOffset)
+	inner.Finish(ipcgen.StatusResponsePayloadEnd(inner))
+	payload := inner.FinishedBytes()
+
+	builder := flatbuffers.NewBuilder(len(payload) + 64)
+	ipcgen.IPCMessageStartPayloadVector(builder, len(payload))
+	for i := len(payload) - 1; i >= 0; i-- {
+		builder.PrependByte(payload[i])
+	}
+	payloadOffset := builder.EndVector(len(payload))
+	ipcgen.IPCMessageStart(builder)
+	ipcgen.IPCMessageAddMessageType(builder, ipcgen.MessageTypeSTATUS_RESPONSE)
+	ipcgen.IPCMessageAddPayload(builder, payloadOffset)
+	builder.Finish(ipcgen.IPCMessageEnd(builder))
+	return builder.FinishedBytes()
+}
+
+// newTestChild makes a child process record current without starting a
+// process, so status messages can be fed to handleChildMessage.
+func newTestChild(p *ParentController) *childProcess {
+	child := &childProcess{
+		done:     make(chan struct{}),
+		failed:   make(chan ipcgen.ConnectionStatus, 1),
+		closeAck: make(chan struct{}),
+	}
+	p.child = child
+	return child
+}
+
+func TestConnectionLostRecoveredDoesNotRestart(t *testing.T) {
+	const grace = 50 * time.Millisecond
+	p := NewParentController(&Options{ConnectionLostGrace: grace})
+	child := newTestChild(p)
+
+	for _, status := range []ipcgen.ConnectionStatus{
+		ipcgen.ConnectionStatusCONNECTED,
+		ipcgen.ConnectionStatusCONNECTION_LOST,
+		ipcgen.ConnectionStatusRECONNECTING,
+		ipcgen.ConnectionStatusRECONNECTED,
+	} {
+		p.handleChildMessage(child, statusMessage(status, ""))
+	}
+	if got := p.State(); got != ipcgen.ConnectionStatusRECONNECTED {
+		t.Fatalf("state %s, want RECONNECTED", ipcgen.EnumNamesConnectionStatus[got])
+	}
+
+	select {
+	case status := <-child.failed:
+		t.Fatalf("child reported as failed with %s after it reconnected", ipcgen.EnumNamesConnectionStatus[status])
+	case <-time.After(4 * grace):
+	}
+}
+
+func TestConnectionLostPastGraceRestarts(t *testing.T) {
+	const grace = 50 * time.Millisecond
+	p := NewParentController(&Options{ConnectionLostGrace: grace})
+	child := newTestChild(p)
+
+	start := time.Now()
+	p.handleChildMessage(child, statusMessage(ipcgen.ConnectionStatusCONNECTED, ""))
+	p.handleChildMessage(child, statusMessage(ipcgen.ConnectionStatusCONNECTION_LOST, ""))
+	// Repeated reports do not extend the grace period
+	p.handleChildMessage(child, statusMessage(ipcgen.ConnectionStatusCONNECTION_LOST, ""))
+
+	select {
+	case status := <-child.failed:
+		if status != ipcgen.ConnectionStatusCONNECTION_LOST {
+			t.Errorf("reported %s, want CONNECTION_LOST", ipcgen.EnumNamesConnectionStatus[status])
+		}
+		if elapsed := time.Since(start); elapsed < grace {
+			t.Errorf("reported after %v, before the %v grace period", elapsed, grace)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("lost connection never reported")
+	}
+}
+
+func TestFailedRestartsImmediately(t *testing.T) {
+	p := NewParentController(&Options{})
+	child := newTestChild(p)
+	p.handleChildMessage(child, statusMessage(ipcgen.ConnectionStatusCONNECTED, ""))
+	p.handleChildMessage(child, statusMessage(ipcgen.ConnectionStatusFAILED, ""))
+	select {
+	case status := <-child.failed:
+		if status != ipcgen.ConnectionStatusFAILED {
+			t.Errorf("reported %s, want FAILED", ipcgen.EnumNamesConnectionStatus[status])
+		}
+	default:
+		t.Error("FAILED not reported to the supervisor")
+	}
+}
+
+// The first CONNECTED zeroes the media clock, reconnects keep its timeline.
+func TestConnectedStartsMediaClock(t *testing.T) {
+	p := NewParentController(&Options{})
+	child := newTestChild(p)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := p.clock.Zero(ctx); err == nil {
+		t.Fatal("clock started before CONNECTED")
+	}
+
+	p.handleChildMessage(child, statusMessage(ipcgen.ConnectionStatusCONNECTED, ""))
+	zero, err := p.clock.Zero(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	for _, status := range []ipcgen.ConnectionStatus{
+		ipcgen.ConnectionStatusRECONNECTING,
+		ipcgen.ConnectionStatusCONNECTED,
+	} {
+		p.handleChildMessage(child, statusMessage(status, ""))
+	}
+	if again, _ := p.clock.Zero(context.Background()); !again.Equal(zero) {
+		t.Errorf("reconnect moved the clock zero from %v to %v", zero, again)
+	}
+}
+
+// readChildMessage reads one length-prefixed message the parent wrote to the
+// child's stdin.
+func readChildMessage(t *testing.T, r *os.File) *ipcgen.IPCMessage {
+	t.Helper()
+	r.SetReadDeadline(time.Now().Add(time.Second))
+	prefix := make([]byte, 4)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		t.Fatalf("failed to read message length: %v", err)
+	}
+	msg := make([]byte, binary.BigEndian.Uint32(prefix))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		t.Fatalf("failed to read message: %v", err)
+	}
+	return ipcgen.GetRootAsIPCMessage(msg, 0)
+}
+
+func TestInterruptClearsQueuedAudio(t *testing.T) {
+	voice := media.NewVoiceBuffer(media.AudioFormat{SampleRate: 16000, Channels: 1}, 10*time.Second)
+	p := NewParentController(&Options{AudioSource: voice, InterruptFade: 30 * time.Millisecond})
+	child := newTestChild(p)
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	child.stdin = w
+	ctx := context.Background()
+
+	// Before CONNECTED the queue is cleared but nothing is sent
+	if err := voice.Write(make([]byte, 3200)); err != nil {
+		t.Fatal(err)
+	}
+	dropped, err := p.Interrupt(ctx)
+	if err != nil || dropped != 100*time.Millisecond {
+		t.Errorf("Interrupt() before CONNECTED = %v, %v, want 100ms", dropped, err)
+	}
+
+	p.handleChildMessage(child, statusMessage(ipcgen.ConnectionStatusCONNECTED, ""))
+	// 250ms of 16kHz mono PCM16
+	if err := voice.Write(make([]byte, 8000)); err != nil {
+		t.Fatal(err)
+	}
+	dropped, err = p.Interrupt(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dropped != 250*time.Millisecond {
+		t.Errorf("dropped %v, want 250ms", dropped)
+	}
+	if queued := voice.Buffered(); queued != 0 {
+		t.Errorf("%v still queued after Interrupt", queued)
+	}
+
+	// The first message on the pipe is the one sent after CONNECTED
+	msg := readChildMessage(t, r)
+	if msg.MessageType() != ipcgen.MessageTypeINTERRUPT_COMMAND {
+		t.Fatalf("message type %s, want INTERRUPT_COMMAND", ipcgen.EnumNamesMessageType[msg.MessageType()])
+	}
+	payload := make([]byte, msg.PayloadLength())
+	for i := range payload {
+		payload[i] = byte(msg.Payload(i))
+	}
+	if fade := ipcgen.GetRootAsInterruptPayload(payload, 0).FadeOutMs(); fade != 30 {
+		t.Errorf("fade out %dms, want 30ms", fade)
+	}
+}
+
+func activityMessage(kind ipcgen.ActivityKind, userID string) []byte {
+	inner := flatbuffers.NewBuilder(64)
+	userOffset := inner.CreateString(userID)
+	ipcgen.ActivityResponsePayloadStart(inner)
+	ipcgen.ActivityResponsePayloadAddKind(inner, kind)
+	ipcgen.ActivityResponsePayloadAddUserId(inner, userOffset)
+	inner.Finish(ipcgen.ActivityResponsePayloadEnd(inner))
+	payload := inner.FinishedBytes()
+
+	builder := flatbuffers.NewBuilder(len(payload) + 64)
+	ipcgen.IPCMessageStartPayloadVector(builder, len(payload))
+	for i := len(payload) - 1; i >= 0; i-- {
+		builder.PrependByte(payload[i])
+	}
+	payloadOffset := builder.EndVector(len(payload))
+	ipcgen.IPCMessageStart(builder)
+	ipcgen.IPCMessageAddMessageType(builder, ipcgen.MessageTypeACTIVITY_RESPONSE)
+	ipcgen.IPCMessageAddPayloadType(builder, ipcgen.MessagePayloadActivity)
+	ipcgen.IPCMessageAddPayload(builder, payloadOffset)
+	builder.Finish(ipcgen.IPCMessageEnd(builder))
+	return builder.FinishedBytes()
+}
+
+func nextEvent(t *testing.T, p *ParentController) ControllerEvent {
+	t.Helper()
+	select {
+	case event := <-p.Events():
+		return event
+	case <-time.After(2 * time.Second):
+		t.Fatal("no controller event")
+	}
+	return ControllerEvent{}
+}
+
+func TestIdleTimeoutDisabled(t *testing.T) {
+	p := NewParentController(&Options{})
+	newTestChild(p)
+	p.startIdleTimer()
+
+	select {
+	case event := <-p.Events():
+		t.Errorf("got %s event with the idle timeout disabled", event.Type)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	// The warning comes after half the timeout
+	const timeout = 200 * time.Millisecond
+	const warnAfter = timeout / 2
+	p := NewParentController(&Options{ActivityIdleTimeout: timeout})
+	child := newTestChild(p)
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	child.stdin = w
+	p.startIdleTimer()
+
+	// Voice audio, users joining and stream messages all keep it alive
+	activities := []func(){
+		p.RecordActivity,
+		func() { p.handleChildMessage(child, activityMessage(ipcgen.ActivityKindUSER_JOINED, "42")) },
+		func() { p.handleChildMessage(child, activityMessage(ipcgen.ActivityKindSTREAM_MESSAGE, "42")) },
+	}
+	var last time.Time
+	for i := 0; i < 9; i++ {
+		activities[i%len(activities)]()
+		last = time.Now()
+		time.Sleep(warnAfter / 3)
+		select {
+		case event := <-p.Events():
+			t.Fatalf("got %s event despite activity", event.Type)
+		default:
+		}
+	}
+
+	if event := nextEvent(t, p); event.Type != EventIdleWarning || event.Idle != warnAfter {
+		t.Fatalf("got %s event (idle=%v), want IDLE_WARNING after %v", event.Type, event.Idle, warnAfter)
+	}
+	if idle := time.Since(last); idle < warnAfter {
+		t.Errorf("warned after %v, want at least %v", idle, warnAfter)
+	}
+
+	// Activity after the warning starts the countdown over
+	p.RecordActivity()
+	last = time.Now()
+	if event := nextEvent(t, p); event.Type != EventIdleWarning {
+		t.Fatalf("got %s event after activity, want another IDLE_WARNING", event.Type)
+	}
+	if idle := time.Since(last); idle < warnAfter {
+		t.Errorf("warned again after %v, want at least %v", idle, warnAfter)
+	}
+
+	event := nextEvent(t, p)
+	if event.Type != EventIdleTimeout || event.Idle != timeout || event.Err != ErrIdleTimeout {
+		t.Fatalf("got %s event (idle=%v, err=%v), want IDLE_TIMEOUT after %v", event.Type, event.Idle, event.Err, timeout)
+	}
+	if idle := time.Since(last); idle < timeout {
+		t.Errorf("timed out after %v, want at least %v", idle, timeout)
+	}
+
+	// The child is told why it is stopped
+	msg := readChildMessage(t, r)
+	if msg.MessageType() != ipcgen.MessageTypeCLOSE_COMMAND {
+		t.Fatalf("message type %s, want CLOSE_COMMAND", ipcgen.EnumNamesMessageType[msg.MessageType()])
+	}
+	if reason := closeCommandReason(msg); reason != "idle timeout" {
+		t.Errorf("close reason %q, want %q", reason, "idle timeout")
+	}
+	p.handleChildMessage(child, statusMessage(ipcgen.ConnectionStatusDISCONNECTED, closeAckInfo))
+	close(child.done)
+	p.wg.Wait()
+}
@@ -0,0 +1,374 @@
+//go:build !child
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Session API limits and defaults
+const (
+	sessionAPIMaxBody          = 64 << 10
+	defaultActivityIdleTimeout = 120 * time.Second
+)
+
+// apiError is the body of a session API error response.
+type apiError struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+	Code    string `json:"code"`
+}
+
+// sessionStartRequest is the body of POST /session/start.
+type sessionStartRequest struct {
+	AvatarID            string         `json:"avatar_id"`
+	Quality             string         `json:"quality"`
+	Version             string         `json:"version"`
+	VideoEncoding       string         `json:"video_encoding"`
+	ActivityIdleTimeout *float64       `json:"activity_idle_timeout"` // seconds, nil for the default
+	AgoraSettings       *agoraSettings `json:"agora_settings"`
+}
+
+type sessionStartResponse struct {
+	SessionID        string `json:"session_id"`
+	WebSocketAddress string `json:"websocket_address"`
+	SessionToken     string `json:"session_token"`
+}
+
+// sessionStopRequest is the body of DELETE /session/stop.
+type sessionStopRequest struct {
+	SessionID    string `json:"session_id"`
+	SessionToken string `json:"session_token"`
+}
+
+type sessionStopResponse struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+// apiSession is a session issued by the session API.
+type apiSession struct {
+	id          string
+	token       string
+	settings    sessionSettings
+	idleTimeout time.Duration // 0 disables the timeout
+	created     time.Time
+}
+
+// sessionSettings are the settings a session was started with. Its init
+// command must repeat them, so a session token cannot publish anywhere else.
+type sessionSettings struct {
+	AvatarID      string
+	Quality       string
+	VideoEncoding string
+	Agora         agoraSettings
+}
+
+// SessionAPI implements the connection-setup REST API: POST /session/start
+// issues a session and the token its WebSocket connection authenticates
+// with, DELETE /session/stop revokes it and stops its child. Sessions are
+// kept in memory.
+type SessionAPI struct {
+	// APIKey is the x-api-key every request must present
+	APIKey string
+	// WebSocketAddress is returned to clients. Empty derives it from the
+	// Host of the request, for a Voice server on the same listener
+	WebSocketAddress string
+	// Voice runs the connections of the issued sessions
+	Voice *VoiceServer
+
+	logger *log.Logger
+
+	mu       sync.Mutex
+	sessions map[string]*apiSession // by session ID
+	tokens   map[string]string      // session token to session ID
+}
+
+func NewSessionAPI(apiKey string, voice *VoiceServer) *SessionAPI {
+	return &SessionAPI{
+		APIKey:   apiKey,
+		Voice:    voice,
+		logger:   log.New(os.Stderr, "[session] ", log.LstdFlags|log.Lshortfile),
+		sessions: make(map[string]*apiSession),
+		tokens:   make(map[string]string),
+	}
+}
+
+// Authenticate returns the session a WebSocket token was issued for.
+func (a *SessionAPI) Authenticate(token string) (string, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	sessionID, ok := a.tokens[token]
+	return sessionID, ok
+}
+
+// IdleTimeout returns the activity_idle_timeout a session was started with.
+func (a *SessionAPI) IdleTimeout(sessionID string) (time.Duration, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	session, ok := a.sessions[sessionID]
+	if !ok {
+		return 0, false
+	}
+	return session.idleTimeout, true
+}
+
+// Settings returns the settings a session was started with.
+func (a *SessionAPI) Settings(sessionID string) (sessionSettings, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	session, ok := a.sessions[sessionID]
+	if !ok {
+		return sessionSettings{}, false
+	}
+	return session.settings, true
+}
+
+// Remove forgets a session, e.g. once its connection ended. Its token can
+// no longer connect and stopping it returns SESSION_NOT_FOUND.
+func (a *SessionAPI) Remove(sessionID string) {
+	a.mu.Lock()
+	session, ok := a.sessions[sessionID]
+	if ok {
+		delete(a.sessions, session.id)
+		delete(a.tokens, session.token)
+	}
+	count := len(a.sessions)
+	a.mu.Unlock()
+	if ok {
+		a.logger.Printf("Session %s ended after %v (%d active)",
+			session.id, time.Since(session.created).Round(time.Second), count)
+	}
+}
+
+// Register adds the API endpoints to mux.
+func (a *SessionAPI) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/session/start", a.handleStart)
+	mux.HandleFunc("/session/stop", a.handleStop)
+}
+
+func (a *SessionAPI) handleStart(w http.ResponseWriter, r *http.Request) {
+	if !a.checkRequest(w, r, http.MethodPost) {
+		return
+	}
+	var req sessionStartRequest
+	if !a.decodeRequest(w, r, &req, []string{"avatar_id", "quality", "version", "video_encoding", "agora_settings"},
+		"agora_settings", []string{"app_id", "token", "channel", "uid", "enable_string_uid"}) {
+		return
+	}
+	if req.Version != "v1" {
+		writeAPIError(w, http.StatusBadRequest, "VALIDATION_ERROR", fmt.Sprintf("Unsupported version %q, expected v1", req.Version))
+		return
+	}
+	if err := validateSessionSettings(req.AvatarID, req.Quality, req.VideoEncoding, req.AgoraSettings); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "VALIDATION_ERROR", err.Error())
+		return
+	}
+	idleTimeout := defaultActivityIdleTimeout
+	if req.ActivityIdleTimeout != nil {
+		if *req.ActivityIdleTimeout < 0 {
+			writeAPIError(w, http.StatusBadRequest, "VALIDATION_ERROR", "activity_idle_timeout must be a non-negative number")
+			return
+		}
+		idleTimeout = time.Duration(*req.ActivityIdleTimeout * float64(time.Second))
+	}
+
+	id, err := newSessionID()
+	if err != nil {
+		a.logger.Printf("Failed to create session: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to create session")
+		return
+	}
+	token, err := newSessionToken()
+	if err != nil {
+		a.logger.Printf("Failed to create session: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to create session")
+		return
+	}
+	session := &apiSession{
+		id:    id,
+		token: token,
+		settings: sessionSettings{
+			AvatarID:      req.AvatarID,
+			Quality:       req.Quality,
+			VideoEncoding: req.VideoEncoding,
+			Agora:         *req.AgoraSettings,
+		},
+		idleTimeout: idleTimeout,
+		created:     time.Now(),
+	}
+
+	a.mu.Lock()
+	a.sessions[id] = session
+	a.tokens[token] = id
+	count := len(a.sessions)
+	a.mu.Unlock()
+	a.logger.Printf("Session %s started: avatar %s, %s quality, %s video, activity idle timeout %v (%d active)",
+		id, req.AvatarID, req.Quality, req.VideoEncoding, idleTimeout, count)
+
+	address := a.WebSocketAddress
+	if address == "" {
+		scheme := "ws"
+		if r.TLS != nil {
+			scheme = "wss"
+		}
+		address = scheme + "://" + r.Host + "/"
+	}
+	writeAPIResponse(w, http.StatusOK, sessionStartResponse{SessionID: id, WebSocketAddress: address, SessionToken: token})
+}
+
+func (a *SessionAPI) handleStop(w http.ResponseWriter, r *http.Request) {
+	if !a.checkRequest(w, r, http.MethodDelete) {
+		return
+	}
+	var req sessionStopRequest
+	if !a.decodeRequest(w, r, &req, []string{"session_id", "session_token"}, "", nil) {
+		return
+	}
+
+	a.mu.Lock()
+	session, ok := a.sessions[req.SessionID]
+	if ok && subtle.ConstantTimeCompare([]byte(req.SessionToken), []byte(session.token)) != 1 {
+		a.mu.Unlock()
+		writeAPIError(w, http.StatusUnauthorized, "INVALID_SESSION_TOKEN", "Invalid session token")
+		return
+	}
+	if ok {
+		delete(a.sessions, session.id)
+		delete(a.tokens, session.token)
+	}
+	count := len(a.sessions)
+	a.mu.Unlock()
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "SESSION_NOT_FOUND", "Session not found or already terminated")
+		return
+	}
+
+	// The token is revoked, so the session cannot reconnect while its child
+	// stops
+	connected := a.Voice != nil && a.Voice.EndSession(session.id)
+	a.logger.Printf("Session %s stopped after %v, connected: %v (%d active)",
+		session.id, time.Since(session.created).Round(time.Second), connected, count)
+	writeAPIResponse(w, http.StatusOK, sessionStopResponse{Status: "success", Message: "Session terminated successfully"})
+}
+
+// checkRequest checks the method and the API key of a request.
+func (a *SessionAPI) checkRequest(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeAPIError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", fmt.Sprintf("Use %s for %s", method, r.URL.Path))
+		return false
+	}
+	key := r.Header.Get("x-api-key")
+	if key == "" {
+		writeAPIError(w, http.StatusForbidden, "MISSING_API_KEY", "API key header missing")
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(key), []byte(a.APIKey)) != 1 {
+		a.logger.Printf("Rejected %s %s from %s: invalid API key", r.Method, r.URL.Path, r.RemoteAddr)
+		writeAPIError(w, http.StatusUnauthorized, "INVALID_API_KEY", "Invalid API key")
+		return false
+	}
+	return true
+}
+
+// decodeRequest decodes a JSON body into v after checking that the required
+// fields, and the required fields of the object in nested, are present.
+func (a *SessionAPI) decodeRequest(w http.ResponseWriter, r *http.Request, v interface{}, required []string, nested string, nestedRequired []string) bool {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, sessionAPIMaxBody))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "INVALID_JSON", fmt.Sprintf("Failed to read request body: %v", err))
+		return false
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "INVALID_JSON", "Invalid JSON in request body")
+		return false
+	}
+	if missing := missingFields(fields, required); len(missing) > 0 {
+		writeAPIError(w, http.StatusBadRequest, "VALIDATION_ERROR", "Missing required field: "+strings.Join(missing, ", "))
+		return false
+	}
+	if nested != "" {
+		var nestedFields map[string]json.RawMessage
+		if err := json.Unmarshal(fields[nested], &nestedFields); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "VALIDATION_ERROR", fmt.Sprintf("%s must be an object", nested))
+			return false
+		}
+		if missing := missingFields(nestedFields, nestedRequired); len(missing) > 0 {
+			writeAPIError(w, http.StatusBadRequest, "VALIDATION_ERROR", fmt.Sprintf("Missing required %s field: %s", nested, strings.Join(missing, ", ")))
+			return false
+		}
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			writeAPIError(w, http.StatusBadRequest, "VALIDATION_ERROR", fmt.Sprintf("Field %s must not be a %s", typeErr.Field, typeErr.Value))
+			return false
+		}
+		writeAPIError(w, http.StatusBadRequest, "INVALID_JSON", "Invalid JSON in request body")
+		return false
+	}
+	return true
+}
+
+// missingFields returns the names that are absent or null in fields.
+func missingFields(fields map[string]json.RawMessage, names []string) []string {
+	var missing []string
+	for _, name := range names {
+		if value, ok := fields[name]; !ok || string(value) == "null" {
+			missing = append(missing, name)
+		}
+	}
+	return missing
+}
+
+func writeAPIError(w http.ResponseWriter, status int, code, message string) {
+	// The contract spells some of the status names its own way
+	errorName := http.StatusText(status)
+	switch status {
+	case http.StatusBadRequest:
+		errorName = "Invalid request"
+	case http.StatusNotFound:
+		errorName = "Not found"
+	}
+	writeAPIResponse(w, status, apiError{Error: errorName, Message: message, Code: code})
+}
+
+func writeAPIResponse(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// newSessionID returns a random (version 4) UUID.
+func newSessionID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("failed to generate session ID: %v", err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+// newSessionToken returns an opaque bearer token with 256 random bits.
+func newSessionToken() (string, error) {
+	var b [32]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("failed to generate session token: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b[:]), nil
+}
@@ -0,0 +1,291 @@
+//go:build !child
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const testAPIKey = "test-api-key"
+
+const testStartBody = `{
+	"avatar_id": "avatar",
+	"quality": "medium",
+	"version": "v1",
+	"video_encoding": "H264",
+	"agora_settings": {
+		"app_id": "app",
+		"token": "token",
+		"channel": "channel",
+		"uid": "42",
+		"enable_string_uid": false
+	}
+}`
+
+// newTestSessionAPI serves the session API and the voice server the way
+// serve mode wires them.
+func newTestSessionAPI(t *testing.T) (*SessionAPI, *httptest.Server) {
+	t.Helper()
+	server := NewVoiceServer(Options{})
+	api := NewSessionAPI(testAPIKey, server)
+	server.Authenticate = api.Authenticate
+	server.IdleTimeout = api.IdleTimeout
+	server.Settings = api.Settings
+	server.SessionEnded = api.Remove
+
+	mux := http.NewServeMux()
+	mux.Handle("/", server)
+	api.Register(mux)
+	ts := httptest.NewServer(mux)
+	t.Cleanup(func() {
+		ts.Close()
+		server.Close()
+	})
+	return api, ts
+}
+
+func apiRequest(t *testing.T, ts *httptest.Server, method, path, apiKey, body string) (int, map[string]string) {
+	t.Helper()
+	req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if apiKey != "" {
+		req.Header.Set("x-api-key", apiKey)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var reply map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		t.Fatalf("%s %s: failed to decode response: %v", method, path, err)
+	}
+	return resp.StatusCode, reply
+}
+
+func startTestSession(t *testing.T, ts *httptest.Server) (sessionID, token string) {
+	t.Helper()
+	status, reply := apiRequest(t, ts, http.MethodPost, "/session/start", testAPIKey, testStartBody)
+	if status != http.StatusOK {
+		t.Fatalf("start: status %d, reply %v", status, reply)
+	}
+	if reply["session_id"] == "" || reply["session_token"] == "" {
+		t.Fatalf("start: incomplete reply %v", reply)
+	}
+	if want := "ws://" + strings.TrimPrefix(ts.URL, "http://") + "/"; reply["websocket_address"] != want {
+		t.Errorf("start: websocket_address %q, want %q", reply["websocket_address"], want)
+	}
+	return reply["session_id"], reply["session_token"]
+}
+
+func stopBody(sessionID, token string) string {
+	var buf bytes.Buffer
+	json.NewEncoder(&buf).Encode(sessionStopRequest{SessionID: sessionID, SessionToken: token})
+	return buf.String()
+}
+
+func TestSessionAPIStartStop(t *testing.T) {
+	api, ts := newTestSessionAPI(t)
+	id, token := startTestSession(t, ts)
+
+	if got, ok := api.Authenticate(token); !ok || got != id {
+		t.Fatalf("Authenticate(token) = %q, %v, want %q", got, ok, id)
+	}
+	if timeout, ok := api.IdleTimeout(id); !ok || timeout != defaultActivityIdleTimeout {
+		t.Errorf("IdleTimeout = %v, %v, want %v", timeout, ok, defaultActivityIdleTimeout)
+	}
+
+	status, reply := apiRequest(t, ts, http.MethodDelete, "/session/stop", testAPIKey, stopBody(id, token))
+	if status != http.StatusOK || reply["status"] != "success" {
+		t.Fatalf("stop: status %d, reply %v", status, reply)
+	}
+	if _, ok := api.Authenticate(token); ok {
+		t.Error("token still valid after stop")
+	}
+
+	// A second stop finds nothing
+	status, reply = apiRequest(t, ts, http.MethodDelete, "/session/stop", testAPIKey, stopBody(id, token))
+	if status != http.StatusNotFound || reply["code"] != "SESSION_NOT_FOUND" {
+		t.Errorf("double stop: status %d, reply %v", status, reply)
+	}
+}
+
+func TestSessionAPIStopUnknownSession(t *testing.T) {
+	_, ts := newTestSessionAPI(t)
+	status, reply := apiRequest(t, ts, http.MethodDelete, "/session/stop", testAPIKey, stopBody("unknown", "token"))
+	if status != http.StatusNotFound || reply["code"] != "SESSION_NOT_FOUND" || reply["error"] != "Not found" {
+		t.Errorf("status %d, reply %v", status, reply)
+	}
+}
+
+func TestSessionAPIStopWrongToken(t *testing.T) {
+	api, ts := newTestSessionAPI(t)
+	id, token := startTestSession(t, ts)
+
+	status, reply := apiRequest(t, ts, http.MethodDelete, "/session/stop", testAPIKey, stopBody(id, "wrong"))
+	if status != http.StatusUnauthorized || reply["code"] != "INVALID_SESSION_TOKEN" {
+		t.Errorf("status %d, reply %v", status, reply)
+	}
+	if _, ok := api.Authenticate(token); !ok {
+		t.Error("session revoked by a stop with the wrong token")
+	}
+}
+
+func TestSessionAPIRejectsRequests(t *testing.T) {
+	_, ts := newTestSessionAPI(t)
+	tests := []struct {
+		name   string
+		method string
+		apiKey string
+		body   string
+		status int
+		code   string
+	}{
+		{"wrong method", http.MethodGet, testAPIKey, testStartBody, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED"},
+		{"missing API key", http.MethodPost, "", testStartBody, http.StatusForbidden, "MISSING_API_KEY"},
+		{"wrong API key", http.MethodPost, "wrong", testStartBody, http.StatusUnauthorized, "INVALID_API_KEY"},
+		{"invalid JSON", http.MethodPost, testAPIKey, "{", http.StatusBadRequest, "INVALID_JSON"},
+		{"missing field", http.MethodPost, testAPIKey, strings.Replace(testStartBody, `"avatar_id"`, `"avatar"`, 1), http.StatusBadRequest, "VALIDATION_ERROR"},
+		{"missing agora setting", http.MethodPost, testAPIKey, strings.Replace(testStartBody, `"channel"`, `"room"`, 1), http.StatusBadRequest, "VALIDATION_ERROR"},
+		{"unsupported version", http.MethodPost, testAPIKey, strings.Replace(testStartBody, `"v1"`, `"v2"`, 1), http.StatusBadRequest, "VALIDATION_ERROR"},
+		{"invalid quality", http.MethodPost, testAPIKey, strings.Replace(testStartBody, `"medium"`, `"ultra"`, 1), http.StatusBadRequest, "VALIDATION_ERROR"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, reply := apiRequest(t, ts, tt.method, "/session/start", tt.apiKey, tt.body)
+			if status != tt.status || reply["code"] != tt.code {
+				t.Errorf("status %d, reply %v, want %d %s", status, reply, tt.status, tt.code)
+			}
+		})
+	}
+}
+
+// A session ends with its connection, whether the client or the server
+// closed it.
+func TestSessionAPIRemovesEndedSessions(t *testing.T) {
+	api, ts := newTestSessionAPI(t)
+	id, token := startTestSession(t, ts)
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/"
+	header := http.Header{"Authorization": {"Bearer " + token}}
+	conn, _, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	conn.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := api.IdleTimeout(id); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("session not removed after its connection ended")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, ok := api.Authenticate(token); ok {
+		t.Error("token still valid after the connection ended")
+	}
+	if _, _, err := websocket.DefaultDialer.Dial(url, header); err == nil {
+		t.Error("ended session could reconnect")
+	}
+	status, _ := apiRequest(t, ts, http.MethodDelete, "/session/stop", testAPIKey, stopBody(id, token))
+	if status != http.StatusNotFound {
+		t.Errorf("stop after the connection ended: status %d, want %d", status, http.StatusNotFound)
+	}
+}
+
+func TestSessionSettingsMismatch(t *testing.T) {
+	started := sessionSettings{
+		AvatarID:      "avatar",
+		Quality:       "medium",
+		VideoEncoding: "H264",
+		Agora:         agoraSettings{AppID: "app", Token: "token", Channel: "channel", UID: "42"},
+	}
+	initCommand := func(change func(cmd *voiceCommand)) *voiceCommand {
+		agora := started.Agora
+		cmd := &voiceCommand{
+			AvatarID:      started.AvatarID,
+			Quality:       started.Quality,
+			VideoEncoding: started.VideoEncoding,
+			AgoraSettings: &agora,
+		}
+		change(cmd)
+		return cmd
+	}
+	tests := []struct {
+		name   string
+		change func(cmd *voiceCommand)
+		want   string
+	}{
+		{"same", func(cmd *voiceCommand) {}, ""},
+		{"renewed token", func(cmd *voiceCommand) { cmd.AgoraSettings.Token = "renewed" }, ""},
+		{"codec spelling", func(cmd *voiceCommand) { cmd.VideoEncoding = "h264" }, ""},
+		{"avatar", func(cmd *voiceCommand) { cmd.AvatarID = "other" }, "avatar_id"},
+		{"quality", func(cmd *voiceCommand) { cmd.Quality = "high" }, "quality"},
+		{"codec", func(cmd *voiceCommand) { cmd.VideoEncoding = "VP8" }, "video_encoding"},
+		{"app", func(cmd *voiceCommand) { cmd.AgoraSettings.AppID = "other" }, "agora_settings.app_id"},
+		{"channel", func(cmd *voiceCommand) { cmd.AgoraSettings.Channel = "other" }, "agora_settings.channel"},
+		{"uid", func(cmd *voiceCommand) { cmd.AgoraSettings.UID = "7" }, "agora_settings.uid"},
+		{"string uid", func(cmd *voiceCommand) { cmd.AgoraSettings.EnableStringUID = true }, "agora_settings.enable_string_uid"},
+	}
+	for _, tt := range tests {
+		if got := started.mismatch(initCommand(tt.change)); got != tt.want {
+			t.Errorf("%s: mismatch = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// A session token only publishes where the session was started to.
+func TestSessionAPIRejectsInitForOtherChannel(t *testing.T) {
+	_, ts := newTestSessionAPI(t)
+	id, token := startTestSession(t, ts)
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/"
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Authorization": {"Bearer " + token}})
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	var cmd voiceCommand
+	if err := json.Unmarshal([]byte(testStartBody), &cmd); err != nil {
+		t.Fatal(err)
+	}
+	cmd.Command = "init"
+	cmd.SessionID = id
+	cmd.AgoraSettings.Channel = "someone-elses-channel"
+	if err := conn.WriteJSON(cmd); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, _, err := conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		var closeErr *websocket.CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != websocket.ClosePolicyViolation {
+			t.Fatalf("got %v, want a policy violation close", err)
+		}
+		if !strings.Contains(closeErr.Text, "agora_settings.channel") {
+			t.Errorf("close reason %q does not name the channel", closeErr.Text)
+		}
+		return
+	}
+}
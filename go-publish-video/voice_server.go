@@ -0,0 +1,663 @@
+//go:build !child
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go-publish-video/media"
+)
+
+// ConvoAI voice protocol limits
+const (
+	// Clients send a heartbeat every 10 seconds
+	voiceReadTimeout  = 30 * time.Second
+	voiceWriteTimeout = 5 * time.Second
+	// Base64 voice chunks are a few KB; this leaves room for long ones
+	voiceMaxMessageSize = 4 << 20
+)
+
+// videoQualities maps the quality of a session to the video bitrate range
+// in Kbps.
+var videoQualities = map[string][2]int{
+	"low":    {500, 100},
+	"medium": {1000, 100},
+	"high":   {2000, 500},
+}
+
+// agoraSettings is the channel a ConvoAI session publishes to.
+type agoraSettings struct {
+	AppID           string `json:"app_id"`
+	Token           string `json:"token"`
+	Channel         string `json:"channel"`
+	UID             string `json:"uid"`
+	EnableStringUID bool   `json:"enable_string_uid"`
+}
+
+// voiceCommand is one JSON message of the ConvoAI voice protocol. Only the
+// fields of its command are set.
+type voiceCommand struct {
+	Command string `json:"command"`
+	EventID string `json:"event_id"`
+
+	// init
+	SessionID     string         `json:"session_id"`
+	AvatarID      string         `json:"avatar_id"`
+	Quality       string         `json:"quality"`
+	Version       string         `json:"version"`
+	VideoEncoding string         `json:"video_encoding"`
+	AgoraSettings *agoraSettings `json:"agora_settings"`
+	// Seconds, nil for the session's
+	ActivityIdleTimeout *float64 `json:"activity_idle_timeout"`
+
+	// voice
+	Audio      string `json:"audio"`
+	SampleRate int    `json:"sampleRate"`
+	Encoding   string `json:"encoding"`
+
+	// heartbeat and heartbeat_ack
+	Timestamp int64 `json:"timestamp"`
+
+	// special
+	Content string `json:"content"`
+}
+
+// voiceReply is a message sent back to the client.
+type voiceReply struct {
+	Command   string `json:"command"`
+	EventID   string `json:"event_id"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// validateSessionSettings checks the session fields shared by the init
+// command and the session API.
+func validateSessionSettings(avatarID, quality, videoEncoding string, settings *agoraSettings) error {
+	if avatarID == "" {
+		return fmt.Errorf("avatar_id is required")
+	}
+	if _, ok := videoQualities[quality]; !ok {
+		return fmt.Errorf("invalid quality %q, expected low, medium or high", quality)
+	}
+	if _, err := media.ParseVideoCodec(videoEncoding); err != nil {
+		return fmt.Errorf("invalid video_encoding: %v", err)
+	}
+	if settings == nil {
+		return fmt.Errorf("agora_settings is required")
+	}
+	for _, field := range []struct{ name, value string }{
+		{"app_id", settings.AppID},
+		{"token", settings.Token},
+		{"channel", settings.Channel},
+		{"uid", settings.UID},
+	} {
+		if field.value == "" {
+			return fmt.Errorf("agora_settings.%s is required", field.name)
+		}
+	}
+	return nil
+}
+
+// VoiceServer accepts ConvoAI voice connections over WebSocket. Every
+// connection gets its own ParentController, configured from Template and
+// the agora_settings of its init command, and publishes the voice audio it
+// receives.
+type VoiceServer struct {
+	// Template holds the options shared by all sessions. Its audio sources
+	// are ignored, sessions publish their voice input
+	Template Options
+	// NewVideoSource sets up the video source of a session's options. Nil
+	// leaves them as they are, so every session reads Template.VideoFile
+	NewVideoSource func(opts *Options) error
+	// Authenticate checks the bearer token of a connection and returns the
+	// session it was issued for, or "" if it is valid for any session
+	Authenticate   func(token string) (sessionID string, ok bool)
+	ConnectTimeout time.Duration
+	// MaxVoiceBuffer bounds the audio a session queues ahead of playback
+	MaxVoiceBuffer time.Duration
+	// IdleTimeout returns the activity_idle_timeout a session was started
+	// with, for init commands that do not carry one. Without it, or for
+	// unknown sessions, the timeout is defaultActivityIdleTimeout
+	IdleTimeout func(sessionID string) (time.Duration, bool)
+	// Settings returns the settings a session was started with, which its
+	// init command must repeat. Without it, or for unknown sessions, any
+	// settings are accepted
+	Settings func(sessionID string) (sessionSettings, bool)
+	// SessionEnded is called once the connection of a session authenticated
+	// for a session ID has ended and its child stopped
+	SessionEnded func(sessionID string)
+
+	logger   *log.Logger
+	upgrader websocket.Upgrader
+
+	mu       sync.Mutex
+	sessions map[*voiceSession]struct{}
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+func NewVoiceServer(template Options) *VoiceServer {
+	return &VoiceServer{
+		Template:       template,
+		ConnectTimeout: 30 * time.Second,
+		MaxVoiceBuffer: 5 * time.Minute,
+		logger:         log.New(os.Stderr, "[voice] ", log.LstdFlags|log.Lshortfile),
+		upgrader: websocket.Upgrader{
+			// Clients authenticate with the session token, not cookies
+			CheckOrigin: func(*http.Request) bool { return true },
+		},
+		sessions: make(map[*voiceSession]struct{}),
+	}
+}
+
+// bearerToken extracts the token of an "Authorization: Bearer" header.
+func bearerToken(header string) (string, bool) {
+	const prefix = "bearer "
+	if len(header) <= len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", false
+	}
+	return strings.TrimSpace(header[len(prefix):]), true
+}
+
+// staticTokenAuth accepts a single token for any session.
+func staticTokenAuth(expected string) func(string) (string, bool) {
+	return func(token string) (string, bool) {
+		return "", subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+	}
+}
+
+func (s *VoiceServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, ok := bearerToken(r.Header.Get("Authorization"))
+	sessionID := ""
+	if ok && s.Authenticate != nil {
+		sessionID, ok = s.Authenticate(token)
+	}
+	if !ok {
+		s.logger.Printf("Rejected connection from %s: invalid session token", r.RemoteAddr)
+		http.Error(w, "invalid session token", http.StatusUnauthorized)
+		return
+	}
+
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already replied
+		s.logger.Printf("WebSocket upgrade from %s failed: %v", r.RemoteAddr, err)
+		return
+	}
+	conn.SetReadLimit(voiceMaxMessageSize)
+
+	v := &voiceSession{
+		server:    s,
+		conn:      conn,
+		sessionID: sessionID,
+		done:      make(chan struct{}),
+		logger:    log.New(os.Stderr, fmt.Sprintf("[voice %s] ", r.RemoteAddr), log.LstdFlags|log.Lshortfile),
+	}
+	v.ctx, v.cancel = context.WithCancel(context.Background())
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		v.close(websocket.CloseGoingAway, "server is shutting down")
+		return
+	}
+	if sessionID != "" && s.connectedLocked(sessionID) {
+		// A second child would publish as the same user
+		s.mu.Unlock()
+		v.logger.Printf("Rejected connection: session %s is already connected", sessionID)
+		v.close(websocket.ClosePolicyViolation, "session is already connected")
+		return
+	}
+	s.sessions[v] = struct{}{}
+	s.wg.Add(1)
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.sessions, v)
+		s.mu.Unlock()
+		close(v.done)
+		if sessionID != "" && s.SessionEnded != nil {
+			s.SessionEnded(sessionID)
+		}
+		s.wg.Done()
+	}()
+	v.logger.Println("Connection accepted")
+	v.run()
+}
+
+// Close disconnects all sessions and waits until their children stopped.
+func (s *VoiceServer) Close() {
+	s.mu.Lock()
+	s.closed = true
+	sessions := make([]*voiceSession, 0, len(s.sessions))
+	for v := range s.sessions {
+		sessions = append(sessions, v)
+	}
+	s.mu.Unlock()
+
+	// Closing writes a close frame, which must not block other sessions
+	for _, v := range sessions {
+		v.close(websocket.CloseGoingAway, "server is shutting down")
+	}
+	s.wg.Wait()
+}
+
+func (s *VoiceServer) connectedLocked(sessionID string) bool {
+	for v := range s.sessions {
+		if v.sessionID == sessionID {
+			return true
+		}
+	}
+	return false
+}
+
+// EndSession disconnects the connection of a session and waits until its
+// child stopped. It reports whether the session was connected.
+func (s *VoiceServer) EndSession(sessionID string) bool {
+	s.mu.Lock()
+	var ended *voiceSession
+	for v := range s.sessions {
+		if v.sessionID == sessionID {
+			ended = v
+			break
+		}
+	}
+	s.mu.Unlock()
+	if ended == nil {
+		return false
+	}
+	ended.close(websocket.CloseNormalClosure, "session stopped")
+	<-ended.done
+	return true
+}
+
+// voiceSession is one ConvoAI connection and the child publishing for it.
+type voiceSession struct {
+	server    *VoiceServer
+	conn      *websocket.Conn
+	logger    *log.Logger
+	sessionID string // the session the token was issued for, if any
+
+	writeMu sync.Mutex
+	done    chan struct{} // closed once the session stopped
+
+	// ctx ends with the connection
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Set by init
+	opts       *Options
+	controller *ParentController
+	voice      *media.VoiceBuffer
+	decoder    *media.VoiceDecoder
+	started    chan struct{} // closed once the child start attempt is over
+	streams    sync.WaitGroup
+}
+
+// voiceCloseError ends a session with a WebSocket close code.
+type voiceCloseError struct {
+	code   int
+	reason string
+}
+
+func (e *voiceCloseError) Error() string { return e.reason }
+
+func (v *voiceSession) run() {
+	defer v.stop()
+	for {
+		v.conn.SetReadDeadline(time.Now().Add(voiceReadTimeout))
+		_, message, err := v.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				v.logger.Println("Connection closed by client")
+			} else if v.ctx.Err() == nil {
+				v.logger.Printf("Connection lost: %v", err)
+			}
+			return
+		}
+
+		var cmd voiceCommand
+		if err := json.Unmarshal(message, &cmd); err != nil {
+			v.logger.Printf("Ignoring malformed message: %v", err)
+			continue
+		}
+		if err := v.handle(&cmd); err != nil {
+			var closeErr *voiceCloseError
+			if errors.As(err, &closeErr) {
+				v.logger.Printf("Closing connection: %s", closeErr.reason)
+				v.close(closeErr.code, closeErr.reason)
+				return
+			}
+			v.logger.Printf("Error handling %s command (event %s): %v", cmd.Command, cmd.EventID, err)
+		}
+	}
+}
+
+func (v *voiceSession) handle(cmd *voiceCommand) error {
+	if cmd.Command != "init" && cmd.Command != "heartbeat" && v.opts == nil {
+		return fmt.Errorf("session is not initialized, send init first")
+	}
+
+	switch cmd.Command {
+	case "init":
+		return v.init(cmd)
+
+	case "voice":
+		encoding, err := media.ParseVoiceEncoding(cmd.Encoding)
+		if err != nil {
+			return err
+		}
+		audio, err := base64.StdEncoding.DecodeString(cmd.Audio)
+		if err != nil {
+			return fmt.Errorf("failed to decode base64 audio: %v", err)
+		}
+		pcm, err := v.decoder.Decode(audio, encoding, cmd.SampleRate)
+		if err != nil {
+			return err
+		}
+		v.controller.RecordActivity()
+		return v.voice.Write(pcm)
+
+	case "voice_end":
+		// Play the tail of the utterance instead of waiting for more audio
+		v.voice.End()
+		v.logger.Printf("Voice ended (event %s), %v of audio queued", cmd.EventID, v.voice.Buffered())
+
+	case "voice_interrupt":
+		// The next utterance does not continue the interrupted one
+		v.decoder.Reset()
+		dropped, err := v.controller.Interrupt(v.ctx)
+		v.logger.Printf("Voice interrupted (event %s), dropped %v of queued audio", cmd.EventID, dropped)
+		return err
+
+	case "heartbeat":
+		return v.writeJSON(voiceReply{Command: "heartbeat_ack", EventID: cmd.EventID, Timestamp: cmd.Timestamp})
+
+	case "special":
+		v.logger.Printf("Special instruction (event %s): %s", cmd.EventID, cmd.Content)
+
+	default:
+		return fmt.Errorf("unknown command %q", cmd.Command)
+	}
+	return nil
+}
+
+// init validates the session settings and starts a child publishing to the
+// session's channel. The child connects in the background, voice audio is
+// queued meanwhile.
+func (v *voiceSession) init(cmd *voiceCommand) error {
+	if v.opts != nil {
+		return fmt.Errorf("session is already initialized")
+	}
+	if cmd.SessionID == "" {
+		return &voiceCloseError{websocket.ClosePolicyViolation, "session_id is required"}
+	}
+	if v.sessionID != "" && cmd.SessionID != v.sessionID {
+		return &voiceCloseError{websocket.ClosePolicyViolation, "session token was not issued for this session"}
+	}
+	if cmd.Version != "v1" {
+		return &voiceCloseError{websocket.ClosePolicyViolation, fmt.Sprintf("unsupported version %q, expected v1", cmd.Version)}
+	}
+	if err := validateSessionSettings(cmd.AvatarID, cmd.Quality, cmd.VideoEncoding, cmd.AgoraSettings); err != nil {
+		return &voiceCloseError{websocket.ClosePolicyViolation, err.Error()}
+	}
+	if v.server.Settings != nil {
+		if started, ok := v.server.Settings(cmd.SessionID); ok {
+			if field := started.mismatch(cmd); field != "" {
+				return &voiceCloseError{websocket.ClosePolicyViolation, fmt.Sprintf("%s differs from the session started with the API", field)}
+			}
+		}
+	}
+	idleTimeout := defaultActivityIdleTimeout
+	if cmd.ActivityIdleTimeout != nil {
+		if *cmd.ActivityIdleTimeout < 0 {
+			return &voiceCloseError{websocket.ClosePolicyViolation, "activity_idle_timeout must be a non-negative number"}
+		}
+		idleTimeout = time.Duration(*cmd.ActivityIdleTimeout * float64(time.Second))
+	} else if v.server.IdleTimeout != nil {
+		if timeout, ok := v.server.IdleTimeout(cmd.SessionID); ok {
+			idleTimeout = timeout
+		}
+	}
+	v.logger.SetPrefix(fmt.Sprintf("[voice %s] ", cmd.SessionID))
+
+	opts := v.server.Template
+	settings := cmd.AgoraSettings
+	opts.AppID = settings.AppID
+	opts.Token = settings.Token
+	opts.ChannelName = settings.Channel
+	opts.UserID = settings.UID
+	opts.EnableStringUID = settings.EnableStringUID
+	codec, _ := media.ParseVideoCodec(cmd.VideoEncoding)
+	opts.VideoCodec = codec.String()
+	bitrates := videoQualities[cmd.Quality]
+	opts.VideoBitrate, opts.MinVideoBitrate = bitrates[0], bitrates[1]
+	opts.ActivityIdleTimeout = idleTimeout
+	// Children share the template's working directory, so each needs its
+	// own SDK log
+	opts.SDKLogPath = sessionLogPath(opts.SDKLogPath, cmd.SessionID)
+
+	// Voice audio is queued in the publisher's format
+	format := media.AudioFormat{SampleRate: opts.SampleRate, Channels: opts.AudioChannels}
+	decoder, err := media.NewVoiceDecoder(format, opts.ResampleQuality)
+	if err != nil {
+		return &voiceCloseError{websocket.CloseInternalServerErr, err.Error()}
+	}
+	v.voice = media.NewVoiceBuffer(format, v.server.MaxVoiceBuffer)
+	v.decoder = decoder
+	opts.AudioFile = ""
+	opts.AudioSource = v.voice
+	opts.EncodedAudioSource = nil
+	opts.EncodedAudio = false
+
+	if v.server.NewVideoSource != nil {
+		if err := v.server.NewVideoSource(&opts); err != nil {
+			return &voiceCloseError{websocket.CloseInternalServerErr, err.Error()}
+		}
+	}
+	v.opts = &opts
+
+	v.logger.Printf("Session initialized: avatar %s, %s quality, %s video, channel %s as %s, activity idle timeout %v",
+		cmd.AvatarID, cmd.Quality, opts.VideoCodec, opts.ChannelName, opts.UserID, idleTimeout)
+
+	v.controller = NewParentController(v.opts)
+	v.started = make(chan struct{})
+	go v.start(ContextWithSessionID(v.ctx, cmd.SessionID))
+	return nil
+}
+
+// mismatch returns the first field of a validated init command that differs
+// from the settings, or "". The Agora token may differ, a client can renew
+// it, but it only grants access to the same channel and uid.
+func (s sessionSettings) mismatch(cmd *voiceCommand) string {
+	codec, _ := media.ParseVideoCodec(s.VideoEncoding)
+	cmdCodec, _ := media.ParseVideoCodec(cmd.VideoEncoding)
+	agora := cmd.AgoraSettings
+	switch {
+	case cmd.AvatarID != s.AvatarID:
+		return "avatar_id"
+	case cmd.Quality != s.Quality:
+		return "quality"
+	case cmdCodec != codec:
+		return "video_encoding"
+	case agora.AppID != s.Agora.AppID:
+		return "agora_settings.app_id"
+	case agora.Channel != s.Agora.Channel:
+		return "agora_settings.channel"
+	case agora.UID != s.Agora.UID:
+		return "agora_settings.uid"
+	case agora.EnableStringUID != s.Agora.EnableStringUID:
+		return "agora_settings.enable_string_uid"
+	}
+	return ""
+}
+
+// sessionLogPath inserts the session ID before the extension of an SDK log
+// path, e.g. agora_child_sdk_<session>.log. Characters that are not safe in
+// a file name are replaced.
+func sessionLogPath(path, sessionID string) string {
+	if path == "" {
+		return ""
+	}
+	safeID := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, sessionID)
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "_" + safeID + ext
+}
+
+// start connects the child and streams until the connection ends.
+func (v *voiceSession) start(ctx context.Context) {
+	defer close(v.started)
+
+	startCtx, cancel := context.WithTimeout(ctx, v.server.ConnectTimeout)
+	err := v.controller.Start(startCtx, v.opts)
+	cancel()
+	if err != nil {
+		if v.ctx.Err() == nil {
+			v.logger.Printf("Failed to start child process: %v", err)
+			v.close(websocket.CloseInternalServerErr, "failed to join the Agora channel")
+		}
+		return
+	}
+
+	v.streams.Add(3)
+	go func() {
+		defer v.streams.Done()
+		v.controller.StreamAudio(v.ctx)
+	}()
+	go func() {
+		defer v.streams.Done()
+		v.controller.StreamVideo(v.ctx)
+	}()
+	go func() {
+		defer v.streams.Done()
+		v.watchEvents()
+	}()
+}
+
+// watchEvents logs supervision events and ends the session once the child
+// cannot be restarted.
+func (v *voiceSession) watchEvents() {
+	for {
+		select {
+		case <-v.ctx.Done():
+			return
+		case event := <-v.controller.Events():
+			switch event.Type {
+			case EventEndOfMedia:
+				v.logger.Printf("Controller event: %s (%s)", event.Type, event.Stream)
+				continue
+			case EventIdleWarning, EventIdleTimeout:
+				v.logger.Printf("Controller event: %s (idle=%v)", event.Type, event.Idle)
+				if event.Type == EventIdleTimeout {
+					// The controller is already stopping the child
+					v.close(websocket.CloseNormalClosure, ErrIdleTimeout.Error())
+					return
+				}
+				continue
+			}
+			v.logger.Printf("Controller event: %s (attempt=%d, backoff=%v, err=%v)",
+				event.Type, event.Attempt, event.Backoff, event.Err)
+			if event.Type == EventRestartsExhausted {
+				v.close(websocket.CloseInternalServerErr, "publisher failed")
+				return
+			}
+		}
+	}
+}
+
+// stop ends the streams and the child once the connection is gone.
+func (v *voiceSession) stop() {
+	v.cancel()
+	v.conn.Close()
+	if v.controller == nil {
+		return
+	}
+	<-v.started
+	v.voice.Close()
+	v.streams.Wait()
+
+	if result := v.controller.Stop(context.Background()); result != ShutdownClean {
+		v.logger.Printf("Child shutdown was not clean: %s", result)
+	}
+	// Per-session sources from NewVideoSource
+	if v.opts.VideoSource != nil {
+		v.opts.VideoSource.Close()
+	}
+	if v.opts.EncodedVideoSource != nil {
+		v.opts.EncodedVideoSource.Close()
+	}
+	v.logger.Println("Session stopped")
+}
+
+func (v *voiceSession) writeJSON(reply interface{}) error {
+	v.writeMu.Lock()
+	defer v.writeMu.Unlock()
+	v.conn.SetWriteDeadline(time.Now().Add(voiceWriteTimeout))
+	return v.conn.WriteJSON(reply)
+}
+
+// close sends a close frame and ends the read loop.
+func (v *voiceSession) close(code int, reason string) {
+	v.writeMu.Lock()
+	v.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(voiceWriteTimeout))
+	v.writeMu.Unlock()
+	v.cancel()
+	v.conn.Close()
+}
+
+// serveVoice runs server, and api unless it is nil, on addr until SIGINT
+// or SIGTERM.
+func serveVoice(server *VoiceServer, api *SessionAPI, addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/", server)
+	if api != nil {
+		api.Register(mux)
+	}
+	httpServer := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- httpServer.ListenAndServe()
+	}()
+	server.logger.Printf("Serving the ConvoAI voice protocol on ws://%s", addr)
+	if api != nil {
+		api.logger.Printf("Serving the session API on http://%s/session/start and /session/stop", addr)
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-serveErr:
+		return fmt.Errorf("failed to serve on %s: %v", addr, err)
+	case <-sigChan:
+		server.logger.Println("Received interrupt signal, shutting down...")
+	}
+
+	// Hijacked WebSocket connections are not closed by Shutdown
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	httpServer.Shutdown(ctx)
+	server.Close()
+	return nil
+}
@@ -0,0 +1,24 @@
+//go:build !child
+
+package main
+
+import "testing"
+
+func TestSessionLogPath(t *testing.T) {
+	tests := []struct {
+		path, sessionID, want string
+	}{
+		{"./agora_child_sdk.log", "abc-123", "./agora_child_sdk_abc-123.log"},
+		{"/var/log/publisher/sdk.log", "s1", "/var/log/publisher/sdk_s1.log"},
+		{"sdk", "s1", "sdk_s1"},
+		{"logs.d/sdk", "s1", "logs.d/sdk_s1"},
+		// Session IDs come from clients and must not leave the directory
+		{"sdk.log", "../../etc/x", "sdk_______etc_x.log"},
+		{"", "s1", ""},
+	}
+	for _, tt := range tests {
+		if got := sessionLogPath(tt.path, tt.sessionID); got != tt.want {
+			t.Errorf("sessionLogPath(%q, %q) = %q, want %q", tt.path, tt.sessionID, got, tt.want)
+		}
+	}
+}